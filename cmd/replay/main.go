@@ -0,0 +1,17 @@
+// Command replay feeds the captured batches of the Logs API through the pipeline of the extension, so that the issues
+// of the forwarders could be reproduced locally without deploying to Lambda, e.g.
+//
+//	go run ./cmd/replay --dry-run captured.ndjson
+//	go run ./cmd/replay --forwarder newrelic --newrelic-license-key <key> --new-request-ids --time-scale 1 captures/
+package main
+
+import (
+	"github.com/david7482/lambda-extension-log-shipper/shipper"
+
+	// the built-in forwarders are registered by importing their packages
+	_ "github.com/david7482/lambda-extension-log-shipper/forwardservice/forwarders/all"
+)
+
+func main() {
+	shipper.Replay()
+}
@@ -0,0 +1,320 @@
+package configfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultPath is the config file in the layer of the extension, which is optional
+const DefaultPath = "/opt/lambda-extension-log-shipper/config.yaml"
+
+const flagName = "config-file"
+
+// The sections of the config file
+const (
+	// General holds the settings by the flag names, e.g. `log-level`
+	General = "general"
+	// Processors holds the settings of each processor, e.g. `transform.operations` of the flag `transform-operations`
+	Processors = "processors"
+	// Forwarders holds the settings of each forwarder, e.g. `newrelic.license-key` of the flag `newrelic-license-key`
+	Forwarders = "forwarders"
+)
+
+// varRegexp matches the references to environment variables, e.g. `${NR_LICENSE_KEY}` or `${ENV:-dev}`, or the
+// escaped `$${`. Only the upper case names are references, so that `${level}` of transform operations is kept.
+var varRegexp = regexp.MustCompile(`\$\$\{|\$\{([A-Z_][A-Z0-9_]*)(:-([^}]*))?\}`)
+
+// File is a YAML or JSON config file whose settings are the defaults of the flags. The precedence is the command
+// line flags, the environment variables, the config file and then the defaults of the flags.
+//
+//	general:
+//	  log-level: debug
+//	  routes:
+//	    - type=platform.report -> newrelic
+//	spill:
+//	  max-bytes: 16777216
+//	processors:
+//	  transform:
+//	    operations: rename field.msg field.message
+//	forwarders:
+//	  newrelic:
+//	    license-key: ${NR_LICENSE_KEY}
+//
+// Other sections are the settings of the components by the prefix of their flags, e.g. `spill.max-bytes` of the flag
+// `spill-max-bytes`. A list is joined by the ListSeparator of the flag value, otherwise by `,`, and a map is
+// joined as `key=value` pairs by `,`.
+type File struct {
+	cfg config
+	// path is the path of the loaded file, empty if there is no config file
+	path string
+	doc  map[string]interface{}
+}
+
+type config struct {
+	Path *string
+}
+
+func New() *File {
+	return &File{}
+}
+
+func (f *File) SetupConfigs(app *kingpin.Application) {
+	f.cfg.Path = app.
+		Flag(flagName, "The YAML or JSON config file whose settings are the defaults of other flags").
+		Envar("LS_CONFIG_FILE").
+		Default(DefaultPath).String()
+}
+
+// Path returns the path of the loaded config file, empty if there is no config file
+func (f *File) Path() string {
+	return f.path
+}
+
+// Load reads the config file before the args are parsed. The default config file is optional, while the config file
+// set by flag or environment variable is required.
+func (f *File) Load(args []string) error {
+	path, ok := lookupArg(args, flagName)
+	if !ok {
+		path, ok = os.LookupEnv("LS_CONFIG_FILE")
+	}
+	if !ok || path == "" {
+		path = DefaultPath
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && path == DefaultPath {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("configfile: fail to read %s: %w", path, err)
+	}
+	if f.doc, err = parse(b); err != nil {
+		return fmt.Errorf("configfile: %s: %w", path, err)
+	}
+	f.path = path
+	return nil
+}
+
+// Apply sets the defaults of the flags by the settings of the loaded config file
+func (f *File) Apply(app *kingpin.Application) error {
+	if err := apply(app, f.doc); err != nil {
+		return fmt.Errorf("configfile: %s: %w", f.path, err)
+	}
+	return nil
+}
+
+// Lookup returns the value of the general setting before the args are parsed, which is for the settings deciding
+// other flags, e.g. the forwarder instances. The precedence is the same as parsing the args.
+func (f *File) Lookup(args []string, flag, envar string) (string, error) {
+	if value, ok := lookupArg(args, flag); ok {
+		return value, nil
+	}
+	if value, ok := os.LookupEnv(envar); ok {
+		return value, nil
+	}
+	general, _ := f.doc[General].(map[string]interface{})
+	value, ok := general[flag]
+	if !ok {
+		return "", nil
+	}
+	s, err := format(value, ",")
+	if err == nil {
+		s, err = interpolate(s)
+	}
+	if err != nil {
+		return "", fmt.Errorf("configfile: %s: invalid setting %s.%s: %w", f.path, General, flag, err)
+	}
+	return s, nil
+}
+
+// lookupArg returns the value of the flag from the args which have not been parsed yet
+func lookupArg(args []string, flag string) (string, bool) {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		switch {
+		case arg == "--"+flag && i+1 < len(args):
+			return args[i+1], true
+		case strings.HasPrefix(arg, "--"+flag+"="):
+			return strings.TrimPrefix(arg, "--"+flag+"="), true
+		}
+	}
+	return "", false
+}
+
+// Apply sets the defaults of the flags by the settings of the YAML or JSON document
+func Apply(app *kingpin.Application, b []byte) error {
+	doc, err := parse(b)
+	if err != nil {
+		return err
+	}
+	return apply(app, doc)
+}
+
+func parse(b []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("invalid YAML or JSON: %w", err)
+	}
+	return doc, nil
+}
+
+func apply(app *kingpin.Application, doc map[string]interface{}) error {
+	settings := make(map[string]setting)
+	for section, v := range doc {
+		items, ok := v.(map[string]interface{})
+		if !ok && v != nil {
+			return fmt.Errorf("%s should be a map", section)
+		}
+		switch section {
+		case General:
+			for key, value := range items {
+				settings[section+"."+key] = setting{flag: key, value: value}
+			}
+		case Processors, Forwarders:
+			for name, v := range items {
+				component, ok := v.(map[string]interface{})
+				if !ok && v != nil {
+					return fmt.Errorf("%s.%s should be a map", section, name)
+				}
+				for key, value := range component {
+					settings[section+"."+name+"."+key] = setting{flag: name + "-" + key, value: value}
+				}
+			}
+		default:
+			for key, value := range items {
+				settings[section+"."+key] = setting{flag: section + "-" + key, value: value}
+			}
+		}
+	}
+
+	// The settings are applied in order, so that the errors are deterministic
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := settings[key].apply(app, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListSeparator is implemented by the flag values whose items are not separated by `,`. ListSeparator returns the
+// separator to join the items of a list setting.
+type ListSeparator interface {
+	ListSeparator() string
+}
+
+// setting is the value of a flag in the config file
+type setting struct {
+	flag  string
+	value interface{}
+}
+
+func (s setting) apply(app *kingpin.Application, key string) error {
+	flag := app.GetFlag(s.flag)
+	if flag == nil || flag.Model().Hidden {
+		return fmt.Errorf("unknown setting %s, there is no flag --%s", key, s.flag)
+	}
+	model := flag.Model()
+	if model.Required || model.Name == flagName || model.Name == "help" {
+		return fmt.Errorf("setting %s could not be set in config file", key)
+	}
+
+	separator := ","
+	if l, ok := model.Value.(ListSeparator); ok {
+		separator = l.ListSeparator()
+	}
+	value, err := format(s.value, separator)
+	if err != nil {
+		return fmt.Errorf("invalid setting %s: %w", key, err)
+	}
+	if value, err = interpolate(value); err != nil {
+		return fmt.Errorf("invalid setting %s: %w", key, err)
+	}
+
+	// The value is validated by the flag, which is set again from the default when the args are parsed
+	if err := model.Value.Set(value); err != nil {
+		return fmt.Errorf("invalid setting %s: %w", key, err)
+	}
+	flag.Default(value)
+	return nil
+}
+
+// format converts the YAML value into the string value of the flag
+func format(v interface{}, separator string) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			if _, ok := item.([]interface{}); ok {
+				return "", fmt.Errorf("nested list is not supported")
+			}
+			s, err := format(item, separator)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, separator), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		items := make([]string, 0, len(v))
+		for _, key := range keys {
+			switch v[key].(type) {
+			case []interface{}, map[string]interface{}:
+				return "", fmt.Errorf("nested value of %s is not supported", key)
+			}
+			s, err := format(v[key], separator)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, key+"="+s)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+// interpolate replaces the references to environment variables. An unset variable without default is an error.
+func interpolate(s string) (string, error) {
+	var err error
+	result := varRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		m := varRegexp.FindStringSubmatch(ref)
+		if value, ok := os.LookupEnv(m[1]); ok {
+			return value
+		}
+		if m[2] != "" {
+			return m[3]
+		}
+		if err == nil {
+			err = fmt.Errorf("environment variable %s is not set", m[1])
+		}
+		return ""
+	})
+	return result, err
+}
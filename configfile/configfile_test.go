@@ -0,0 +1,178 @@
+package configfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// testList is a flag value whose items are separated by `;`
+type testList string
+
+func (l *testList) Set(value string) error { *l = testList(value); return nil }
+func (l *testList) String() string         { return string(*l) }
+func (l *testList) ListSeparator() string  { return "; " }
+
+type testConfig struct {
+	LogLevel   *string
+	Routes     *testList
+	Formats    *string
+	MaxBytes   *int
+	Rules      *string
+	Enable     *bool
+	LicenseKey *string
+	Labels     *string
+	Timeout    *time.Duration
+}
+
+func newTestApp() (*kingpin.Application, *testConfig) {
+	app := kingpin.New("test", "")
+	var cfg testConfig
+	app.Flag("lambda-name", "The name of the lambda function").Envar("TEST_LAMBDA_NAME").Required().String()
+	cfg.LogLevel = app.Flag("log-level", "The level").Envar("TEST_LOG_LEVEL").Default("info").Enum("error", "info", "debug")
+	cfg.Routes = new(testList)
+	app.Flag("routes", "The routing rules").Default("").SetValue(cfg.Routes)
+	cfg.Formats = app.Flag("parse-formats", "The comma separated formats").Default("json").String()
+	cfg.MaxBytes = app.Flag("spill-max-bytes", "The maximum size").Default("100").Int()
+	cfg.Rules = app.Flag("logmetrics-rules", "The semicolon separated rules").Default("").String()
+	cfg.Enable = app.Flag("newrelic-enable", "Enable").Default("true").Bool()
+	cfg.LicenseKey = app.Flag("newrelic-license-key", "The key").Default("").String()
+	cfg.Labels = app.Flag("promremotewrite-labels", "The comma separated labels").Default("").String()
+	cfg.Timeout = app.Flag("promremotewrite-timeout", "The timeout").Default("5s").Duration()
+	app.Flag("forwarder-instances", "The comma separated instances").Default("").String()
+	return app, &cfg
+}
+
+func TestApply(t *testing.T) {
+	os.Setenv("TEST_NR_LICENSE_KEY", "secret")
+	defer os.Unsetenv("TEST_NR_LICENSE_KEY")
+
+	app, cfg := newTestApp()
+	require.NoError(t, Apply(app, []byte(`
+general:
+  log-level: debug
+  routes:
+    - type=platform.report -> newrelic
+    - level>=error -> stdout
+  parse-formats: [json, logfmt]
+spill:
+  max-bytes: 2048
+processors:
+  logmetrics:
+    rules:
+      - counter errors when content~ERROR
+forwarders:
+  newrelic:
+    enable: false
+    license-key: ${TEST_NR_LICENSE_KEY}
+  promremotewrite:
+    labels:
+      env: ${TEST_ENV:-dev}
+      team: orders
+    timeout: 10s
+`)))
+	_, err := app.Parse([]string{"--lambda-name", "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, "debug", *cfg.LogLevel)
+	assert.Equal(t, "type=platform.report -> newrelic; level>=error -> stdout", cfg.Routes.String())
+	assert.Equal(t, "json,logfmt", *cfg.Formats)
+	assert.Equal(t, 2048, *cfg.MaxBytes)
+	assert.Equal(t, "counter errors when content~ERROR", *cfg.Rules)
+	assert.False(t, *cfg.Enable)
+	assert.Equal(t, "secret", *cfg.LicenseKey)
+	assert.Equal(t, "env=dev,team=orders", *cfg.Labels)
+	assert.Equal(t, 10*time.Second, *cfg.Timeout)
+}
+
+func TestApply_precedence(t *testing.T) {
+	os.Setenv("TEST_LOG_LEVEL", "error")
+	defer os.Unsetenv("TEST_LOG_LEVEL")
+
+	app, cfg := newTestApp()
+	require.NoError(t, Apply(app, []byte(`{"general": {"log-level": "debug", "parse-formats": "logfmt"}, "spill": {"max-bytes": 1}}`)))
+	_, err := app.Parse([]string{"--lambda-name", "hello", "--parse-formats", "json"})
+	require.NoError(t, err)
+	// flags > env > file > defaults
+	assert.Equal(t, "json", *cfg.Formats)
+	assert.Equal(t, "error", *cfg.LogLevel)
+	assert.Equal(t, 1, *cfg.MaxBytes)
+	assert.Equal(t, "", cfg.Routes.String())
+}
+
+func TestApply_invalid(t *testing.T) {
+	tests := []struct {
+		doc     string
+		wantErr string
+	}{
+		{doc: "general: [", wantErr: "invalid YAML or JSON"},
+		{doc: "general: debug", wantErr: "general should be a map"},
+		{doc: "general:\n  log-levle: debug", wantErr: "unknown setting general.log-levle, there is no flag --log-levle"},
+		{doc: "forwarders:\n  newrelc:\n    enable: true", wantErr: "unknown setting forwarders.newrelc.enable, there is no flag --newrelc-enable"},
+		{doc: "forwarders:\n  newrelic: true", wantErr: "forwarders.newrelic should be a map"},
+		{doc: "general:\n  lambda-name: hello", wantErr: "setting general.lambda-name could not be set in config file"},
+		{doc: "general:\n  log-level: trace", wantErr: "invalid setting general.log-level"},
+		{doc: "spill:\n  max-bytes: many", wantErr: "invalid setting spill.max-bytes"},
+		{doc: "general:\n  routes: [[a]]", wantErr: "nested list is not supported"},
+		{doc: "forwarders:\n  newrelic:\n    license-key: ${TEST_UNSET_KEY}", wantErr: "environment variable TEST_UNSET_KEY is not set"},
+	}
+	for _, tt := range tests {
+		app, _ := newTestApp()
+		err := Apply(app, []byte(tt.doc))
+		require.Error(t, err, tt.doc)
+		assert.Contains(t, err.Error(), tt.wantErr)
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	os.Setenv("TEST_ENV", "prod")
+	defer os.Unsetenv("TEST_ENV")
+
+	s, err := interpolate("set field.env ${TEST_ENV}; set field.level ${level}; set field.raw $${TEST_ENV}; ${TEST_UNSET:-x}")
+	require.NoError(t, err)
+	assert.Equal(t, "set field.env prod; set field.level ${level}; set field.raw ${TEST_ENV}; x", s)
+}
+
+func TestFile_Load(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"general": {"log-level": "debug", "forwarder-instances": ["newrelic-team", "newrelic-platform"]}}`), 0600))
+
+	app, cfg := newTestApp()
+	f := New()
+	f.SetupConfigs(app)
+	require.NoError(t, f.Load([]string{"--config-file", path}))
+	assert.Equal(t, path, f.Path())
+	require.NoError(t, f.Apply(app))
+	_, err = app.Parse([]string{"--lambda-name", "hello", "--config-file", path})
+	require.NoError(t, err)
+	assert.Equal(t, "debug", *cfg.LogLevel)
+
+	// The config file set explicitly is required
+	f = New()
+	assert.Error(t, f.Load([]string{"--config-file=" + filepath.Join(dir, "missing.yaml")}))
+
+	os.Setenv("LS_CONFIG_FILE", path)
+	defer os.Unsetenv("LS_CONFIG_FILE")
+	f = New()
+	require.NoError(t, f.Load(nil))
+	assert.Equal(t, path, f.Path())
+
+	// The settings deciding other flags are looked up before the args are parsed
+	value, err := f.Lookup(nil, "forwarder-instances", "TEST_FORWARDER_INSTANCES")
+	require.NoError(t, err)
+	assert.Equal(t, "newrelic-team,newrelic-platform", value)
+	value, err = f.Lookup([]string{"--forwarder-instances=stdout-debug"}, "forwarder-instances", "TEST_FORWARDER_INSTANCES")
+	require.NoError(t, err)
+	assert.Equal(t, "stdout-debug", value)
+	value, err = f.Lookup(nil, "tags", "TEST_TAGS")
+	require.NoError(t, err)
+	assert.Equal(t, "", value)
+}
@@ -0,0 +1,25 @@
+// Package configtest parses the kingpin configs of components in tests, so that a component is built with the same
+// flags and defaults as the extension:
+//
+//	r := redact.New()
+//	configtest.Parse(t, r.SetupConfigs, "--redact-detectors=email")
+//	r.Init()
+package configtest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Parse creates an application, sets up the configs on it and parses the args. The test fails if the args are
+// invalid.
+func Parse(t testing.TB, setup func(app *kingpin.Application), args ...string) *kingpin.Application {
+	t.Helper()
+	app := kingpin.New("test", "")
+	setup(app)
+	_, err := app.Parse(args)
+	require.NoError(t, err)
+	return app
+}
@@ -0,0 +1,133 @@
+package emf
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Unit is the unit of a metric
+type Unit string
+
+const (
+	Count        Unit = "Count"
+	Bytes        Unit = "Bytes"
+	Milliseconds Unit = "Milliseconds"
+	Megabytes    Unit = "Megabytes"
+	None         Unit = "None"
+)
+
+// units are all the units supported by CloudWatch
+var units = map[Unit]bool{
+	"Seconds": true, "Microseconds": true, "Milliseconds": true,
+	"Bytes": true, "Kilobytes": true, "Megabytes": true, "Gigabytes": true, "Terabytes": true,
+	"Bits": true, "Kilobits": true, "Megabits": true, "Gigabits": true, "Terabits": true,
+	"Percent": true, "Count": true, "None": true,
+	"Bytes/Second": true, "Kilobytes/Second": true, "Megabytes/Second": true, "Gigabytes/Second": true,
+	"Terabytes/Second": true, "Bits/Second": true, "Kilobits/Second": true, "Megabits/Second": true,
+	"Gigabits/Second": true, "Terabits/Second": true, "Count/Second": true,
+}
+
+// IsValid tells whether the unit is supported by CloudWatch
+func (u Unit) IsValid() bool {
+	return units[u]
+}
+
+// maxMetrics is the maximum number of metrics of a document
+const maxMetrics = 100
+
+// Metric is a value, or the distribution of values, of a document
+type Metric struct {
+	Name  string
+	Unit  Unit
+	Value float64
+	// Values and Counts are the distribution of the metric, e.g. the buckets of a histogram. Value is ignored if
+	// Values is set.
+	Values []float64
+	Counts []float64
+}
+
+// Document is a CloudWatch Embedded Metric Format document of the metrics sharing the same namespace and dimensions.
+// The metrics are extracted by CloudWatch when the document is written to CloudWatch Logs.
+// See https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+type Document struct {
+	Namespace string
+	Timestamp time.Time
+	// Dimensions are the names and values of the dimensions, e.g. FunctionName
+	Dimensions map[string]string
+	// Properties are the extra fields of the document which are not dimensions, e.g. requestId
+	Properties map[string]interface{}
+	Metrics    []Metric
+}
+
+type metadata struct {
+	Timestamp         int64             `json:"Timestamp"`
+	CloudWatchMetrics []metricDirective `json:"CloudWatchMetrics"`
+}
+
+type metricDirective struct {
+	Namespace  string             `json:"Namespace"`
+	Dimensions [][]string         `json:"Dimensions"`
+	Metrics    []metricDefinition `json:"Metrics"`
+}
+
+type metricDefinition struct {
+	Name string `json:"Name"`
+	Unit Unit   `json:"Unit,omitempty"`
+}
+
+type distribution struct {
+	Values []float64 `json:"Values"`
+	Counts []float64 `json:"Counts"`
+}
+
+// MarshalJSON writes the document in EMF. The dimensions and metrics override the properties of the same names.
+func (d Document) MarshalJSON() ([]byte, error) {
+	if len(d.Metrics) > maxMetrics {
+		return nil, fmt.Errorf("emf: too many metrics: %d", len(d.Metrics))
+	}
+
+	dimensions := make([]string, 0, len(d.Dimensions))
+	for name := range d.Dimensions {
+		dimensions = append(dimensions, name)
+	}
+	sort.Strings(dimensions)
+
+	directive := metricDirective{
+		Namespace:  d.Namespace,
+		Dimensions: [][]string{dimensions},
+	}
+	doc := make(map[string]interface{}, len(d.Properties)+len(d.Dimensions)+len(d.Metrics)+1)
+	for k, v := range d.Properties {
+		doc[k] = v
+	}
+	for k, v := range d.Dimensions {
+		doc[k] = v
+	}
+	for _, m := range d.Metrics {
+		directive.Metrics = append(directive.Metrics, metricDefinition{Name: m.Name, Unit: m.Unit})
+		if m.Values != nil {
+			doc[m.Name] = distribution{Values: m.Values, Counts: m.Counts}
+		} else {
+			doc[m.Name] = m.Value
+		}
+	}
+	doc["_aws"] = metadata{
+		Timestamp:         d.Timestamp.UnixNano() / 1e6,
+		CloudWatchMetrics: []metricDirective{directive},
+	}
+	return json.Marshal(doc)
+}
+
+// Split returns the documents of at most 100 metrics each, which is the limit of EMF
+func (d Document) Split() []Document {
+	var docs []Document
+	for len(d.Metrics) > maxMetrics {
+		part := d
+		part.Metrics = d.Metrics[:maxMetrics]
+		docs = append(docs, part)
+		d.Metrics = d.Metrics[maxMetrics:]
+	}
+	return append(docs, d)
+}
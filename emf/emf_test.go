@@ -0,0 +1,56 @@
+package emf
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDocument_MarshalJSON(t *testing.T) {
+	doc := Document{
+		Namespace:  "LambdaExtensionLogShipper",
+		Timestamp:  time.Unix(1600000000, 0),
+		Dimensions: map[string]string{"FunctionName": "hello", "Forwarder": "newrelic"},
+		Properties: map[string]interface{}{"requestId": "6f7f0961", "FunctionName": "overridden"},
+		Metrics: []Metric{
+			{Name: "ForwarderSent", Unit: Count, Value: 3},
+			{Name: "ForwarderLatency", Unit: Milliseconds, Values: []float64{10, 100}, Counts: []float64{2, 1}},
+		},
+	}
+	b, err := doc.MarshalJSON()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"_aws": {
+			"Timestamp": 1600000000000,
+			"CloudWatchMetrics": [{
+				"Namespace": "LambdaExtensionLogShipper",
+				"Dimensions": [["Forwarder", "FunctionName"]],
+				"Metrics": [{"Name": "ForwarderSent", "Unit": "Count"}, {"Name": "ForwarderLatency", "Unit": "Milliseconds"}]
+			}]
+		},
+		"FunctionName": "hello",
+		"Forwarder": "newrelic",
+		"requestId": "6f7f0961",
+		"ForwarderSent": 3,
+		"ForwarderLatency": {"Values": [10, 100], "Counts": [2, 1]}
+	}`, string(b))
+}
+
+func TestDocument_Split(t *testing.T) {
+	doc := Document{Namespace: "test"}
+	for i := 0; i < 250; i++ {
+		doc.Metrics = append(doc.Metrics, Metric{Name: fmt.Sprintf("metric%d", i), Value: float64(i)})
+	}
+	_, err := doc.MarshalJSON()
+	assert.Error(t, err)
+
+	docs := doc.Split()
+	require.Len(t, docs, 3)
+	assert.Len(t, docs[0].Metrics, 100)
+	assert.Len(t, docs[1].Metrics, 100)
+	assert.Len(t, docs[2].Metrics, 50)
+	assert.Equal(t, "metric200", docs[2].Metrics[0].Name)
+}
@@ -0,0 +1,72 @@
+// custom-forwarder is a binary of the extension with a private forwarder, which writes the content of logs to stderr
+// and implements forwardservice.ForwarderV2
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/forwardservice"
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/shipper"
+
+	// the built-in forwarders are kept by importing their packages
+	_ "github.com/david7482/lambda-extension-log-shipper/forwardservice/forwarders/all"
+)
+
+type Stderr struct {
+	name   string
+	enable *bool
+	out    *bufio.Writer
+}
+
+func init() {
+	forwardservice.Register("stderr", func(instance string) forwardservice.ForwarderV2 {
+		return &Stderr{name: forwardservice.InstanceName("stderr", instance), out: bufio.NewWriter(os.Stderr)}
+	})
+}
+
+func (s *Stderr) Name() string {
+	return s.name
+}
+
+func (s *Stderr) SetupConfigs(app *kingpin.Application) {
+	s.enable = app.
+		Flag(s.name+"-enable", fmt.Sprintf("Enable the %s forwarder", s.name)).
+		Envar(forwardservice.EnvarName(s.name, "ENABLE")).
+		Default("false").Bool()
+}
+
+func (s *Stderr) Init(_ forwardservice.ForwarderParams) error {
+	return nil
+}
+
+func (s *Stderr) IsEnable() bool {
+	return *s.enable
+}
+
+// Send buffers the logs, which are written when the buffer is full or flushed
+func (s *Stderr) Send(_ context.Context, logs []logservice.Log) error {
+	for _, log := range logs {
+		if _, err := fmt.Fprintf(s.out, "%s %s\n", log.Type, log.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Stderr) Flush(_ context.Context) error {
+	return s.out.Flush()
+}
+
+func (s *Stderr) Shutdown(_ context.Context) error {
+	return nil
+}
+
+func main() {
+	shipper.Main()
+}
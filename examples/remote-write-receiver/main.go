@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/david7482/lambda-extension-log-shipper/forwardservice/forwarders/promremotewrite"
+)
+
+// A local remote write endpoint which prints the received time series, e.g.
+//
+//	go run ./examples/remote-write-receiver -addr :9201
+//	LS_PROMREMOTEWRITE_URL=http://localhost:9201/api/v1/push
+func main() {
+	addr := flag.String("addr", ":9201", "The listen address")
+	username := flag.String("username", "", "The username of basic authentication")
+	password := flag.String("password", "", "The password of basic authentication")
+	bearerToken := flag.String("bearer-token", "", "The bearer token of the requests")
+	flag.Parse()
+
+	receiver := &promremotewrite.Receiver{
+		Username:    *username,
+		Password:    *password,
+		BearerToken: *bearerToken,
+		OnWrite: func(series []promremotewrite.TimeSeries) {
+			for _, ts := range series {
+				fmt.Println(ts)
+			}
+		},
+	}
+	http.Handle("/api/v1/push", receiver)
+	log.Printf("listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
@@ -0,0 +1,53 @@
+package extension
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorType is reported to the Extensions API by InitError or ExitError, in the form of Category.Reason
+type ErrorType string
+
+const (
+	// ConfigInvalid is the error of invalid configs, e.g. unknown forwarders or secrets which could not be resolved
+	ConfigInvalid ErrorType = "Extension.ConfigInvalid"
+	// SubscribeFailed is the error of subscribing to the Logs API
+	SubscribeFailed ErrorType = "Extension.SubscribeFailed"
+	// ListenFailed is the error of the log service listening for the logs
+	ListenFailed ErrorType = "Extension.ListenFailed"
+	// ForwarderInitFailed is the error of initializing a forwarder
+	ForwarderInitFailed ErrorType = "Extension.ForwarderInitFailed"
+	// Unknown is the type of the errors which are not typed
+	Unknown ErrorType = "Extension.Unknown"
+)
+
+// Error is an error with the type to report to the Extensions API
+type Error struct {
+	Type ErrorType
+	Err  error
+}
+
+// NewError returns the error with its type, or nil if err is nil
+func NewError(errorType ErrorType, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Type: errorType, Err: err}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %v", e.Type, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// TypeOf returns the type of the error, or Unknown if it is not typed
+func TypeOf(err error) ErrorType {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Type
+	}
+	return Unknown
+}
@@ -0,0 +1,20 @@
+package extension
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypeOf(t *testing.T) {
+	cause := errors.New("address already in use")
+	err := fmt.Errorf("log service: %w", NewError(ListenFailed, cause))
+	assert.Equal(t, ListenFailed, TypeOf(err))
+	assert.True(t, errors.Is(err, cause))
+	assert.Equal(t, "log service: Extension.ListenFailed: address already in use", err.Error())
+
+	assert.Equal(t, Unknown, TypeOf(cause))
+	assert.NoError(t, NewError(ConfigInvalid, nil))
+}
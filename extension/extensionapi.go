@@ -23,6 +23,8 @@ type NextEventResponse struct {
 	RequestID          string    `json:"requestId"`
 	InvokedFunctionArn string    `json:"invokedFunctionArn"`
 	Tracing            Tracing   `json:"tracing"`
+	// ShutdownReason is only set for the SHUTDOWN event
+	ShutdownReason ShutdownReason `json:"shutdownReason"`
 }
 
 // Tracing is part of the response for /event/next
@@ -47,6 +49,20 @@ const (
 	Shutdown EventType = "SHUTDOWN"
 )
 
+// ShutdownReason represents the reason of the SHUTDOWN event
+type ShutdownReason string
+
+const (
+	// Spindown is a normal shutdown of the idle environment
+	Spindown ShutdownReason = "spindown"
+
+	// Timeout is a shutdown after the function or an extension times out
+	Timeout ShutdownReason = "timeout"
+
+	// Failure is a shutdown after the function or an extension fails, e.g. out of memory
+	Failure ShutdownReason = "failure"
+)
+
 const (
 	extensionNameHeader       = "Lambda-Extension-Name"
 	extensionIdentifierHeader = "Lambda-Extension-Identifier"
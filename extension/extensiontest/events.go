@@ -0,0 +1,71 @@
+package extensiontest
+
+import (
+	"time"
+)
+
+// Event is an event of the Logs API
+type Event struct {
+	Time   time.Time   `json:"time"`
+	Type   string      `json:"type"`
+	Record interface{} `json:"record"`
+}
+
+// PlatformStart returns the platform.start event of the invocation
+func PlatformStart(requestID string) Event {
+	return Event{
+		Time: time.Now().UTC(),
+		Type: "platform.start",
+		Record: map[string]interface{}{
+			"requestId": requestID,
+			"version":   "$LATEST",
+		},
+	}
+}
+
+// Function returns the function event of the line
+func Function(line string) Event {
+	return Event{Time: time.Now().UTC(), Type: "function", Record: line}
+}
+
+// PlatformRuntimeDone returns the platform.runtimeDone event of the invocation
+func PlatformRuntimeDone(requestID string) Event {
+	return Event{
+		Time: time.Now().UTC(),
+		Type: "platform.runtimeDone",
+		Record: map[string]interface{}{
+			"requestId": requestID,
+			"status":    "success",
+		},
+	}
+}
+
+// PlatformReport returns the platform.report event of the invocation which takes durationMs
+func PlatformReport(requestID string, durationMs float64) Event {
+	return Event{
+		Time: time.Now().UTC(),
+		Type: "platform.report",
+		Record: map[string]interface{}{
+			"requestId": requestID,
+			"metrics": map[string]interface{}{
+				"durationMs":       durationMs,
+				"billedDurationMs": int(durationMs) + 1,
+				"memorySizeMB":     128,
+				"maxMemoryUsedMB":  64,
+			},
+		},
+	}
+}
+
+// PlatformLogsDropped returns the platform.logsDropped event of the dropped records
+func PlatformLogsDropped(droppedRecords, droppedBytes int) Event {
+	return Event{
+		Time: time.Now().UTC(),
+		Type: "platform.logsDropped",
+		Record: map[string]interface{}{
+			"reason":         "Consumer seems to have fallen behind as it has not acknowledged receipt of logs.",
+			"droppedRecords": droppedRecords,
+			"droppedBytes":   droppedBytes,
+		},
+	}
+}
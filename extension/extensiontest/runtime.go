@@ -0,0 +1,292 @@
+// Package extensiontest emulates the Lambda runtime for end-to-end tests of the extension. The Runtime serves the
+// Extensions API and the Logs API, and drives the extension by a script of invocations and a shutdown:
+//
+//	rt := extensiontest.NewRuntime()
+//	defer rt.Close()
+//	// start the extension with rt.Addr() as AWS_LAMBDA_RUNTIME_API, and then
+//	err := rt.WaitSubscribed(ctx)
+//	err = rt.Invoke(ctx, "request-1", "hello", "world")
+//	err = rt.Shutdown(ctx, extension.Spindown, 2*time.Second)
+package extensiontest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/david7482/lambda-extension-log-shipper/extension"
+)
+
+const (
+	extensionNameHeader       = "Lambda-Extension-Name"
+	extensionIdentifierHeader = "Lambda-Extension-Identifier"
+	extensionErrorType        = "Lambda-Extension-Function-Error-Type"
+
+	// extensionID is the identifier of the registered extension
+	extensionID = "extensiontest-id"
+)
+
+// ReportedError is an error reported by the extension to /init/error or /exit/error
+type ReportedError struct {
+	// Phase is either "init" or "exit"
+	Phase string
+	Type  extension.ErrorType
+}
+
+// Runtime emulates the Extensions API and the Logs API of the Lambda runtime
+type Runtime struct {
+	FunctionName    string
+	FunctionVersion string
+	Handler         string
+	// InvokedFunctionArn is sent with the INVOKE events
+	InvokedFunctionArn string
+
+	server *httptest.Server
+	client *http.Client
+	// events are taken by the long polling of /event/next
+	events chan extension.NextEventResponse
+	// closed releases the long polling when the runtime is closed
+	closed chan struct{}
+
+	mu            sync.Mutex
+	extensionName string
+	destination   string
+	subscribed    chan struct{}
+	errs          []ReportedError
+}
+
+// NewRuntime starts the runtime, which is closed by Close
+func NewRuntime() *Runtime {
+	r := &Runtime{
+		FunctionName:       "function",
+		FunctionVersion:    "$LATEST",
+		Handler:            "index.handler",
+		InvokedFunctionArn: "arn:aws:lambda:us-east-1:123456789012:function:function",
+		client:             &http.Client{Timeout: 5 * time.Second},
+		events:             make(chan extension.NextEventResponse),
+		closed:             make(chan struct{}),
+		subscribed:         make(chan struct{}),
+	}
+
+	router := http.NewServeMux()
+	router.HandleFunc("/2020-01-01/extension/register", r.register)
+	router.HandleFunc("/2020-01-01/extension/event/next", r.next)
+	router.HandleFunc("/2020-01-01/extension/init/error", r.reportError("init"))
+	router.HandleFunc("/2020-01-01/extension/exit/error", r.reportError("exit"))
+	router.HandleFunc("/2020-08-15/logs", r.subscribe)
+	router.HandleFunc("/2022-07-01/telemetry", r.subscribe)
+	r.server = httptest.NewServer(router)
+	return r
+}
+
+// Addr returns the address of the runtime, which is the AWS_LAMBDA_RUNTIME_API of the extension
+func (r *Runtime) Addr() string {
+	return r.server.Listener.Addr().String()
+}
+
+// Close stops the runtime
+func (r *Runtime) Close() {
+	close(r.closed)
+	r.server.Close()
+}
+
+// ExtensionName returns the name of the registered extension, or empty if it is not registered
+func (r *Runtime) ExtensionName() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.extensionName
+}
+
+// Errors returns the errors reported by the extension
+func (r *Runtime) Errors() []ReportedError {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]ReportedError(nil), r.errs...)
+}
+
+// WaitSubscribed waits until the extension subscribes to the Logs API
+func (r *Runtime) WaitSubscribed(ctx context.Context) error {
+	select {
+	case <-r.subscribed:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("extensiontest: not subscribed: %w", ctx.Err())
+	}
+}
+
+// Invoke sends the INVOKE event once the extension waits for the next event, and then the logs of the invocation:
+// platform.start, a function log of each line, platform.runtimeDone and platform.report
+func (r *Runtime) Invoke(ctx context.Context, requestID string, lines ...string) error {
+	if err := r.SendInvoke(ctx, requestID); err != nil {
+		return err
+	}
+
+	events := []Event{PlatformStart(requestID)}
+	for _, line := range lines {
+		events = append(events, Function(line))
+	}
+	events = append(events, PlatformRuntimeDone(requestID), PlatformReport(requestID, 12.5))
+	return r.SendLogs(ctx, events...)
+}
+
+// SendInvoke sends the INVOKE event once the extension waits for the next event, without the logs of the invocation.
+// They are sent by SendLogs, e.g. after the SHUTDOWN event as the Logs API flushes the logs of the last invocation.
+func (r *Runtime) SendInvoke(ctx context.Context, requestID string) error {
+	return r.send(ctx, extension.NextEventResponse{
+		EventType:          extension.Invoke,
+		DeadlineMs:         time.Now().Add(3*time.Second).UnixNano() / int64(time.Millisecond),
+		RequestID:          requestID,
+		InvokedFunctionArn: r.InvokedFunctionArn,
+		Tracing: extension.Tracing{
+			Type:  "X-Amzn-Trace-Id",
+			Value: "Root=1-5f35ae12-0c0fec141ab77a00bc047aa2;Parent=2be948a625588e32;Sampled=1",
+		},
+	})
+}
+
+// Shutdown sends the SHUTDOWN event with the time until its deadline once the extension waits for the next event
+func (r *Runtime) Shutdown(ctx context.Context, reason extension.ShutdownReason, timeout time.Duration) error {
+	return r.send(ctx, extension.NextEventResponse{
+		EventType:      extension.Shutdown,
+		DeadlineMs:     time.Now().Add(timeout).UnixNano() / int64(time.Millisecond),
+		ShutdownReason: reason,
+	})
+}
+
+// SendLogs posts a batch of the events to the subscriber of the Logs API
+func (r *Runtime) SendLogs(ctx context.Context, events ...Event) error {
+	if err := r.WaitSubscribed(ctx); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	destination := r.destination
+	r.mu.Unlock()
+
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", destination, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("extensiontest: fail to send logs, status: %s", res.Status)
+	}
+	return nil
+}
+
+func (r *Runtime) send(ctx context.Context, event extension.NextEventResponse) error {
+	select {
+	case r.events <- event:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("extensiontest: %s event not taken: %w", event.EventType, ctx.Err())
+	}
+}
+
+func (r *Runtime) register(w http.ResponseWriter, req *http.Request) {
+	name := req.Header.Get(extensionNameHeader)
+	if req.Method != "POST" || name == "" {
+		http.Error(w, "invalid register request", http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	r.extensionName = name
+	r.mu.Unlock()
+
+	w.Header().Set(extensionIdentifierHeader, extensionID)
+	writeJSON(w, extension.RegisterResponse{
+		FunctionName:    r.FunctionName,
+		FunctionVersion: r.FunctionVersion,
+		Handler:         r.Handler,
+	})
+}
+
+func (r *Runtime) next(w http.ResponseWriter, req *http.Request) {
+	if !authorized(w, req) {
+		return
+	}
+	select {
+	case event := <-r.events:
+		writeJSON(w, event)
+	case <-r.closed:
+		http.Error(w, "runtime is closed", http.StatusServiceUnavailable)
+	case <-req.Context().Done():
+	}
+}
+
+func (r *Runtime) reportError(phase string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !authorized(w, req) {
+			return
+		}
+		r.mu.Lock()
+		r.errs = append(r.errs, ReportedError{Phase: phase, Type: extension.ErrorType(req.Header.Get(extensionErrorType))})
+		r.mu.Unlock()
+		writeJSON(w, extension.StatusResponse{Status: "OK"})
+	}
+}
+
+func (r *Runtime) subscribe(w http.ResponseWriter, req *http.Request) {
+	if !authorized(w, req) {
+		return
+	}
+	var body struct {
+		Destination struct {
+			URI string `json:"URI"`
+		} `json:"destination"`
+	}
+	data, err := ioutil.ReadAll(req.Body)
+	if err == nil {
+		err = json.Unmarshal(data, &body)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	destination, err := url.Parse(body.Destination.URI)
+	if err != nil || destination.Port() == "" {
+		http.Error(w, "invalid destination", http.StatusBadRequest)
+		return
+	}
+	// sandbox is the hostname of the execution environment
+	if destination.Hostname() == "sandbox" {
+		destination.Host = net.JoinHostPort("127.0.0.1", destination.Port())
+	}
+
+	r.mu.Lock()
+	if r.destination == "" {
+		close(r.subscribed)
+	}
+	r.destination = destination.String()
+	r.mu.Unlock()
+	_, _ = w.Write([]byte("OK"))
+}
+
+func authorized(w http.ResponseWriter, req *http.Request) bool {
+	if req.Header.Get(extensionIdentifierHeader) != extensionID {
+		http.Error(w, "unknown extension identifier", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,75 @@
+package extensiontest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/david7482/lambda-extension-log-shipper/extension"
+)
+
+func TestRuntime(t *testing.T) {
+	batches := make(chan []Event, 1)
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var events []Event
+		_ = json.NewDecoder(r.Body).Decode(&events)
+		batches <- events
+	}))
+	defer subscriber.Close()
+	subscriberURL, _ := url.Parse(subscriber.URL)
+	port, _ := strconv.Atoi(subscriberURL.Port())
+
+	rt := NewRuntime()
+	defer rt.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := extension.NewClient(rt.Addr())
+	_, err := client.SubscribeLogs(ctx, []extension.LogType{extension.Function}, extension.SubscribeLogsParams{ListenPort: port})
+	require.Error(t, err, "the extension is not registered")
+	res, err := client.RegisterExtension(ctx, "shipper")
+	require.NoError(t, err)
+	assert.Equal(t, "function", res.FunctionName)
+	assert.Equal(t, "shipper", rt.ExtensionName())
+	_, err = client.SubscribeLogs(ctx, []extension.LogType{extension.Function}, extension.SubscribeLogsParams{ListenPort: port})
+	require.NoError(t, err)
+	require.NoError(t, rt.WaitSubscribed(ctx))
+
+	events := make(chan extension.NextEventResponse, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			event, err := client.NextEvent(ctx)
+			if err != nil {
+				return
+			}
+			events <- event
+		}
+	}()
+	require.NoError(t, rt.Invoke(ctx, "request-1", "hello"))
+	event := <-events
+	assert.Equal(t, extension.Invoke, event.EventType)
+	assert.Equal(t, "request-1", event.RequestID)
+
+	batch := <-batches
+	require.Len(t, batch, 4)
+	assert.Equal(t, []string{"platform.start", "function", "platform.runtimeDone", "platform.report"},
+		[]string{batch[0].Type, batch[1].Type, batch[2].Type, batch[3].Type})
+	assert.Equal(t, "hello", batch[1].Record)
+
+	require.NoError(t, rt.Shutdown(ctx, extension.Timeout, time.Second))
+	event = <-events
+	assert.Equal(t, extension.Shutdown, event.EventType)
+	assert.Equal(t, extension.Timeout, event.ShutdownReason)
+
+	_, err = client.ExitError(ctx, string(extension.Unknown))
+	require.NoError(t, err)
+	assert.Equal(t, []ReportedError{{Phase: "exit", Type: extension.Unknown}}, rt.Errors())
+}
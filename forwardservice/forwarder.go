@@ -0,0 +1,231 @@
+package forwardservice
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/david7482/lambda-extension-log-shipper/emf"
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/metrics"
+	"github.com/david7482/lambda-extension-log-shipper/processservice/processors/filter"
+	"github.com/david7482/lambda-extension-log-shipper/spill"
+)
+
+// forwarder is a ForwarderV2 with its shared options applied
+type forwarder struct {
+	ForwarderV2
+	minLevel logservice.Level
+	filter   *filter.Filter
+	redact   bool
+
+	// limiter is nil if the forwarder has no rate limit
+	limiter     *tokenBucket
+	rateLimited uint64
+
+	// spill is nil if the forwarder does not report failures or spilling is disabled
+	spill *spill.Buffer
+
+	metrics forwarderMetrics
+}
+
+type forwarderMetrics struct {
+	sent    *metrics.Counter
+	failed  *metrics.Counter
+	dropped *metrics.Counter
+	bytes   *metrics.Counter
+	retried *metrics.Counter
+	spilled *metrics.Counter
+	latency *metrics.Histogram
+}
+
+func newForwarder(f ForwarderV2, opts ForwarderOptions) *forwarder {
+	fwd := &forwarder{
+		ForwarderV2: f,
+		filter:      filter.NewFilter(nil, nil),
+		redact:      true,
+	}
+	if opts.MinLevel != nil {
+		fwd.minLevel, _ = logservice.ParseLevel(*opts.MinLevel)
+	}
+	if opts.Redact != nil {
+		fwd.redact = *opts.Redact
+	}
+	if opts.RateLimit != nil && *opts.RateLimit > 0 {
+		fwd.limiter = newTokenBucket(*opts.RateLimit, *opts.RateBurst, time.Now())
+	}
+	if opts.FilterInclude != nil && opts.FilterExclude != nil {
+		fwd.filter = filter.NewFilter(*opts.FilterInclude, *opts.FilterExclude)
+	}
+	return fwd
+}
+
+// instrument creates the metrics of the forwarder in the registry
+func (f *forwarder) instrument(registry *metrics.Registry) {
+	labels := metrics.Labels{"Forwarder": f.Name()}
+	f.metrics = forwarderMetrics{
+		sent:    registry.Counter(metrics.ForwarderSent, emf.Count, labels),
+		failed:  registry.Counter(metrics.ForwarderFailed, emf.Count, labels),
+		dropped: registry.Counter(metrics.ForwarderDropped, emf.Count, labels),
+		bytes:   registry.Counter(metrics.ForwarderBytes, emf.Bytes, labels),
+		retried: registry.Counter(metrics.ForwarderRetried, emf.Count, labels),
+		spilled: registry.Counter(metrics.ForwarderSpilled, emf.Count, labels),
+		latency: registry.Histogram(metrics.ForwarderLatency, emf.Milliseconds, labels, metrics.LatencyBuckets),
+	}
+}
+
+// accept returns the logs which this forwarder should send
+func (f *forwarder) accept(logs []logservice.Log) []logservice.Log {
+	total := len(logs)
+	defer func() {
+		f.metrics.dropped.Add(uint64(total - len(logs)))
+	}()
+
+	if f.minLevel != logservice.TraceLevel {
+		var filtered []logservice.Log
+		for _, log := range logs {
+			if log.Level >= f.minLevel {
+				filtered = append(filtered, log)
+			}
+		}
+		logs = filtered
+	}
+	logs, _ = f.filter.Apply(logs)
+
+	if f.limiter != nil {
+		now := time.Now()
+		limited := make([]logservice.Log, 0, len(logs))
+		for _, log := range logs {
+			if f.limiter.allow(now) {
+				limited = append(limited, log)
+			} else {
+				f.rateLimited++
+			}
+		}
+		logs = limited
+	}
+	return logs
+}
+
+// openSpill opens the disk buffer of undelivered logs if the forwarder reports failures
+func (f *forwarder) openSpill(store *spill.Store, logger *zerolog.Logger) {
+	if !reportsFailures(f.ForwarderV2) {
+		return
+	}
+	buffer, err := store.Open(f.Name())
+	if err != nil {
+		logger.Error().Err(err).Str("forwarder", f.Name()).Msg("fail to open spill buffer")
+		return
+	}
+	f.spill = buffer
+}
+
+// send delivers the logs in batches within the limits of the forwarder
+func (f *forwarder) send(ctx context.Context, logs []logservice.Log, logger *zerolog.Logger) {
+	var limits BatchLimits
+	if limiter, ok := f.ForwarderV2.(BatchLimiter); ok {
+		limits = limiter.BatchLimits()
+	}
+	for _, batch := range batches(logs, limits) {
+		f.sendBatch(ctx, batch, logger)
+	}
+}
+
+// sendBatch delivers the batch. If the forwarder has a spill buffer, the spilled logs are delivered first to keep the
+// order, and the batch is spilled if the destination is still unavailable.
+func (f *forwarder) sendBatch(ctx context.Context, logs []logservice.Log, logger *zerolog.Logger) {
+	var err error
+	if f.spill != nil && !f.spill.IsEmpty() {
+		err = f.spill.Replay(func(spilled []logservice.Log) error {
+			if err := f.deliver(ctx, spilled); err != nil {
+				return err
+			}
+			f.metrics.retried.Add(uint64(len(spilled)))
+			return nil
+		})
+	}
+	if err == nil {
+		err = f.deliver(ctx, logs)
+	}
+	if err == nil {
+		return
+	}
+
+	if f.spill == nil {
+		logger.Error().Err(err).Str("forwarder", f.Name()).Int("logs", len(logs)).Msg("fail to deliver logs")
+		return
+	}
+	if spillErr := f.spill.Push(logs); spillErr != nil {
+		logger.Error().Err(spillErr).Str("forwarder", f.Name()).Int("logs", len(logs)).Msg("fail to spill undelivered logs")
+		return
+	}
+	f.metrics.spilled.Add(uint64(len(logs)))
+	logger.Warn().Err(err).Str("forwarder", f.Name()).Int("logs", len(logs)).Msg("spill undelivered logs")
+}
+
+// deliver sends the logs and records its metrics
+func (f *forwarder) deliver(ctx context.Context, logs []logservice.Log) error {
+	start := time.Now()
+	err := f.Send(ctx, logs)
+	f.metrics.latency.ObserveSince(start)
+	if err != nil {
+		f.metrics.failed.Add(uint64(len(logs)))
+		return err
+	}
+
+	f.metrics.sent.Add(uint64(len(logs)))
+	var size int
+	for _, log := range logs {
+		size += len(log.Content)
+	}
+	f.metrics.bytes.Add(uint64(size))
+	return nil
+}
+
+// healthCheck logs whether the destination of the forwarder is reachable if it is a HealthChecker
+func (f *forwarder) healthCheck(ctx context.Context, logger *zerolog.Logger) {
+	checker, ok := f.ForwarderV2.(HealthChecker)
+	if !ok {
+		return
+	}
+	if err := checker.HealthCheck(ctx); err != nil {
+		logger.Warn().Err(err).Str("forwarder", f.Name()).Msg("forwarder health check failed")
+	}
+}
+
+// shutdown flushes the buffered logs of the forwarder and then shuts it down
+func (f *forwarder) shutdown(ctx context.Context, logger *zerolog.Logger) {
+	if err := f.Flush(ctx); err != nil {
+		logger.Error().Err(err).Str("forwarder", f.Name()).Msg("fail to flush forwarder")
+	}
+	if err := f.ForwarderV2.Shutdown(ctx); err != nil {
+		logger.Error().Err(err).Str("forwarder", f.Name()).Msg("fail to shutdown forwarder")
+	}
+}
+
+// logStats writes the counters of logs sent by this forwarder, and dropped by its filter and rate limit
+func (f *forwarder) logStats(logger *zerolog.Logger) {
+	logger.Info().Str("forwarder", f.Name()).
+		Uint64("sent", f.metrics.sent.Value()).
+		Uint64("failed", f.metrics.failed.Value()).
+		Uint64("dropped", f.metrics.dropped.Value()).
+		Uint64("spilled", f.metrics.spilled.Value()).
+		Msg("forwarder stats")
+	if !f.filter.IsEmpty() {
+		f.filter.LogStats(logger.Info().Str("forwarder", f.Name())).Msg("forwarder filter stats")
+	}
+	if f.limiter != nil {
+		logger.Info().Str("forwarder", f.Name()).Uint64("dropped", f.rateLimited).Msg("forwarder rate limit stats")
+	}
+	if f.spill != nil {
+		stats := f.spill.Stats()
+		logger.Info().Str("forwarder", f.Name()).
+			Uint64("spilled", stats.Spilled).
+			Uint64("replayed", stats.Replayed).
+			Uint64("evicted", stats.Evicted).
+			Uint64("corrupted", stats.Corrupted).
+			Bool("pending", !f.spill.IsEmpty()).
+			Msg("forwarder spill stats")
+	}
+}
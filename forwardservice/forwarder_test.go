@@ -0,0 +1,83 @@
+package forwardservice
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/david7482/lambda-extension-log-shipper/configtest"
+	"github.com/david7482/lambda-extension-log-shipper/emf"
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/metrics"
+	"github.com/david7482/lambda-extension-log-shipper/spill"
+)
+
+// flakyForwarder is a ForwarderV2 whose destination is down when unavailable is set
+type flakyForwarder struct {
+	namedForwarder
+	unavailable bool
+	delivered   []string
+}
+
+func (f *flakyForwarder) Init(_ ForwarderParams) error {
+	return nil
+}
+
+func (f *flakyForwarder) Send(_ context.Context, logs []logservice.Log) error {
+	if f.unavailable {
+		return errors.New("unavailable")
+	}
+	for _, log := range logs {
+		f.delivered = append(f.delivered, log.RequestID)
+	}
+	return nil
+}
+
+func (f *flakyForwarder) Flush(_ context.Context) error {
+	return nil
+}
+
+func (f *flakyForwarder) Shutdown(_ context.Context) error {
+	return nil
+}
+
+func TestForwarder_send(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store := spill.New()
+	configtest.Parse(t, store.SetupConfigs, "--spill-dir", dir)
+
+	logger := zerolog.Nop()
+	flaky := &flakyForwarder{namedForwarder: namedForwarder{name: "flaky"}}
+	f := newForwarder(flaky, ForwarderOptions{})
+	registry := metrics.New()
+	f.instrument(registry)
+	f.openSpill(store, &logger)
+	require.NotNil(t, f.spill)
+
+	f.send(context.Background(), []logservice.Log{{RequestID: "1"}}, &logger)
+	flaky.unavailable = true
+	f.send(context.Background(), []logservice.Log{{RequestID: "2"}}, &logger)
+	f.send(context.Background(), []logservice.Log{{RequestID: "3"}}, &logger)
+	assert.Equal(t, []string{"1"}, flaky.delivered)
+	assert.False(t, f.spill.IsEmpty())
+
+	// the spilled logs are delivered before the new logs once the destination recovers
+	flaky.unavailable = false
+	f.send(context.Background(), []logservice.Log{{RequestID: "4"}}, &logger)
+	assert.Equal(t, []string{"1", "2", "3", "4"}, flaky.delivered)
+	assert.True(t, f.spill.IsEmpty())
+
+	labels := metrics.Labels{"Forwarder": "flaky"}
+	assert.Equal(t, uint64(4), registry.Counter(metrics.ForwarderSent, emf.Count, labels).Value())
+	assert.Equal(t, uint64(2), registry.Counter(metrics.ForwarderFailed, emf.Count, labels).Value())
+	assert.Equal(t, uint64(2), registry.Counter(metrics.ForwarderSpilled, emf.Count, labels).Value())
+	assert.Equal(t, uint64(2), registry.Counter(metrics.ForwarderRetried, emf.Count, labels).Value())
+}
@@ -0,0 +1,10 @@
+// Package all registers all the built-in forwarders, which is imported by the binary of the extension
+package all
+
+import (
+	// the forwarders register themselves in their init()
+	_ "github.com/david7482/lambda-extension-log-shipper/forwardservice/forwarders/emf"
+	_ "github.com/david7482/lambda-extension-log-shipper/forwardservice/forwarders/newrelic"
+	_ "github.com/david7482/lambda-extension-log-shipper/forwardservice/forwarders/promremotewrite"
+	_ "github.com/david7482/lambda-extension-log-shipper/forwardservice/forwarders/stdout"
+)
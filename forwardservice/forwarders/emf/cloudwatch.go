@@ -0,0 +1,157 @@
+package emf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/david7482/lambda-extension-log-shipper/awsauth"
+)
+
+// The limits of a PutLogEvents request
+const (
+	maxBatchEvents   = 10000
+	maxBatchBytes    = 1048576
+	eventBytesHeader = 26
+)
+
+type logEvent struct {
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+}
+
+// cloudwatchLogs puts the EMF documents into a dedicated log group by CloudWatch Logs API
+type cloudwatchLogs struct {
+	httpClient *http.Client
+	endpoint   string
+	region     string
+	logGroup   string
+	logStream  string
+	// streamCreated is set once the log stream is known to exist
+	streamCreated bool
+}
+
+// apiError is the error response of CloudWatch Logs API
+type apiError struct {
+	StatusCode int
+	Type       string `json:"__type"`
+	Message    string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("emf: cloudwatch logs error, status: %d, type: %s, message: %s", e.StatusCode, e.Type, e.Message)
+}
+
+func (e *apiError) is(errorType string) bool {
+	// the type might be prefixed with the namespace, e.g. `com.amazonaws.logs#ResourceNotFoundException`
+	return strings.HasSuffix(e.Type, errorType)
+}
+
+// retryable tells whether the request could succeed later
+func (e *apiError) retryable() bool {
+	return e.StatusCode >= http.StatusInternalServerError || e.StatusCode == http.StatusTooManyRequests ||
+		e.is("ThrottlingException") || e.is("ServiceUnavailableException")
+}
+
+// putLogEvents puts the events in batches within the limits of PutLogEvents
+func (c *cloudwatchLogs) putLogEvents(ctx context.Context, events []logEvent) error {
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Timestamp < events[j].Timestamp })
+	for len(events) > 0 {
+		n, size := 0, 0
+		for n < len(events) && n < maxBatchEvents {
+			eventSize := len(events[n].Message) + eventBytesHeader
+			if n > 0 && size+eventSize > maxBatchBytes {
+				break
+			}
+			size += eventSize
+			n++
+		}
+		if err := c.putBatch(ctx, events[:n]); err != nil {
+			return err
+		}
+		events = events[n:]
+	}
+	return nil
+}
+
+func (c *cloudwatchLogs) putBatch(ctx context.Context, events []logEvent) error {
+	if !c.streamCreated {
+		if err := c.createLogStream(ctx); err != nil {
+			return err
+		}
+	}
+	err := c.call(ctx, "PutLogEvents", map[string]interface{}{
+		"logGroupName":  c.logGroup,
+		"logStreamName": c.logStream,
+		"logEvents":     events,
+	})
+	if apiErr, ok := err.(*apiError); ok && apiErr.is("ResourceNotFoundException") {
+		// The log stream is deleted, e.g. by the retention of the log group
+		c.streamCreated = false
+		if err := c.createLogStream(ctx); err != nil {
+			return err
+		}
+		err = c.call(ctx, "PutLogEvents", map[string]interface{}{
+			"logGroupName":  c.logGroup,
+			"logStreamName": c.logStream,
+			"logEvents":     events,
+		})
+	}
+	return err
+}
+
+func (c *cloudwatchLogs) createLogStream(ctx context.Context) error {
+	err := c.call(ctx, "CreateLogStream", map[string]interface{}{
+		"logGroupName":  c.logGroup,
+		"logStreamName": c.logStream,
+	})
+	if apiErr, ok := err.(*apiError); ok && apiErr.is("ResourceAlreadyExistsException") {
+		err = nil
+	}
+	if err == nil {
+		c.streamCreated = true
+	}
+	return err
+}
+
+// call makes the signed request of the action of CloudWatch Logs API
+func (c *cloudwatchLogs) call(ctx context.Context, action string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "Logs_20140328."+action)
+
+	creds, err := awsauth.CredentialsFromEnv()
+	if err != nil {
+		return err
+	}
+	awsauth.Sign(req, body, creds, c.region, "logs", time.Now())
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("emf: fail to call %s: %w", action, err)
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("emf: fail to read %s response: %w", action, err)
+	}
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+	apiErr := &apiError{StatusCode: res.StatusCode}
+	_ = json.Unmarshal(resBody, apiErr)
+	return apiErr
+}
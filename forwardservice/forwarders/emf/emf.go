@@ -0,0 +1,369 @@
+package emf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/emf"
+	"github.com/david7482/lambda-extension-log-shipper/forwardservice"
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/utils"
+)
+
+// Destinations of the EMF documents
+const (
+	// Stdout writes the documents to stdout, which are sent to the log group of the function by Lambda
+	Stdout = "stdout"
+	// CloudWatch puts the documents into a dedicated log group by CloudWatch Logs API
+	CloudWatch = "cloudwatch"
+)
+
+// reportMetrics are the metrics of platform.report records
+var reportMetrics = []struct {
+	key  string
+	name string
+	unit emf.Unit
+}{
+	{key: "durationMs", name: "Duration", unit: emf.Milliseconds},
+	{key: "billedDurationMs", name: "BilledDuration", unit: emf.Milliseconds},
+	{key: "initDurationMs", name: "InitDuration", unit: emf.Milliseconds},
+	{key: "memorySizeMB", name: "MemorySize", unit: emf.Megabytes},
+	{key: "maxMemoryUsedMB", name: "MaxMemoryUsed", unit: emf.Megabytes},
+}
+
+// EMF converts the platform reports, and optionally the metrics of function logs, into CloudWatch Embedded Metric
+// Format documents, so that the Lambda insights are kept without sending all logs to CloudWatch Logs
+type EMF struct {
+	name       string
+	cfg        config
+	logger     zerolog.Logger
+	params     forwardservice.ForwarderParams
+	dimensions []dimension
+	cloudwatch *cloudwatchLogs
+}
+
+type config struct {
+	Enable       *bool
+	Namespace    *string
+	Dimensions   *string
+	MetricFields *metricFields
+	Passthrough  *bool
+	Destination  *string
+	LogGroup     *string
+	LogStream    *string
+	Endpoint     *string
+}
+
+// dimension is the name of a dimension and its static value, or the name of the metadata or field holding the value
+type dimension struct {
+	name  string
+	value string
+}
+
+func init() {
+	forwardservice.Register("emf", func(instance string) forwardservice.ForwarderV2 {
+		return NewInstance(instance)
+	})
+}
+
+func New() *EMF {
+	return NewInstance("")
+}
+
+// NewInstance creates the named instance of the forwarder, whose configs are prefixed by `emf-<instance>`
+func NewInstance(instance string) *EMF {
+	name := forwardservice.InstanceName("emf", instance)
+	return &EMF{
+		name:   name,
+		logger: zerolog.New(os.Stdout).With().Str("forwarder", name).Timestamp().Logger(),
+	}
+}
+
+func (s *EMF) Name() string {
+	return s.name
+}
+
+func (s *EMF) SetupConfigs(app *kingpin.Application) {
+	s.cfg.Enable = app.
+		Flag(s.name+"-enable", fmt.Sprintf("Enable the %s forwarder", s.name)).
+		Envar(forwardservice.EnvarName(s.name, "ENABLE")).
+		Default("false").Bool()
+	s.cfg.Namespace = app.
+		Flag(s.name+"-namespace", "The CloudWatch namespace of the metrics").
+		Envar(forwardservice.EnvarName(s.name, "NAMESPACE")).
+		Default("LambdaExtensionLogShipper").String()
+	s.cfg.Dimensions = app.
+		Flag(s.name+"-dimensions", "The comma separated dimensions of the metrics, either a name of the metadata or fields of logs, or a name=value pair").
+		Envar(forwardservice.EnvarName(s.name, "DIMENSIONS")).
+		Default("FunctionName").String()
+	s.cfg.MetricFields = new(metricFields)
+	app.
+		Flag(s.name+"-metric-fields", "The comma separated numeric fields of JSON function logs extracted as metrics, e.g. orderTotal,latency:Milliseconds").
+		Envar(forwardservice.EnvarName(s.name, "METRIC_FIELDS")).
+		Default("").SetValue(s.cfg.MetricFields)
+	s.cfg.Passthrough = app.
+		Flag(s.name+"-passthrough", "Forward the function logs which are already EMF documents").
+		Envar(forwardservice.EnvarName(s.name, "PASSTHROUGH")).
+		Default("true").Bool()
+	s.cfg.Destination = app.
+		Flag(s.name+"-destination", "Where the EMF documents are delivered").
+		Envar(forwardservice.EnvarName(s.name, "DESTINATION")).
+		Default(Stdout).Enum(Stdout, CloudWatch)
+	s.cfg.LogGroup = app.
+		Flag(s.name+"-log-group", "The dedicated log group of the EMF documents, required by the cloudwatch destination").
+		Envar(forwardservice.EnvarName(s.name, "LOG_GROUP")).
+		Default("").String()
+	s.cfg.LogStream = app.
+		Flag(s.name+"-log-stream", "The log stream of the EMF documents, default is unique for each execution environment").
+		Envar(forwardservice.EnvarName(s.name, "LOG_STREAM")).
+		Default("").String()
+	s.cfg.Endpoint = app.
+		Flag(s.name+"-endpoint", "The endpoint of CloudWatch Logs API, default is the endpoint of the region").
+		Envar(forwardservice.EnvarName(s.name, "ENDPOINT")).
+		Default("").String()
+}
+
+func (s *EMF) Init(params forwardservice.ForwarderParams) error {
+	s.params = params
+	s.logger = s.logger.With().Str("lambdaName", s.params.LambdaName).Str("awsRegion", s.params.AWSRegion).Logger()
+
+	s.dimensions = nil
+	for _, item := range utils.SplitList(*s.cfg.Dimensions) {
+		parts := strings.SplitN(item, "=", 2)
+		d := dimension{name: strings.TrimSpace(parts[0])}
+		if len(parts) == 2 {
+			d.value = strings.TrimSpace(parts[1])
+		}
+		s.dimensions = append(s.dimensions, d)
+	}
+
+	if *s.cfg.Destination == CloudWatch {
+		endpoint := *s.cfg.Endpoint
+		if endpoint == "" {
+			endpoint = fmt.Sprintf("https://logs.%s.amazonaws.com/", s.params.AWSRegion)
+		}
+		logStream := *s.cfg.LogStream
+		if logStream == "" {
+			logStream = fmt.Sprintf("%s/%s/%d", time.Now().UTC().Format("2006/01/02"), s.params.LambdaName, time.Now().UnixNano())
+		}
+		s.cloudwatch = &cloudwatchLogs{
+			httpClient: &http.Client{Timeout: 5 * time.Second},
+			endpoint:   endpoint,
+			region:     s.params.AWSRegion,
+			logGroup:   *s.cfg.LogGroup,
+			logStream:  logStream,
+		}
+		if *s.cfg.LogGroup == "" && *s.cfg.Enable {
+			return errors.New("emf: the log group of cloudwatch destination is not set")
+		}
+	}
+	return nil
+}
+
+func (s *EMF) IsEnable() bool {
+	return *s.cfg.Enable
+}
+
+// Send sends the EMF documents converted from the logs. It returns an error if the documents could be retried later.
+func (s *EMF) Send(ctx context.Context, logs []logservice.Log) error {
+	events := s.events(logs)
+	if len(events) == 0 {
+		return nil
+	}
+
+	if s.cloudwatch == nil {
+		for _, event := range events {
+			fmt.Fprintln(os.Stdout, event.Message)
+		}
+		return nil
+	}
+	err := s.cloudwatch.putLogEvents(ctx, events)
+	if apiErr, ok := err.(*apiError); ok && !apiErr.retryable() {
+		s.logger.Error().Err(err).Int("documents", len(events)).Msg("fail to put EMF documents")
+		return nil
+	}
+	return err
+}
+
+// events converts the logs into EMF documents
+func (s *EMF) events(logs []logservice.Log) []logEvent {
+	var events []logEvent
+	for _, log := range logs {
+		var message []byte
+		switch {
+		case log.Type == logservice.PlatformReport:
+			message = s.marshal(s.reportDocument(log))
+		case log.Type == logservice.Metric:
+			message = s.marshal(s.metricDocument(log))
+		case log.Type != logservice.Function:
+			continue
+		case log.Fields["_aws"] != nil:
+			if *s.cfg.Passthrough {
+				message = []byte(log.Line())
+			}
+		case len(*s.cfg.MetricFields) > 0:
+			message = s.marshal(s.fieldsDocument(log))
+		}
+		if len(message) > 0 {
+			events = append(events, logEvent{Timestamp: log.Time.UnixNano() / 1e6, Message: string(message)})
+		}
+	}
+	return events
+}
+
+func (s *EMF) marshal(doc *emf.Document) []byte {
+	if doc == nil {
+		return nil
+	}
+	b, err := doc.MarshalJSON()
+	if err != nil {
+		s.logger.Error().Err(err).Msg("fail to marshal EMF document")
+		return nil
+	}
+	return b
+}
+
+// reportDocument converts the metrics of platform.report, e.g. `{"durationMs":101.51,"maxMemoryUsedMB":34}`
+func (s *EMF) reportDocument(log logservice.Log) *emf.Document {
+	var record map[string]float64
+	if err := json.Unmarshal(log.Content, &record); err != nil {
+		s.logger.Error().Err(err).Msg("fail to parse platform.report metrics")
+		return nil
+	}
+	doc := s.document(log)
+	for _, m := range reportMetrics {
+		if value, ok := record[m.key]; ok {
+			doc.Metrics = append(doc.Metrics, emf.Metric{Name: m.name, Unit: m.unit, Value: value})
+		}
+	}
+	coldStart := 0.0
+	if _, ok := record["initDurationMs"]; ok {
+		coldStart = 1
+	}
+	doc.Metrics = append(doc.Metrics, emf.Metric{Name: "ColdStart", Unit: emf.Count, Value: coldStart})
+	return doc
+}
+
+// metricDocument converts the metric log of the logmetrics processor, whose labels are the extra dimensions,
+// e.g. `{"name":"latency","type":"histogram","labels":{"route":"/orders"},"values":[10,30],"counts":[1,2]}`
+func (s *EMF) metricDocument(log logservice.Log) *emf.Document {
+	var record logservice.MetricRecord
+	if err := json.Unmarshal(log.Content, &record); err != nil {
+		s.logger.Error().Err(err).Msg("fail to parse metric")
+		return nil
+	}
+	doc := s.document(log)
+	for name, value := range record.Labels {
+		doc.Dimensions[name] = value
+	}
+	metric := emf.Metric{Name: record.Name, Unit: emf.None, Value: record.Value}
+	if record.Type == "histogram" {
+		metric.Values = record.Values
+		metric.Counts = record.Counts
+	}
+	doc.Metrics = append(doc.Metrics, metric)
+	return doc
+}
+
+// fieldsDocument extracts the metrics from the numeric fields of the function log. It returns nil if there is none.
+func (s *EMF) fieldsDocument(log logservice.Log) *emf.Document {
+	doc := s.document(log)
+	for _, f := range *s.cfg.MetricFields {
+		if value, ok := log.Fields[f.name].(float64); ok {
+			doc.Metrics = append(doc.Metrics, emf.Metric{Name: f.name, Unit: f.unit, Value: value})
+		}
+	}
+	if len(doc.Metrics) == 0 {
+		return nil
+	}
+	return doc
+}
+
+// document creates the document of the log with its dimensions and properties
+func (s *EMF) document(log logservice.Log) *emf.Document {
+	doc := &emf.Document{
+		Namespace:  *s.cfg.Namespace,
+		Timestamp:  log.Time,
+		Dimensions: make(map[string]string),
+		Properties: map[string]interface{}{},
+	}
+	for _, d := range s.dimensions {
+		if value := s.dimensionValue(d, log); value != "" {
+			doc.Dimensions[d.name] = value
+		}
+	}
+	if log.RequestID != "" {
+		doc.Properties["requestId"] = log.RequestID
+	}
+	if log.Tracing.Value != "" {
+		doc.Properties["traceId"] = log.Tracing.Value
+	}
+	return doc
+}
+
+func (s *EMF) dimensionValue(d dimension, log logservice.Log) string {
+	if d.value != "" {
+		return d.value
+	}
+	if d.name == "FunctionName" {
+		return s.params.LambdaName
+	}
+	if v, ok := log.Metadata[d.name]; ok {
+		return fmt.Sprint(v)
+	}
+	if v, ok := log.Fields[d.name]; ok && v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+func (s *EMF) Flush(_ context.Context) error {
+	return nil
+}
+
+func (s *EMF) Shutdown(_ context.Context) error {
+	return nil
+}
+
+// metricField is a numeric field of function logs and the unit of its metric
+type metricField struct {
+	name string
+	unit emf.Unit
+}
+
+// metricFields is the comma separated fields with optional units, e.g. `latency:Milliseconds`. It implements kingpin.Value.
+type metricFields []metricField
+
+func (l *metricFields) Set(value string) error {
+	var list metricFields
+	for _, item := range utils.SplitList(value) {
+		parts := strings.SplitN(item, ":", 2)
+		f := metricField{name: strings.TrimSpace(parts[0]), unit: emf.None}
+		if len(parts) == 2 {
+			f.unit = emf.Unit(strings.TrimSpace(parts[1]))
+			if !f.unit.IsValid() {
+				return fmt.Errorf("emf: unknown unit of metric field %s: %s", f.name, f.unit)
+			}
+		}
+		list = append(list, f)
+	}
+	*l = list
+	return nil
+}
+
+func (l *metricFields) String() string {
+	var items []string
+	for _, f := range *l {
+		items = append(items, f.name+":"+string(f.unit))
+	}
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,273 @@
+package emf
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/david7482/lambda-extension-log-shipper/configtest"
+	"github.com/david7482/lambda-extension-log-shipper/extension"
+	"github.com/david7482/lambda-extension-log-shipper/forwardservice"
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/metrics"
+	"github.com/david7482/lambda-extension-log-shipper/processservice"
+	"github.com/david7482/lambda-extension-log-shipper/processservice/processors/logmetrics"
+)
+
+func newTestEMF(t *testing.T, args ...string) *EMF {
+	s := New()
+	configtest.Parse(t, s.SetupConfigs, append([]string{"--emf-enable"}, args...)...)
+	require.NoError(t, s.Init(forwardservice.ForwarderParams{LambdaName: "hello", AWSRegion: "us-east-1"}))
+	return s
+}
+
+func TestEMF_events(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	logs := []logservice.Log{
+		{
+			Time:      now,
+			Type:      logservice.PlatformReport,
+			RequestID: "6f7f0961",
+			Content:   []byte(`{"durationMs":101.51,"billedDurationMs":102,"memorySizeMB":128,"maxMemoryUsedMB":34,"initDurationMs":150.2}`),
+			Tracing:   extension.Tracing{Type: "X-Amzn-Trace-Id", Value: "Root=1-5f5f5f5f-1234567890abcdef12345678"},
+			Metadata:  map[string]interface{}{"functionVersion": "$LATEST"},
+		},
+		{
+			Time:     now,
+			Type:     logservice.Function,
+			Content:  []byte(`"{\"orderTotal\":12.5,\"latency\":30,\"route\":\"/orders\"}"`),
+			Fields:   map[string]interface{}{"orderTotal": 12.5, "latency": float64(30), "route": "/orders"},
+			Metadata: map[string]interface{}{"functionVersion": "$LATEST"},
+		},
+		{
+			Time:    now,
+			Type:    logservice.Function,
+			Content: []byte(`"{\"_aws\":{},\"custom\":1}"`),
+			Fields:  map[string]interface{}{"_aws": map[string]interface{}{}, "custom": float64(1)},
+		},
+		{Time: now, Type: logservice.Function, Content: []byte(`"plain text"`)},
+		{Time: now, Type: logservice.PlatformFault, Content: []byte(`"fault"`)},
+	}
+
+	s := newTestEMF(t, "--emf-dimensions", "FunctionName,functionVersion,env=prod", "--emf-metric-fields", "orderTotal,latency:Milliseconds")
+	events := s.events(logs)
+	require.Len(t, events, 3)
+	for _, event := range events {
+		assert.Equal(t, int64(1600000000000), event.Timestamp)
+	}
+
+	assert.JSONEq(t, `{
+		"_aws": {
+			"Timestamp": 1600000000000,
+			"CloudWatchMetrics": [{
+				"Namespace": "LambdaExtensionLogShipper",
+				"Dimensions": [["FunctionName", "env", "functionVersion"]],
+				"Metrics": [
+					{"Name": "Duration", "Unit": "Milliseconds"},
+					{"Name": "BilledDuration", "Unit": "Milliseconds"},
+					{"Name": "InitDuration", "Unit": "Milliseconds"},
+					{"Name": "MemorySize", "Unit": "Megabytes"},
+					{"Name": "MaxMemoryUsed", "Unit": "Megabytes"},
+					{"Name": "ColdStart", "Unit": "Count"}
+				]
+			}]
+		},
+		"FunctionName": "hello",
+		"functionVersion": "$LATEST",
+		"env": "prod",
+		"requestId": "6f7f0961",
+		"traceId": "Root=1-5f5f5f5f-1234567890abcdef12345678",
+		"Duration": 101.51,
+		"BilledDuration": 102,
+		"InitDuration": 150.2,
+		"MemorySize": 128,
+		"MaxMemoryUsed": 34,
+		"ColdStart": 1
+	}`, events[0].Message)
+
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(events[1].Message), &fields))
+	assert.Equal(t, 12.5, fields["orderTotal"])
+	assert.Equal(t, float64(30), fields["latency"])
+	assert.NotContains(t, fields, "route")
+
+	assert.Equal(t, `{"_aws":{},"custom":1}`, events[2].Message)
+
+	// EMF documents of function logs are not forwarded without passthrough
+	s = newTestEMF(t, "--no-emf-passthrough")
+	assert.Len(t, s.events(logs), 1)
+}
+
+func TestEMF_events_metrics(t *testing.T) {
+	m := logmetrics.New()
+	configtest.Parse(t, m.SetupConfigs, "--logmetrics-rules", "counter errors when content~ERROR; histogram latency value=latency_ms by=route")
+	m.Init(processservice.ProcessorParams{})
+	function := func(line string, fields map[string]interface{}) logservice.Log {
+		return logservice.Log{
+			Time: time.Unix(1600000000, 0), Type: logservice.Function, RequestID: "6f7f0961", Content: []byte(`"` + line + `"`), Fields: fields,
+		}
+	}
+	m.Process([]logservice.Log{
+		function("ERROR fail", nil),
+		function("ok", map[string]interface{}{"latency_ms": float64(30), "route": "/orders"}),
+		function("ok", map[string]interface{}{"latency_ms": float64(10), "route": "/orders"}),
+		function("ok", map[string]interface{}{"latency_ms": float64(30), "route": "/orders"}),
+	})
+	logs := m.Flush()
+	require.Len(t, logs, 2)
+
+	s := newTestEMF(t, "--emf-dimensions", "FunctionName")
+	events := s.events(logs)
+	require.Len(t, events, 2)
+	assert.JSONEq(t, `{
+		"_aws": {
+			"Timestamp": 1600000000000,
+			"CloudWatchMetrics": [{
+				"Namespace": "LambdaExtensionLogShipper",
+				"Dimensions": [["FunctionName"]],
+				"Metrics": [{"Name": "errors", "Unit": "None"}]
+			}]
+		},
+		"FunctionName": "hello",
+		"requestId": "6f7f0961",
+		"errors": 1
+	}`, events[0].Message)
+	assert.JSONEq(t, `{
+		"_aws": {
+			"Timestamp": 1600000000000,
+			"CloudWatchMetrics": [{
+				"Namespace": "LambdaExtensionLogShipper",
+				"Dimensions": [["FunctionName", "route"]],
+				"Metrics": [{"Name": "latency", "Unit": "None"}]
+			}]
+		},
+		"FunctionName": "hello",
+		"route": "/orders",
+		"requestId": "6f7f0961",
+		"latency": {"Values": [10, 30], "Counts": [1, 2]}
+	}`, events[1].Message)
+}
+
+func TestMetricFields_Set(t *testing.T) {
+	var fields metricFields
+	require.NoError(t, fields.Set("orderTotal, latency:Milliseconds"))
+	assert.Equal(t, "orderTotal:None,latency:Milliseconds", fields.String())
+	assert.Error(t, fields.Set("latency:Hours"))
+}
+
+// fakeCloudWatchLogs serves CreateLogStream and PutLogEvents of CloudWatch Logs API
+type fakeCloudWatchLogs struct {
+	mu       sync.Mutex
+	streams  map[string]bool
+	events   []logEvent
+	failures []int
+	actions  []string
+}
+
+func (f *fakeCloudWatchLogs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "Logs_20140328.")
+	f.actions = append(f.actions, action)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if len(f.failures) > 0 {
+		w.WriteHeader(f.failures[0])
+		if f.failures[0] >= http.StatusInternalServerError {
+			_, _ = w.Write([]byte(`{"__type":"ServiceUnavailableException","message":"try again"}`))
+		} else {
+			_, _ = w.Write([]byte(`{"__type":"InvalidParameterException","message":"invalid"}`))
+		}
+		f.failures = f.failures[1:]
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	var req struct {
+		LogGroupName  string     `json:"logGroupName"`
+		LogStreamName string     `json:"logStreamName"`
+		LogEvents     []logEvent `json:"logEvents"`
+	}
+	_ = json.Unmarshal(body, &req)
+	switch action {
+	case "CreateLogStream":
+		f.streams[req.LogStreamName] = true
+	case "PutLogEvents":
+		if !f.streams[req.LogStreamName] {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type":"com.amazonaws.logs#ResourceNotFoundException","message":"The specified log stream does not exist."}`))
+			return
+		}
+		f.events = append(f.events, req.LogEvents...)
+	}
+	_, _ = w.Write([]byte(`{}`))
+}
+
+func TestEMF_Send_cloudwatch(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	fake := &fakeCloudWatchLogs{streams: make(map[string]bool)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	s := newTestEMF(t, "--emf-destination", "cloudwatch", "--emf-log-group", "/lambda/insights",
+		"--emf-log-stream", "stream", "--emf-endpoint", server.URL)
+	require.True(t, s.IsEnable())
+	report := logservice.Log{Time: time.Unix(1600000000, 0), Type: logservice.PlatformReport, Content: []byte(`{"durationMs":1}`)}
+
+	require.NoError(t, s.Send(context.Background(), []logservice.Log{report}))
+	assert.Equal(t, []string{"CreateLogStream", "PutLogEvents"}, fake.actions)
+	require.Len(t, fake.events, 1)
+	assert.Equal(t, int64(1600000000000), fake.events[0].Timestamp)
+
+	// The log stream is deleted
+	fake.streams = make(map[string]bool)
+	fake.actions = nil
+	require.NoError(t, s.Send(context.Background(), []logservice.Log{report}))
+	assert.Equal(t, []string{"PutLogEvents", "CreateLogStream", "PutLogEvents"}, fake.actions)
+	assert.Len(t, fake.events, 2)
+
+	// Server errors could be retried later
+	fake.failures = []int{http.StatusServiceUnavailable}
+	assert.Error(t, s.Send(context.Background(), []logservice.Log{report}))
+	assert.Len(t, fake.events, 2)
+
+	// Client errors could not be retried
+	fake.failures = []int{http.StatusBadRequest}
+	assert.NoError(t, s.Send(context.Background(), []logservice.Log{report}))
+	assert.Len(t, fake.events, 2)
+}
+
+func TestEMF_Init(t *testing.T) {
+	assert.True(t, newTestEMF(t).IsEnable())
+
+	// The cloudwatch destination without a log group fails the forward service, and so the extension at startup
+	s := New()
+	configtest.Parse(t, s.SetupConfigs, "--emf-enable", "--emf-destination", "cloudwatch")
+	_, err := forwardservice.New(forwardservice.ServiceParams{Forwarders: []forwardservice.ForwarderV2{s}, Metrics: metrics.New()})
+	require.Error(t, err)
+	assert.Equal(t, extension.ForwarderInitFailed, extension.TypeOf(err))
+	assert.Contains(t, err.Error(), "log group")
+
+	// A disabled forwarder is not validated
+	s = New()
+	configtest.Parse(t, s.SetupConfigs, "--emf-destination", "cloudwatch")
+	assert.NoError(t, s.Init(forwardservice.ForwarderParams{}))
+	assert.False(t, s.IsEnable())
+}
@@ -1,7 +1,10 @@
 package newrelic
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -14,7 +17,11 @@ import (
 	"github.com/david7482/lambda-extension-log-shipper/utils"
 )
 
+// maxPayloadBytes is the maximum size of a request of NR Log API
+const maxPayloadBytes = 1000000
+
 type Newrelic struct {
+	name       string
 	cfg        config
 	logger     zerolog.Logger
 	httpClient *http.Client
@@ -24,6 +31,7 @@ type Newrelic struct {
 type config struct {
 	Enable     *bool
 	LicenseKey *string
+	EntityGUID *string
 }
 
 type NRCommon struct {
@@ -41,34 +49,67 @@ type NRLog struct {
 	Attributes map[string]interface{} `json:"attributes"`
 }
 
+func init() {
+	forwardservice.Register("newrelic", func(instance string) forwardservice.ForwarderV2 {
+		return NewInstance(instance)
+	})
+}
+
 func New() *Newrelic {
+	return NewInstance("")
+}
+
+// NewInstance creates the named instance of the forwarder, whose configs are prefixed by `newrelic-<instance>`
+func NewInstance(instance string) *Newrelic {
+	name := forwardservice.InstanceName("newrelic", instance)
 	return &Newrelic{
-		logger:     zerolog.New(os.Stdout).With().Str("forwarder", "newrelic").Timestamp().Logger(),
+		name:       name,
+		logger:     zerolog.New(os.Stdout).With().Str("forwarder", name).Timestamp().Logger(),
 		httpClient: &http.Client{},
 	}
 }
 
+func (s *Newrelic) Name() string {
+	return s.name
+}
+
 func (s *Newrelic) SetupConfigs(app *kingpin.Application) {
 	s.cfg.Enable = app.
-		Flag("newrelic-enable", "Enable the newrelic forwarder").
-		Envar("LS_NEWRELIC_ENABLE").
+		Flag(s.name+"-enable", fmt.Sprintf("Enable the %s forwarder", s.name)).
+		Envar(forwardservice.EnvarName(s.name, "ENABLE")).
 		Default("true").Bool()
 	s.cfg.LicenseKey = app.
-		Flag("newrelic-license-key", "The NewRelic licence key to ingest the logs").
-		Envar("LS_NEWRELIC_LICENSE_KEY").
+		Flag(s.name+"-license-key", "The NewRelic licence key to ingest the logs").
+		Envar(forwardservice.EnvarName(s.name, "LICENSE_KEY")).
+		Default("").String()
+	s.cfg.EntityGUID = app.
+		Flag(s.name+"-entity-guid", "The GUID of the NewRelic Lambda entity to link the logs with").
+		Envar(forwardservice.EnvarName(s.name, "ENTITY_GUID")).
 		Default("").String()
 }
 
-func (s *Newrelic) Init(params forwardservice.ForwarderParams) {
+func (s *Newrelic) Init(params forwardservice.ForwarderParams) error {
 	s.params = params
 	s.logger = s.logger.With().Str("lambdaName", s.params.LambdaName).Str("awsRegion", s.params.AWSRegion).Logger()
+
+	if *s.cfg.LicenseKey == "" && *s.cfg.Enable {
+		return errors.New("newrelic: the license key is not set")
+	}
+	return nil
 }
 
 func (s *Newrelic) IsEnable() bool {
 	return *s.cfg.Enable
 }
 
-func (s *Newrelic) SendLog(logs []logservice.Log) {
+// BatchLimits keeps the contents of a batch within the payload limit of NR Log API, and the compressed payload with
+// the attributes is smaller than it
+func (s *Newrelic) BatchLimits() forwardservice.BatchLimits {
+	return forwardservice.BatchLimits{MaxBytes: maxPayloadBytes}
+}
+
+// Send sends the logs to NR. It returns an error if NR is unavailable, so that the logs could be retried later.
+func (s *Newrelic) Send(ctx context.Context, logs []logservice.Log) error {
 	// Build NR logs payload
 	var detailedLog NRDetailedLog
 	detailedLog.Common.Attributes = map[string]interface{}{
@@ -78,6 +119,9 @@ func (s *Newrelic) SendLog(logs []logservice.Log) {
 		"aws.lambda": s.params.LambdaName,
 		"aws.region": s.params.AWSRegion,
 	}
+	if *s.cfg.EntityGUID != "" {
+		detailedLog.Common.Attributes["entity.guid"] = *s.cfg.EntityGUID
+	}
 	for _, log := range logs {
 		nrlog := NRLog{
 			Timestamp: log.Time.UnixNano() / 1e6,
@@ -85,8 +129,35 @@ func (s *Newrelic) SendLog(logs []logservice.Log) {
 			Attributes: map[string]interface{}{
 				"aws.lambdaRequestId":  log.RequestID,
 				"aws.lambdaExtLogType": log.Type,
+				"level":                log.Level.String(),
 			},
 		}
+		for k, v := range log.Metadata {
+			if _, ok := nrlog.Attributes[k]; !ok {
+				nrlog.Attributes[k] = v
+			}
+		}
+		for k, v := range log.Fields {
+			if _, ok := nrlog.Attributes[k]; !ok {
+				nrlog.Attributes[k] = v
+			}
+		}
+		if message, ok := log.Fields[logservice.FieldMessage].(string); ok {
+			nrlog.Message, _ = json.Marshal(message)
+		}
+		if log.SampleRate > 0 {
+			nrlog.Attributes["sampleRate"] = log.SampleRate
+		}
+		if log.FunctionArn != "" {
+			nrlog.Attributes["aws.arn"] = log.FunctionArn
+		}
+		tc := extractTraceContext(log)
+		if tc.TraceID != "" {
+			nrlog.Attributes["trace.id"] = tc.TraceID
+		}
+		if tc.SpanID != "" {
+			nrlog.Attributes["span.id"] = tc.SpanID
+		}
 		if log.Type == logservice.PlatformReport {
 			nrlog.Message = []byte(`"aws lambda report"`)
 			nrlog.Attributes["aws"] = json.RawMessage(log.Content)
@@ -99,21 +170,21 @@ func (s *Newrelic) SendLog(logs []logservice.Log) {
 	uncompressed, err := json.Marshal([]NRDetailedLog{detailedLog})
 	if err != nil {
 		s.logger.Error().Err(err).Msg("fail to marshal NR logs")
-		return
+		return nil
 	}
 	s.logger.Debug().RawJSON("rawjson", uncompressed).Send()
 
 	compressed, err := utils.Compress(uncompressed)
 	if err != nil {
 		s.logger.Error().Err(err).Msg("fail to compress NR logs")
-		return
+		return nil
 	}
 
 	// Build NR logs request
-	httpReq, err := http.NewRequest("POST", "https://log-api.newrelic.com/log/v1", compressed)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://log-api.newrelic.com/log/v1", compressed)
 	if err != nil {
 		s.logger.Error().Err(err).Msg("fail to build NR logs request")
-		return
+		return nil
 	}
 	httpReq.Header.Add("Content-Encoding", "gzip")
 	httpReq.Header.Add("Content-Type", "application/json")
@@ -123,21 +194,26 @@ func (s *Newrelic) SendLog(logs []logservice.Log) {
 	// Make the request
 	httpRes, err := s.httpClient.Do(httpReq)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("fail to send logs to NR")
-		return
+		return fmt.Errorf("newrelic: fail to send logs: %w", err)
 	}
 	defer httpRes.Body.Close()
 	body, err := ioutil.ReadAll(httpRes.Body)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("fail to read NR logs response")
-		return
+		return fmt.Errorf("newrelic: fail to read logs response: %w", err)
+	}
+	if httpRes.StatusCode == http.StatusTooManyRequests || httpRes.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("newrelic: logs response, status: %s, response: %s", httpRes.Status, string(body))
 	}
 	if httpRes.StatusCode != http.StatusAccepted {
 		s.logger.Error().Msgf("NR logs response, status: %s, response: %s", httpRes.Status, string(body))
-		return
 	}
+	return nil
 }
 
-func (s *Newrelic) Shutdown() {
+func (s *Newrelic) Flush(_ context.Context) error {
+	return nil
+}
 
+func (s *Newrelic) Shutdown(_ context.Context) error {
+	return nil
 }
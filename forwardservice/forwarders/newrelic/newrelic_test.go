@@ -0,0 +1,34 @@
+package newrelic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/david7482/lambda-extension-log-shipper/configtest"
+	"github.com/david7482/lambda-extension-log-shipper/extension"
+	"github.com/david7482/lambda-extension-log-shipper/forwardservice"
+	"github.com/david7482/lambda-extension-log-shipper/metrics"
+)
+
+func TestNewrelic_Init(t *testing.T) {
+	s := New()
+	configtest.Parse(t, s.SetupConfigs, "--newrelic-license-key", "key")
+	assert.NoError(t, s.Init(forwardservice.ForwarderParams{LambdaName: "hello", AWSRegion: "us-east-1"}))
+	assert.True(t, s.IsEnable())
+
+	// The enabled forwarder without a license key fails the forward service, and so the extension at startup
+	s = New()
+	configtest.Parse(t, s.SetupConfigs)
+	_, err := forwardservice.New(forwardservice.ServiceParams{Forwarders: []forwardservice.ForwarderV2{s}, Metrics: metrics.New()})
+	require.Error(t, err)
+	assert.Equal(t, extension.ForwarderInitFailed, extension.TypeOf(err))
+	assert.Contains(t, err.Error(), "license key")
+
+	// A disabled forwarder is not validated
+	s = New()
+	configtest.Parse(t, s.SetupConfigs, "--no-newrelic-enable")
+	assert.NoError(t, s.Init(forwardservice.ForwarderParams{}))
+	assert.False(t, s.IsEnable())
+}
@@ -0,0 +1,93 @@
+package newrelic
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/david7482/lambda-extension-log-shipper/extension"
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+)
+
+const xrayTracingType = "X-Amzn-Trace-Id"
+
+var (
+	// traceparentRegexp matches the W3C trace context header: version-traceid-parentid-flags
+	traceparentRegexp = regexp.MustCompile(`\b[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}\b`)
+
+	traceIDKeys = []string{"trace.id", "traceId", "trace_id", "traceID", "dd.trace_id"}
+	spanIDKeys  = []string{"span.id", "spanId", "span_id", "spanID", "dd.span_id"}
+)
+
+// traceContext is the distributed tracing linkage of a log
+type traceContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// extractTraceContext finds the trace/span ids of a log. The ids written by the function itself are preferred,
+// and the X-Ray tracing header of the invocation is used as a fallback.
+func extractTraceContext(log logservice.Log) traceContext {
+	var tc traceContext
+	if log.Type == logservice.Function {
+		tc = traceContextFromContent(log)
+	}
+	if tc.TraceID == "" {
+		xray := traceContextFromXRay(log.Tracing)
+		tc.TraceID = xray.TraceID
+		if tc.SpanID == "" {
+			tc.SpanID = xray.SpanID
+		}
+	}
+	return tc
+}
+
+// traceContextFromContent parses the trace/span ids from the structured fields or the W3C traceparent of a function log
+func traceContextFromContent(log logservice.Log) traceContext {
+	var tc traceContext
+	tc.TraceID = lookupString(log.Fields, traceIDKeys)
+	tc.SpanID = lookupString(log.Fields, spanIDKeys)
+
+	if tc.TraceID == "" {
+		if m := traceparentRegexp.FindStringSubmatch(log.Line()); m != nil {
+			tc.TraceID = m[1]
+			tc.SpanID = m[2]
+		}
+	}
+	return tc
+}
+
+// traceContextFromXRay converts the X-Ray tracing header (Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1)
+// into W3C compatible trace/span ids
+func traceContextFromXRay(tracing extension.Tracing) traceContext {
+	var tc traceContext
+	if tracing.Type != xrayTracingType {
+		return tc
+	}
+
+	for _, part := range strings.Split(tracing.Value, ";") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "Root":
+			// 1-{8 hex epoch}-{24 hex random}
+			segments := strings.Split(kv[1], "-")
+			if len(segments) == 3 {
+				tc.TraceID = segments[1] + segments[2]
+			}
+		case "Parent":
+			tc.SpanID = kv[1]
+		}
+	}
+	return tc
+}
+
+func lookupString(fields map[string]interface{}, keys []string) string {
+	for _, key := range keys {
+		if v, ok := fields[key].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
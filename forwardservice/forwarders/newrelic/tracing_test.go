@@ -0,0 +1,76 @@
+package newrelic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/david7482/lambda-extension-log-shipper/extension"
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+)
+
+func TestExtractTraceContext(t *testing.T) {
+	xray := extension.Tracing{
+		Type:  "X-Amzn-Trace-Id",
+		Value: "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1",
+	}
+	tests := []struct {
+		name string
+		log  logservice.Log
+		want traceContext
+	}{
+		{
+			name: "JSON fields",
+			log: logservice.Log{
+				Type:    logservice.Function,
+				Content: []byte(`"{\"msg\":\"hello\",\"trace.id\":\"4bf92f3577b34da6a3ce929d0e0e4736\",\"span.id\":\"00f067aa0ba902b7\"}"`),
+				Tracing: xray,
+				Fields: map[string]interface{}{
+					"msg":      "hello",
+					"trace.id": "4bf92f3577b34da6a3ce929d0e0e4736",
+					"span.id":  "00f067aa0ba902b7",
+				},
+			},
+			want: traceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"},
+		},
+		{
+			name: "W3C traceparent",
+			log: logservice.Log{
+				Type:    logservice.Function,
+				Content: []byte(`"hello traceparent=00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"`),
+			},
+			want: traceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"},
+		},
+		{
+			name: "X-Ray fallback",
+			log: logservice.Log{
+				Type:    logservice.Function,
+				Content: []byte(`"hello"`),
+				Tracing: xray,
+			},
+			want: traceContext{TraceID: "5759e988bd862e3fe1be46a994272793", SpanID: "53995c3f42cd8ad8"},
+		},
+		{
+			name: "Platform report",
+			log: logservice.Log{
+				Type:    logservice.PlatformReport,
+				Content: []byte(`{"durationMs": 101.51}`),
+				Tracing: xray,
+			},
+			want: traceContext{TraceID: "5759e988bd862e3fe1be46a994272793", SpanID: "53995c3f42cd8ad8"},
+		},
+		{
+			name: "None",
+			log: logservice.Log{
+				Type:    logservice.Function,
+				Content: []byte(`"hello"`),
+			},
+			want: traceContext{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, extractTraceContext(tt.log))
+		})
+	}
+}
@@ -0,0 +1,393 @@
+package promremotewrite
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/forwardservice"
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/utils"
+)
+
+// reportMetrics are the gauges of platform.report records, which are converted into the base units of Prometheus
+var reportMetrics = []struct {
+	key   string
+	name  string
+	scale float64
+}{
+	{key: "durationMs", name: "lambda_duration_seconds", scale: 1e-3},
+	{key: "billedDurationMs", name: "lambda_billed_duration_seconds", scale: 1e-3},
+	{key: "initDurationMs", name: "lambda_init_duration_seconds", scale: 1e-3},
+	{key: "memorySizeMB", name: "lambda_memory_size_bytes", scale: 1 << 20},
+	{key: "maxMemoryUsedMB", name: "lambda_max_memory_used_bytes", scale: 1 << 20},
+}
+
+// The counters of the execution environment
+const (
+	invocationsTotal = "lambda_invocations_total"
+	coldStartsTotal  = "lambda_cold_starts_total"
+)
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// invalidNameCharRegexp matches the characters of metric and label names which are not allowed by Prometheus
+var invalidNameCharRegexp = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// reservedLabels are the labels set by the forwarder, which could not be overridden by static labels
+var reservedLabels = map[string]bool{"function_name": true, "region": true, "version": true, "instance": true}
+
+// PromRemoteWrite pushes the metrics of platform.report records and the metric logs of the logmetrics processor to
+// Prometheus compatible storages, e.g. Mimir, Thanos or Cortex, by remote write protocol
+type PromRemoteWrite struct {
+	name       string
+	cfg        config
+	logger     zerolog.Logger
+	httpClient *http.Client
+	params     forwardservice.ForwarderParams
+	version    string
+	instance   string
+	// counters holds the cumulative counters of the delivered reports
+	counters counters
+}
+
+type config struct {
+	Enable      *bool
+	URL         *string
+	Username    *string
+	Password    *string
+	BearerToken *string
+	Labels      *labels
+	Timeout     *time.Duration
+}
+
+// counters are the counters of the execution environment and the timestamp of the last sample.
+// Prometheus rejects the samples which are not newer than the last one of the same series.
+type counters struct {
+	invocations   float64
+	coldStarts    float64
+	lastTimestamp int64
+	// metrics are the cumulative values of the metric logs by their series
+	metrics map[string]float64
+}
+
+func init() {
+	forwardservice.Register("promremotewrite", func(instance string) forwardservice.ForwarderV2 {
+		return NewInstance(instance)
+	})
+}
+
+func New() *PromRemoteWrite {
+	return NewInstance("")
+}
+
+// NewInstance creates the named instance of the forwarder, whose configs are prefixed by `promremotewrite-<instance>`
+func NewInstance(instance string) *PromRemoteWrite {
+	name := forwardservice.InstanceName("promremotewrite", instance)
+	return &PromRemoteWrite{
+		name:   name,
+		logger: zerolog.New(os.Stdout).With().Str("forwarder", name).Timestamp().Logger(),
+	}
+}
+
+func (s *PromRemoteWrite) Name() string {
+	return s.name
+}
+
+func (s *PromRemoteWrite) SetupConfigs(app *kingpin.Application) {
+	s.cfg.Enable = app.
+		Flag(s.name+"-enable", fmt.Sprintf("Enable the %s forwarder", s.name)).
+		Envar(forwardservice.EnvarName(s.name, "ENABLE")).
+		Default("false").Bool()
+	s.cfg.URL = app.
+		Flag(s.name+"-url", "The remote write endpoint, e.g. https://mimir.example.com/api/v1/push").
+		Envar(forwardservice.EnvarName(s.name, "URL")).
+		Default("").String()
+	s.cfg.Username = app.
+		Flag(s.name+"-username", "The username of basic authentication").
+		Envar(forwardservice.EnvarName(s.name, "USERNAME")).
+		Default("").String()
+	s.cfg.Password = app.
+		Flag(s.name+"-password", "The password of basic authentication").
+		Envar(forwardservice.EnvarName(s.name, "PASSWORD")).
+		Default("").String()
+	s.cfg.BearerToken = app.
+		Flag(s.name+"-bearer-token", "The bearer token of the requests, which takes precedence over basic authentication").
+		Envar(forwardservice.EnvarName(s.name, "BEARER_TOKEN")).
+		Default("").String()
+	s.cfg.Labels = new(labels)
+	app.
+		Flag(s.name+"-labels", "The comma separated static labels added to all time series, e.g. env=prod,team=orders").
+		Envar(forwardservice.EnvarName(s.name, "LABELS")).
+		Default("").SetValue(s.cfg.Labels)
+	s.cfg.Timeout = app.
+		Flag(s.name+"-timeout", "The timeout of the remote write requests").
+		Envar(forwardservice.EnvarName(s.name, "TIMEOUT")).
+		Default("5s").Duration()
+}
+
+func (s *PromRemoteWrite) Init(params forwardservice.ForwarderParams) error {
+	s.params = params
+	s.logger = s.logger.With().Str("lambdaName", s.params.LambdaName).Str("awsRegion", s.params.AWSRegion).Logger()
+	s.httpClient = &http.Client{Timeout: *s.cfg.Timeout}
+
+	s.version = os.Getenv("AWS_LAMBDA_FUNCTION_VERSION")
+	// The counters are only cumulative in the execution environment, so each of them is a distinct series
+	s.instance = os.Getenv("AWS_LAMBDA_LOG_STREAM_NAME")
+	if s.instance == "" {
+		s.instance = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+
+	if *s.cfg.URL == "" && *s.cfg.Enable {
+		return errors.New("promremotewrite: the remote write url is not set")
+	}
+	return nil
+}
+
+func (s *PromRemoteWrite) IsEnable() bool {
+	return *s.cfg.Enable
+}
+
+// Send pushes the time series converted from the reports. It returns an error if the time series could be
+// retried later, and the counters are only advanced once the time series are accepted or dropped.
+func (s *PromRemoteWrite) Send(ctx context.Context, logs []logservice.Log) error {
+	series, next := s.series(logs)
+	if len(series) == 0 {
+		return nil
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, *s.cfg.URL, bytes.NewReader(snappyEncode(marshalWriteRequest(series))))
+	if err != nil {
+		s.logger.Error().Err(err).Msg("fail to build remote write request")
+		return nil
+	}
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("User-Agent", "lambda-extension-log-shipper/1")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if *s.cfg.BearerToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+*s.cfg.BearerToken)
+	} else if *s.cfg.Username != "" {
+		httpReq.SetBasicAuth(*s.cfg.Username, *s.cfg.Password)
+	}
+
+	httpRes, err := s.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("promremotewrite: fail to push time series: %w", err)
+	}
+	defer httpRes.Body.Close()
+	body, err := ioutil.ReadAll(httpRes.Body)
+	if err != nil {
+		return fmt.Errorf("promremotewrite: fail to read remote write response: %w", err)
+	}
+	if httpRes.StatusCode == http.StatusTooManyRequests || httpRes.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("promremotewrite: remote write response, status: %s, response: %s", httpRes.Status, string(body))
+	}
+	if httpRes.StatusCode/100 != 2 {
+		s.logger.Error().Int("series", len(series)).Msgf("remote write response, status: %s, response: %s", httpRes.Status, string(body))
+	}
+	s.counters = next
+	return nil
+}
+
+// series converts the reports and the metric logs into the time series, and returns the counters after them
+func (s *PromRemoteWrite) series(logs []logservice.Log) ([]TimeSeries, counters) {
+	next := s.counters
+	next.metrics = nil
+	for key, value := range s.counters.metrics {
+		if next.metrics == nil {
+			next.metrics = make(map[string]float64, len(s.counters.metrics))
+		}
+		next.metrics[key] = value
+	}
+	index := make(map[string]int)
+	var series []TimeSeries
+	add := func(name string, version string, extra []Label, sample Sample) {
+		list := s.labels(name, version, extra)
+		key := seriesKey(list)
+		i, ok := index[key]
+		if !ok {
+			i = len(series)
+			index[key] = i
+			series = append(series, TimeSeries{Labels: list})
+		}
+		series[i].Samples = append(series[i].Samples, sample)
+	}
+	// accumulate adds the value to the cumulative counter of the series
+	accumulate := func(name string, version string, extra []Label, value float64, timestamp int64) {
+		key := seriesKey(s.labels(name, version, extra))
+		if next.metrics == nil {
+			next.metrics = make(map[string]float64)
+		}
+		next.metrics[key] += value
+		add(name, version, extra, Sample{Value: next.metrics[key], Timestamp: timestamp})
+	}
+
+	for _, log := range logs {
+		if log.Type != logservice.PlatformReport && log.Type != logservice.Metric {
+			continue
+		}
+
+		timestamp := log.Time.UnixNano() / 1e6
+		if timestamp <= next.lastTimestamp {
+			timestamp = next.lastTimestamp + 1
+		}
+
+		version := s.version
+		if v, ok := log.Metadata["functionVersion"]; ok {
+			version = fmt.Sprint(v)
+		}
+		instance := []Label{{Name: "instance", Value: s.instance}}
+
+		if log.Type == logservice.Metric {
+			var record logservice.MetricRecord
+			if err := json.Unmarshal(log.Content, &record); err != nil {
+				s.logger.Error().Err(err).Msg("fail to parse metric")
+				continue
+			}
+			next.lastTimestamp = timestamp
+
+			// The metrics are aggregated per invocation, so they are accumulated into counters of the execution
+			// environment. A histogram is a summary of its count and sum.
+			name := sanitizeName(record.Name)
+			extra := append(s.metricLabels(record.Labels), instance...)
+			switch record.Type {
+			case "counter":
+				accumulate(name+"_total", version, extra, record.Value, timestamp)
+			case "histogram":
+				accumulate(name+"_count", version, extra, float64(record.Count), timestamp)
+				accumulate(name+"_sum", version, extra, record.Sum, timestamp)
+			}
+			continue
+		}
+
+		var record map[string]float64
+		if err := json.Unmarshal(log.Content, &record); err != nil {
+			s.logger.Error().Err(err).Msg("fail to parse platform.report metrics")
+			continue
+		}
+		next.lastTimestamp = timestamp
+
+		for _, m := range reportMetrics {
+			if value, ok := record[m.key]; ok {
+				add(m.name, version, nil, Sample{Value: value * m.scale, Timestamp: timestamp})
+			}
+		}
+		next.invocations++
+		if _, ok := record["initDurationMs"]; ok {
+			next.coldStarts++
+		}
+		add(invocationsTotal, version, instance, Sample{Value: next.invocations, Timestamp: timestamp})
+		add(coldStartsTotal, version, instance, Sample{Value: next.coldStarts, Timestamp: timestamp})
+	}
+	return series, next
+}
+
+// labels returns the labels of the series sorted by name
+func (s *PromRemoteWrite) labels(name string, version string, extra []Label) []Label {
+	list := []Label{
+		{Name: "__name__", Value: name},
+		{Name: "function_name", Value: s.params.LambdaName},
+		{Name: "region", Value: s.params.AWSRegion},
+		{Name: "version", Value: version},
+	}
+	list = append(list, extra...)
+	list = append(list, *s.cfg.Labels...)
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// metricLabels converts the labels of a metric log into valid label names. The names which are taken by the
+// forwarder or the static labels are prefixed by `exported_`, as Prometheus does for scraped labels.
+func (s *PromRemoteWrite) metricLabels(labels map[string]string) []Label {
+	var list []Label
+	for name, value := range labels {
+		name = sanitizeName(name)
+		if reservedLabels[name] || s.cfg.Labels.has(name) {
+			name = "exported_" + name
+		}
+		list = append(list, Label{Name: name, Value: value})
+	}
+	return list
+}
+
+// seriesKey identifies the series by its sorted labels
+func seriesKey(labels []Label) string {
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString(l.Name)
+		b.WriteByte('\xff')
+		b.WriteString(l.Value)
+		b.WriteByte('\xff')
+	}
+	return b.String()
+}
+
+// sanitizeName replaces the characters which are not allowed in metric and label names, e.g. `http.status`
+func sanitizeName(name string) string {
+	name = invalidNameCharRegexp.ReplaceAllString(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+func (s *PromRemoteWrite) Flush(_ context.Context) error {
+	return nil
+}
+
+func (s *PromRemoteWrite) Shutdown(_ context.Context) error {
+	return nil
+}
+
+// labels is the comma separated static labels, e.g. `env=prod,team=orders`. It implements kingpin.Value.
+type labels []Label
+
+func (l *labels) Set(value string) error {
+	var list labels
+	for _, item := range utils.SplitList(value) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("promremotewrite: label should be name=value: %s", item)
+		}
+		name := strings.TrimSpace(parts[0])
+		if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("promremotewrite: invalid label name: %s", name)
+		}
+		if reservedLabels[name] {
+			return fmt.Errorf("promremotewrite: label is reserved: %s", name)
+		}
+		list = append(list, Label{Name: name, Value: strings.TrimSpace(parts[1])})
+	}
+	*l = list
+	return nil
+}
+
+func (l *labels) has(name string) bool {
+	for _, label := range *l {
+		if label.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *labels) String() string {
+	var items []string
+	for _, label := range *l {
+		items = append(items, label.Name+"="+label.Value)
+	}
+	return strings.Join(items, ",")
+}
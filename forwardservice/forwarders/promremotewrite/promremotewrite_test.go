@@ -0,0 +1,257 @@
+package promremotewrite
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/david7482/lambda-extension-log-shipper/configtest"
+	"github.com/david7482/lambda-extension-log-shipper/extension"
+	"github.com/david7482/lambda-extension-log-shipper/forwardservice"
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/metrics"
+	"github.com/david7482/lambda-extension-log-shipper/processservice"
+	"github.com/david7482/lambda-extension-log-shipper/processservice/processors/logmetrics"
+)
+
+func newTestPromRemoteWrite(t *testing.T, url string, args ...string) *PromRemoteWrite {
+	s := New()
+	configtest.Parse(t, s.SetupConfigs, append([]string{"--promremotewrite-enable", "--promremotewrite-url", url}, args...)...)
+	require.NoError(t, s.Init(forwardservice.ForwarderParams{LambdaName: "hello", AWSRegion: "us-east-1"}))
+	s.instance = "instance-1"
+	s.version = "$LATEST"
+	return s
+}
+
+func TestSnappy(t *testing.T) {
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := [][]byte{
+		nil,
+		[]byte("a"),
+		[]byte("abcabcabcabcabcabcabcabc"),
+		bytes.Repeat([]byte("lambda_duration_seconds"), 1000),
+		bytes.Repeat([]byte{0}, 70000),
+		random,
+	}
+	for _, input := range inputs {
+		encoded := snappyEncode(input)
+		decoded, err := snappyDecode(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, len(input), len(decoded))
+		assert.True(t, bytes.Equal(input, decoded))
+	}
+	assert.Less(t, len(snappyEncode(bytes.Repeat([]byte("lambda"), 1000))), 600)
+
+	// A literal of "abc" and a copy of 6 bytes at offset 3 with 1-byte offset
+	decoded, err := snappyDecode([]byte{0x09, 0x08, 'a', 'b', 'c', 0x09, 0x03})
+	require.NoError(t, err)
+	assert.Equal(t, "abcabcabc", string(decoded))
+
+	_, err = snappyDecode([]byte{0x09, 0x08, 'a', 'b', 'c', 0x09, 0x04})
+	assert.Error(t, err)
+	_, err = snappyDecode([]byte{0x05, 0x08, 'a', 'b', 'c'})
+	assert.Error(t, err)
+}
+
+func TestWriteRequest(t *testing.T) {
+	series := []TimeSeries{
+		{
+			Labels:  []Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "lambda"}},
+			Samples: []Sample{{Value: 1, Timestamp: 1600000000000}, {Value: -0.5, Timestamp: 1600000000001}},
+		},
+		{
+			Labels:  []Label{{Name: "__name__", Value: "empty"}},
+			Samples: []Sample{{Value: 0, Timestamp: 0}},
+		},
+	}
+	encoded := marshalWriteRequest(series)
+	// The label `__name__="up"` of the first series
+	assert.Equal(t, []byte{0x0a, 0x0e, 0x0a, 0x08, '_', '_', 'n', 'a', 'm', 'e', '_', '_', 0x12, 0x02, 'u', 'p'}, encoded[2:18])
+
+	decoded, err := unmarshalWriteRequest(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, series, decoded)
+
+	_, err = unmarshalWriteRequest(encoded[:len(encoded)-1])
+	assert.Error(t, err)
+}
+
+func TestPromRemoteWrite_Send(t *testing.T) {
+	receiver := &Receiver{BearerToken: "secret"}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	s := newTestPromRemoteWrite(t, server.URL, "--promremotewrite-bearer-token", "secret", "--promremotewrite-labels", "env=prod")
+	require.True(t, s.IsEnable())
+	now := time.Unix(1600000000, 0)
+	logs := []logservice.Log{
+		{
+			Time:     now,
+			Type:     logservice.PlatformReport,
+			Content:  []byte(`{"durationMs":101.5,"billedDurationMs":102,"memorySizeMB":128,"maxMemoryUsedMB":34,"initDurationMs":150.2}`),
+			Metadata: map[string]interface{}{"functionVersion": "3"},
+		},
+		{Time: now, Type: logservice.Function, Content: []byte(`"hello"`)},
+		{
+			Time:     now,
+			Type:     logservice.PlatformReport,
+			Content:  []byte(`{"durationMs":2,"billedDurationMs":2,"memorySizeMB":128,"maxMemoryUsedMB":35}`),
+			Metadata: map[string]interface{}{"functionVersion": "3"},
+		},
+	}
+	require.NoError(t, s.Send(context.Background(), logs))
+
+	lines := map[string]string{}
+	for _, ts := range receiver.Series() {
+		for i, l := range ts.Labels {
+			if i > 0 {
+				assert.Less(t, ts.Labels[i-1].Name, l.Name)
+			}
+		}
+		lines[ts.Labels[0].Value] = ts.String()
+	}
+	assert.Len(t, lines, 7)
+	labels := `{env="prod",function_name="hello",region="us-east-1",version="3"}`
+	assert.Equal(t, "lambda_duration_seconds"+labels+" 0.1015 1600000000000\n"+
+		"lambda_duration_seconds"+labels+" 0.002 1600000000001", lines["lambda_duration_seconds"])
+	assert.Equal(t, "lambda_init_duration_seconds"+labels+" 0.1502 1600000000000", lines["lambda_init_duration_seconds"])
+	assert.Equal(t, "lambda_max_memory_used_bytes"+labels+" 3.5651584e+07 1600000000000\n"+
+		"lambda_max_memory_used_bytes"+labels+" 3.670016e+07 1600000000001", lines["lambda_max_memory_used_bytes"])
+	counterLabels := `{env="prod",function_name="hello",instance="instance-1",region="us-east-1",version="3"}`
+	assert.Equal(t, "lambda_cold_starts_total"+counterLabels+" 1 1600000000000\n"+
+		"lambda_cold_starts_total"+counterLabels+" 1 1600000000001", lines["lambda_cold_starts_total"])
+	assert.Equal(t, "lambda_invocations_total"+counterLabels+" 1 1600000000000\n"+
+		"lambda_invocations_total"+counterLabels+" 2 1600000000001", lines["lambda_invocations_total"])
+	assert.Equal(t, counters{invocations: 2, coldStarts: 1, lastTimestamp: 1600000000001}, s.counters)
+
+	// Logs without reports are not pushed
+	require.NoError(t, s.Send(context.Background(), logs[1:2]))
+	assert.Len(t, receiver.Series(), 7)
+}
+
+func TestPromRemoteWrite_Send_metrics(t *testing.T) {
+	receiver := &Receiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	m := logmetrics.New()
+	configtest.Parse(t, m.SetupConfigs, "--logmetrics-rules", "counter errors when content~ERROR; histogram http.latency value=latency_ms by=route,region")
+	m.Init(processservice.ProcessorParams{})
+	now := time.Unix(1600000000, 0)
+	function := func(requestID string, line string, fields map[string]interface{}) logservice.Log {
+		return logservice.Log{Time: now, Type: logservice.Function, RequestID: requestID, Content: []byte(`"` + line + `"`), Fields: fields}
+	}
+	var logs []logservice.Log
+	for _, log := range m.Process([]logservice.Log{
+		function("1", "ERROR fail", nil),
+		function("1", "ok", map[string]interface{}{"latency_ms": float64(30), "route": "/orders", "region": "eu"}),
+		function("1", "ok", map[string]interface{}{"latency_ms": float64(10), "route": "/orders", "region": "eu"}),
+		function("2", "ERROR fail", nil),
+	}) {
+		if log.Type == logservice.Metric {
+			logs = append(logs, log)
+		}
+	}
+	logs = append(logs, m.Flush()...)
+	require.Len(t, logs, 3)
+
+	s := newTestPromRemoteWrite(t, server.URL, "--promremotewrite-labels", "env=prod")
+	require.NoError(t, s.Send(context.Background(), logs))
+
+	lines := map[string]string{}
+	for _, ts := range receiver.Series() {
+		lines[ts.Labels[0].Value] = ts.String()
+	}
+	assert.Len(t, lines, 3)
+	counterLabels := `{env="prod",function_name="hello",instance="instance-1",region="us-east-1",version="$LATEST"}`
+	assert.Equal(t, "errors_total"+counterLabels+" 1 1600000000000\n"+
+		"errors_total"+counterLabels+" 2 1600000000002", lines["errors_total"])
+	histogramLabels := `{env="prod",exported_region="eu",function_name="hello",instance="instance-1",region="us-east-1",route="/orders",version="$LATEST"}`
+	assert.Equal(t, "http_latency_count"+histogramLabels+" 2 1600000000001", lines["http_latency_count"])
+	assert.Equal(t, "http_latency_sum"+histogramLabels+" 40 1600000000001", lines["http_latency_sum"])
+
+	// The metrics are cumulative in the execution environment
+	require.NoError(t, s.Send(context.Background(), logs[:1]))
+	series := receiver.Series()
+	assert.Equal(t, "errors_total"+counterLabels+" 3 1600000000003", series[len(series)-1].String())
+}
+
+func TestPromRemoteWrite_Send_failures(t *testing.T) {
+	receiver := &Receiver{Username: "user", Password: "pass"}
+	status := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		receiver.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	report := logservice.Log{Time: time.Unix(1600000000, 0), Type: logservice.PlatformReport, Content: []byte(`{"durationMs":1}`)}
+
+	// Server errors could be retried later, and the counters are kept
+	s := newTestPromRemoteWrite(t, server.URL, "--promremotewrite-username", "user", "--promremotewrite-password", "pass")
+	status = http.StatusServiceUnavailable
+	assert.Error(t, s.Send(context.Background(), []logservice.Log{report}))
+	assert.Equal(t, counters{}, s.counters)
+	status = http.StatusTooManyRequests
+	assert.Error(t, s.Send(context.Background(), []logservice.Log{report}))
+
+	status = 0
+	require.NoError(t, s.Send(context.Background(), []logservice.Log{report}))
+	assert.Len(t, receiver.Series(), 3)
+	assert.Equal(t, float64(1), s.counters.invocations)
+
+	// Client errors, e.g. wrong credentials, could not be retried
+	s = newTestPromRemoteWrite(t, server.URL, "--promremotewrite-username", "user", "--promremotewrite-password", "wrong")
+	assert.NoError(t, s.Send(context.Background(), []logservice.Log{report}))
+	assert.Len(t, receiver.Series(), 3)
+
+	// Network errors could be retried later
+	s = newTestPromRemoteWrite(t, "http://127.0.0.1:1")
+	assert.Error(t, s.Send(context.Background(), []logservice.Log{report}))
+
+	// The push is cancelled at the deadline, and could be retried later
+	s = newTestPromRemoteWrite(t, server.URL, "--promremotewrite-username", "user", "--promremotewrite-password", "pass")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, s.Send(ctx, []logservice.Log{report}))
+	assert.Equal(t, counters{}, s.counters)
+}
+
+func TestLabels_Set(t *testing.T) {
+	var l labels
+	require.NoError(t, l.Set("env=prod, team = orders"))
+	assert.Equal(t, "env=prod,team=orders", l.String())
+	assert.Error(t, l.Set("env"))
+	assert.Error(t, l.Set("1env=prod"))
+	assert.Error(t, l.Set("__name__=up"))
+	assert.Error(t, l.Set("region=eu-west-1"))
+}
+
+func TestPromRemoteWrite_Init(t *testing.T) {
+	assert.True(t, newTestPromRemoteWrite(t, "http://localhost:9201").IsEnable())
+
+	// The enabled forwarder without a url fails the forward service, and so the extension at startup
+	s := New()
+	configtest.Parse(t, s.SetupConfigs, "--promremotewrite-enable")
+	_, err := forwardservice.New(forwardservice.ServiceParams{Forwarders: []forwardservice.ForwarderV2{s}, Metrics: metrics.New()})
+	require.Error(t, err)
+	assert.Equal(t, extension.ForwarderInitFailed, extension.TypeOf(err))
+	assert.Contains(t, err.Error(), "url")
+
+	// A disabled forwarder is not validated
+	s = New()
+	configtest.Parse(t, s.SetupConfigs)
+	assert.NoError(t, s.Init(forwardservice.ForwarderParams{}))
+	assert.False(t, s.IsEnable())
+}
@@ -0,0 +1,183 @@
+package promremotewrite
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// The protobuf messages of Prometheus remote write, which are encoded by hand to avoid the protobuf dependency.
+// See https://github.com/prometheus/prometheus/blob/main/prompb/remote.proto
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+
+// Label is a name and value pair of a time series. The metric name is the label `__name__`.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a value of a time series at the timestamp in milliseconds
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// TimeSeries is the samples of the labels, which have to be sorted by name
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errCorruptProto = errors.New("promremotewrite: corrupt protobuf input")
+
+// marshalWriteRequest encodes the WriteRequest of the time series
+func marshalWriteRequest(series []TimeSeries) []byte {
+	var buf []byte
+	for _, ts := range series {
+		var tsBuf []byte
+		for _, l := range ts.Labels {
+			var labelBuf []byte
+			labelBuf = appendBytes(labelBuf, 1, []byte(l.Name))
+			labelBuf = appendBytes(labelBuf, 2, []byte(l.Value))
+			tsBuf = appendBytes(tsBuf, 1, labelBuf)
+		}
+		for _, s := range ts.Samples {
+			var sampleBuf []byte
+			sampleBuf = appendKey(sampleBuf, 1, wireFixed64)
+			sampleBuf = appendFixed64(sampleBuf, math.Float64bits(s.Value))
+			sampleBuf = appendKey(sampleBuf, 2, wireVarint)
+			sampleBuf = appendVarint(sampleBuf, uint64(s.Timestamp))
+			tsBuf = appendBytes(tsBuf, 2, sampleBuf)
+		}
+		buf = appendBytes(buf, 1, tsBuf)
+	}
+	return buf
+}
+
+func appendKey(buf []byte, field int, wire int) []byte {
+	return appendVarint(buf, uint64(field<<3|wire))
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func appendFixed64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendBytes(buf []byte, field int, b []byte) []byte {
+	buf = appendKey(buf, field, wireBytes)
+	buf = appendVarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// unmarshalWriteRequest decodes the time series of the WriteRequest. Unknown fields, e.g. metadata, are skipped.
+func unmarshalWriteRequest(buf []byte) ([]TimeSeries, error) {
+	var series []TimeSeries
+	err := walkFields(buf, func(field int, value []byte, _ uint64) error {
+		if field != 1 {
+			return nil
+		}
+		var ts TimeSeries
+		err := walkFields(value, func(field int, value []byte, _ uint64) error {
+			switch field {
+			case 1:
+				var l Label
+				err := walkFields(value, func(field int, value []byte, _ uint64) error {
+					switch field {
+					case 1:
+						l.Name = string(value)
+					case 2:
+						l.Value = string(value)
+					}
+					return nil
+				})
+				ts.Labels = append(ts.Labels, l)
+				return err
+			case 2:
+				var s Sample
+				err := walkFields(value, func(field int, _ []byte, number uint64) error {
+					switch field {
+					case 1:
+						s.Value = math.Float64frombits(number)
+					case 2:
+						s.Timestamp = int64(number)
+					}
+					return nil
+				})
+				ts.Samples = append(ts.Samples, s)
+				return err
+			}
+			return nil
+		})
+		series = append(series, ts)
+		return err
+	})
+	return series, err
+}
+
+// walkFields calls fn with each field of the message, either the bytes of a length-delimited field
+// or the number of a numeric field
+func walkFields(buf []byte, fn func(field int, value []byte, number uint64) error) error {
+	for len(buf) > 0 {
+		key, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return errCorruptProto
+		}
+		buf = buf[n:]
+
+		var value []byte
+		var number uint64
+		switch key & 0x07 {
+		case wireVarint:
+			number, n = binary.Uvarint(buf)
+			if n <= 0 {
+				return errCorruptProto
+			}
+			buf = buf[n:]
+		case wireFixed64:
+			if len(buf) < 8 {
+				return errCorruptProto
+			}
+			number = binary.LittleEndian.Uint64(buf)
+			buf = buf[8:]
+		case wireBytes:
+			length, n := binary.Uvarint(buf)
+			if n <= 0 || length > uint64(len(buf)-n) {
+				return errCorruptProto
+			}
+			value = buf[n : n+int(length)]
+			buf = buf[n+int(length):]
+		case wireFixed32:
+			if len(buf) < 4 {
+				return errCorruptProto
+			}
+			number = uint64(binary.LittleEndian.Uint32(buf))
+			buf = buf[4:]
+		default:
+			return errCorruptProto
+		}
+		if err := fn(int(key>>3), value, number); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package promremotewrite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Receiver is a minimal remote write endpoint which keeps the received time series in memory.
+// It is meant for local testing of the forwarder, see examples/remote-write-receiver.
+type Receiver struct {
+	// Username and Password require basic authentication if set
+	Username string
+	Password string
+	// BearerToken requires the bearer token if set
+	BearerToken string
+	// OnWrite is called with the time series of each accepted request
+	OnWrite func([]TimeSeries)
+
+	mu     sync.Mutex
+	series []TimeSeries
+}
+
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !r.authorized(req) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if req.Header.Get("Content-Encoding") != "snappy" || req.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(w, "unsupported content type or encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	decoded, err := snappyDecode(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	series, err := unmarshalWriteRequest(decoded)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.mu.Lock()
+	r.series = append(r.series, series...)
+	r.mu.Unlock()
+	if r.OnWrite != nil {
+		r.OnWrite(series)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *Receiver) authorized(req *http.Request) bool {
+	if r.BearerToken != "" {
+		return req.Header.Get("Authorization") == "Bearer "+r.BearerToken
+	}
+	if r.Username != "" {
+		username, password, ok := req.BasicAuth()
+		return ok && username == r.Username && password == r.Password
+	}
+	return true
+}
+
+// Series returns all received time series
+func (r *Receiver) Series() []TimeSeries {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]TimeSeries(nil), r.series...)
+}
+
+// String formats the time series in the Prometheus text format, one line for each sample
+func (ts TimeSeries) String() string {
+	var name string
+	var labels []string
+	for _, l := range ts.Labels {
+		if l.Name == "__name__" {
+			name = l.Value
+			continue
+		}
+		labels = append(labels, fmt.Sprintf("%s=%q", l.Name, l.Value))
+	}
+	var lines []string
+	for _, s := range ts.Samples {
+		lines = append(lines, fmt.Sprintf("%s{%s} %s %d", name, strings.Join(labels, ","),
+			strconv.FormatFloat(s.Value, 'g', -1, 64), s.Timestamp))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,155 @@
+package promremotewrite
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The snappy block format, which is required by Prometheus remote write.
+// See https://github.com/google/snappy/blob/main/format_description.txt
+
+const (
+	tagLiteral = 0x00
+	tagCopy1   = 0x01
+	tagCopy2   = 0x02
+	tagCopy4   = 0x03
+
+	snappyHashBits  = 14
+	snappyMaxOffset = 1<<16 - 1
+)
+
+var errCorruptSnappy = errors.New("promremotewrite: corrupt snappy input")
+
+// snappyEncode compresses src with a greedy matcher of 4-byte sequences
+func snappyEncode(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, len(src)+len(src)/6+binary.MaxVarintLen64)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+
+	// table holds the last position+1 of each hashed sequence, 0 if there is none
+	var table [1 << snappyHashBits]int
+	literal := 0
+	for i := 0; i+4 <= len(src); {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := (seq * 0x1e35a7bd) >> (32 - snappyHashBits)
+		candidate := table[h] - 1
+		table[h] = i + 1
+		if candidate < 0 || i-candidate > snappyMaxOffset || binary.LittleEndian.Uint32(src[candidate:]) != seq {
+			i++
+			continue
+		}
+
+		length := 4
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = appendLiteral(dst, src[literal:i])
+		dst = appendCopy(dst, i-candidate, length)
+		i += length
+		literal = i
+	}
+	return appendLiteral(dst, src[literal:])
+}
+
+func appendLiteral(dst, literal []byte) []byte {
+	if len(literal) == 0 {
+		return dst
+	}
+	n := len(literal) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|tagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|tagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|tagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|tagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|tagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, literal...)
+}
+
+// appendCopy writes the copies of 2-byte offsets, each of them is at most 64 bytes
+func appendCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > 64 {
+			n = 64
+		}
+		dst = append(dst, byte(n-1)<<2|tagCopy2, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
+
+// snappyDecode decompresses the snappy block
+func snappyDecode(src []byte) ([]byte, error) {
+	n, read := binary.Uvarint(src)
+	if read <= 0 || n > 1<<30 {
+		return nil, errCorruptSnappy
+	}
+	src = src[read:]
+	dst := make([]byte, 0, n)
+
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 0x03 {
+		case tagLiteral:
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				size := length - 59
+				if len(src) < size {
+					return nil, errCorruptSnappy
+				}
+				length = 0
+				for i := size - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				src = src[size:]
+			}
+			length++
+			if length > len(src) {
+				return nil, errCorruptSnappy
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case tagCopy1:
+			if len(src) < 2 {
+				return nil, errCorruptSnappy
+			}
+			length = 4 + int(tag>>2)&0x07
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case tagCopy2:
+			if len(src) < 3 {
+				return nil, errCorruptSnappy
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case tagCopy4:
+			if len(src) < 5 {
+				return nil, errCorruptSnappy
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) {
+			return nil, errCorruptSnappy
+		}
+		// the copy could overlap with itself, e.g. a run of the same byte
+		start := len(dst) - offset
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, errCorruptSnappy
+	}
+	return dst, nil
+}
@@ -1,6 +1,7 @@
 package stdout
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/rs/zerolog"
@@ -11,6 +12,7 @@ import (
 )
 
 type Stdout struct {
+	name       string
 	cfg        config
 	logger     zerolog.Logger
 	lambdaName string
@@ -21,16 +23,33 @@ type config struct {
 	Enable *bool
 }
 
+func init() {
+	forwardservice.Register("stdout", func(instance string) forwardservice.ForwarderV2 {
+		return forwardservice.Adapt(NewInstance(instance))
+	})
+}
+
 func New() *Stdout {
+	return NewInstance("")
+}
+
+// NewInstance creates the named instance of the forwarder, whose configs are prefixed by `stdout-<instance>`
+func NewInstance(instance string) *Stdout {
+	name := forwardservice.InstanceName("stdout", instance)
 	return &Stdout{
-		logger: zerolog.New(os.Stdout).With().Str("forwarder", "stdout").Timestamp().Logger(),
+		name:   name,
+		logger: zerolog.New(os.Stdout).With().Str("forwarder", name).Timestamp().Logger(),
 	}
 }
 
+func (s *Stdout) Name() string {
+	return s.name
+}
+
 func (s *Stdout) SetupConfigs(app *kingpin.Application) {
 	s.cfg.Enable = app.
-		Flag("stdout-enable", "Enable the stdout forwarder").
-		Envar("LS_STDOUT_ENABLE").
+		Flag(s.name+"-enable", fmt.Sprintf("Enable the %s forwarder", s.name)).
+		Envar(forwardservice.EnvarName(s.name, "ENABLE")).
 		Default("true").Bool()
 }
 
@@ -46,7 +65,17 @@ func (s *Stdout) IsEnable() bool {
 
 func (s *Stdout) SendLog(logs []logservice.Log) {
 	for _, log := range logs {
-		s.logger.Log().Time("time", log.Time).Str("lambdaRequestId", log.RequestID).RawJSON("content", log.Content).Send()
+		e := s.logger.Log().Time("time", log.Time).Str("lambdaRequestId", log.RequestID).Str("level", log.Level.String()).RawJSON("content", log.Content)
+		if log.Fields != nil {
+			e = e.Interface("fields", log.Fields)
+		}
+		if log.Metadata != nil {
+			e = e.Interface("metadata", log.Metadata)
+		}
+		if log.SampleRate > 0 {
+			e = e.Float64("sampleRate", log.SampleRate)
+		}
+		e.Send()
 	}
 }
 
@@ -2,12 +2,17 @@ package forwardservice
 
 import (
 	"context"
+	"fmt"
 	"sync"
 
 	"github.com/rs/zerolog"
 	"gopkg.in/alecthomas/kingpin.v2"
 
+	"github.com/david7482/lambda-extension-log-shipper/extension"
 	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/metrics"
+	"github.com/david7482/lambda-extension-log-shipper/redact"
+	"github.com/david7482/lambda-extension-log-shipper/spill"
 )
 
 type ForwarderParams struct {
@@ -15,7 +20,10 @@ type ForwarderParams struct {
 	AWSRegion  string
 }
 
+// Forwarder is the interface of forwarders which neither report failures nor take a context. It is adapted to
+// ForwarderV2 by Adapt.
 type Forwarder interface {
+	Name() string
 	SetupConfigs(app *kingpin.Application)
 	Init(params ForwarderParams)
 	IsEnable() bool
@@ -24,53 +32,169 @@ type Forwarder interface {
 }
 
 type ServiceParams struct {
-	Forwarders []Forwarder
-	LogsQueue  <-chan []logservice.Log
-	LambdaName string
-	AWSRegion  string
+	Forwarders       []ForwarderV2
+	ForwarderOptions map[string]ForwarderOptions
+	Redactor         *redact.Redactor
+	Spill            *spill.Store
+	Metrics          *metrics.Registry
+	Routes           Routes
+	DefaultRoute     []string
+	LogsQueue        <-chan []logservice.Log
+	LambdaName       string
+	AWSRegion        string
 }
 
 type ForwardService struct {
-	forwarders []Forwarder
+	forwarders []*forwarder
+	redactor   *redact.Redactor
+	spill      *spill.Store
+	router     router
 	logsQueue  <-chan []logservice.Log
+
+	// sendCtx is the context of the sends and flushes, which is cancelled at the deadline of the shutdown
+	sendCtx    context.Context
+	cancelSend context.CancelFunc
+	// done is closed once the service is closed
+	done chan struct{}
 }
 
-func New(params ServiceParams) *ForwardService {
+// New returns the forward service with the forwarders initialized, or the error of the forwarder which fails to
+// initialize
+func New(params ServiceParams) (*ForwardService, error) {
 	s := &ForwardService{
-		forwarders: params.Forwarders,
-		logsQueue:  params.LogsQueue,
+		router: router{
+			routes:   params.Routes,
+			defaults: params.DefaultRoute,
+		},
+		logsQueue: params.LogsQueue,
+		done:      make(chan struct{}),
+	}
+	s.sendCtx, s.cancelSend = context.WithCancel(context.Background())
+	if params.Spill != nil && params.Spill.IsEnable() {
+		s.spill = params.Spill
+	}
+	if params.Redactor != nil {
+		params.Redactor.Init()
+		if params.Redactor.IsEnable() {
+			s.redactor = params.Redactor
+		}
 	}
-	for _, f := range s.forwarders {
-		f.Init(ForwarderParams{
+	for _, f := range params.Forwarders {
+		err := f.Init(ForwarderParams{
 			LambdaName: params.LambdaName,
 			AWSRegion:  params.AWSRegion,
 		})
+		if err != nil {
+			return nil, extension.NewError(extension.ForwarderInitFailed, fmt.Errorf("forwardservice: fail to init forwarder %s: %w", f.Name(), err))
+		}
+
+		fwd := newForwarder(f, params.ForwarderOptions[f.Name()])
+		fwd.instrument(params.Metrics)
+		s.forwarders = append(s.forwarders, fwd)
 	}
-	return s
+	return s, nil
 }
 
 func (s *ForwardService) Run(ctx context.Context, wg *sync.WaitGroup) {
 
 	go func() {
 		zerolog.Ctx(ctx).Info().Msg("forward service is running")
-		for logs := range s.logsQueue {
-			// Send log to each forwarder
+		// The logs are still drained after ctx is cancelled, so the sends are only cancelled by the deadline of Shutdown
+		sendCtx := zerolog.Ctx(ctx).WithContext(s.sendCtx)
+		for _, f := range s.forwarders {
+			if f.IsEnable() {
+				f.healthCheck(sendCtx, zerolog.Ctx(ctx))
+			}
+		}
+		if s.spill != nil {
 			for _, f := range s.forwarders {
 				if f.IsEnable() {
-					f.SendLog(logs)
+					f.openSpill(s.spill, zerolog.Ctx(ctx))
+				}
+			}
+		}
+		for logs := range s.logsQueue {
+			// Redact the logs once for all the forwarders which are not trusted
+			var redacted []logservice.Log
+
+			// Evaluate the routes of each log
+			routed := s.router.route(logs, s.forwarders)
+
+			// Send log to each forwarder
+			for i, f := range s.forwarders {
+				if !f.IsEnable() {
+					continue
+				}
+				batch := logs
+				if s.redactor != nil && f.redact {
+					if redacted == nil {
+						redacted = s.redactor.Redact(logs)
+					}
+					batch = redacted
+				}
+				if routed != nil {
+					batch = pick(batch, routed[i])
+				}
+				if filtered := f.accept(batch); len(filtered) > 0 {
+					f.send(sendCtx, filtered, zerolog.Ctx(ctx))
 				}
 			}
 		}
 
 		zerolog.Ctx(ctx).Info().Msg("forward service is closing")
+		// Flush the forwarders in parallel, so a slow destination does not use up the time of the others
+		var flushWg sync.WaitGroup
+		for _, f := range s.forwarders {
+			if f.IsEnable() {
+				flushWg.Add(1)
+				go func(f *forwarder) {
+					defer flushWg.Done()
+					f.shutdown(sendCtx, zerolog.Ctx(ctx))
+				}(f)
+			}
+		}
+		flushWg.Wait()
 		for _, f := range s.forwarders {
 			if f.IsEnable() {
-				f.Shutdown()
+				f.logStats(zerolog.Ctx(ctx))
 			}
 		}
 
 		zerolog.Ctx(ctx).Info().Msg("forward service is closed")
+		s.cancelSend()
+		close(s.done)
 		wg.Done()
 	}()
 
 }
+
+// Shutdown sets the deadline of the service, after which the sends and flushes of the forwarders are cancelled. The
+// service is closed once the logs queue is closed and drained, and the forwarders are flushed.
+func (s *ForwardService) Shutdown(ctx context.Context) {
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.cancelSend()
+		case <-s.done:
+		}
+	}()
+}
+
+// Wait waits until the service is closed, or ctx is done
+func (s *ForwardService) Wait(ctx context.Context) error {
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pick returns the logs of the indexes
+func pick(logs []logservice.Log, indexes []int) []logservice.Log {
+	picked := make([]logservice.Log, 0, len(indexes))
+	for _, i := range indexes {
+		picked = append(picked, logs[i])
+	}
+	return picked
+}
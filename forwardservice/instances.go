@@ -0,0 +1,59 @@
+package forwardservice
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/david7482/lambda-extension-log-shipper/utils"
+)
+
+var instanceRegexp = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// Instance is a named instance of a type of forwarder, e.g. the instance `team` of `newrelic`
+type Instance struct {
+	Type string
+	Name string
+}
+
+// String returns the name of the forwarder, which prefixes its configs, e.g. `newrelic-team` of `newrelic-team-license-key`
+func (i Instance) String() string {
+	return InstanceName(i.Type, i.Name)
+}
+
+// InstanceName returns the name of the instance of the forwarder type. The default instance is named by the type.
+func InstanceName(forwarderType, instance string) string {
+	if instance == "" {
+		return forwarderType
+	}
+	return forwarderType + "-" + instance
+}
+
+// ParseInstances parses the comma separated instances, e.g. `newrelic-team,newrelic-platform`, where each of them is
+// a type of the forwarders followed by the instance name
+func ParseInstances(value string, types []string) ([]Instance, error) {
+	var instances []Instance
+	names := make(map[string]bool)
+	for _, item := range utils.SplitList(value) {
+		parts := strings.SplitN(item, "-", 2)
+		instance := Instance{Type: parts[0]}
+		if len(parts) == 2 {
+			instance.Name = parts[1]
+		}
+		known := false
+		for _, t := range types {
+			known = known || t == instance.Type
+		}
+		switch {
+		case !known:
+			return nil, fmt.Errorf("forwardservice: unknown forwarder type of instance %q, expect one of %s", item, strings.Join(types, ", "))
+		case !instanceRegexp.MatchString(instance.Name):
+			return nil, fmt.Errorf("forwardservice: invalid instance %q, expect <type>-<name> of lowercase letters, digits and dashes", item)
+		case names[item]:
+			return nil, fmt.Errorf("forwardservice: duplicated instance %q", item)
+		}
+		names[item] = true
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
@@ -0,0 +1,31 @@
+package forwardservice
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseInstances(t *testing.T) {
+	types := []string{"newrelic", "stdout"}
+	instances, err := ParseInstances("newrelic-team, newrelic-platform,stdout-debug-2", types)
+	require.NoError(t, err)
+	assert.Equal(t, []Instance{
+		{Type: "newrelic", Name: "team"},
+		{Type: "newrelic", Name: "platform"},
+		{Type: "stdout", Name: "debug-2"},
+	}, instances)
+	assert.Equal(t, "stdout-debug-2", instances[2].String())
+	assert.Equal(t, "LS_STDOUT_DEBUG_2_ENABLE", EnvarName(instances[2].String(), "ENABLE"))
+	assert.Equal(t, "newrelic", InstanceName("newrelic", ""))
+
+	instances, err = ParseInstances("", types)
+	require.NoError(t, err)
+	assert.Empty(t, instances)
+
+	for _, value := range []string{"splunk-team", "newrelic", "newrelic-", "newrelic-Team", "newrelic-team,newrelic-team"} {
+		_, err := ParseInstances(value, types)
+		assert.Error(t, err, value)
+	}
+}
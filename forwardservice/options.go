@@ -0,0 +1,58 @@
+package forwardservice
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/matcher"
+)
+
+// ForwarderOptions are the settings shared by all forwarders, namespaced by the forwarder name
+type ForwarderOptions struct {
+	MinLevel      *string
+	FilterInclude *matcher.List
+	FilterExclude *matcher.List
+	Redact        *bool
+	RateLimit     *float64
+	RateBurst     *int
+}
+
+// SetupForwarderOptions registers the shared settings of the named forwarder, e.g. `stdout-min-level` (LS_STDOUT_MIN_LEVEL)
+func SetupForwarderOptions(app *kingpin.Application, name string) ForwarderOptions {
+	var opts ForwarderOptions
+	opts.MinLevel = app.
+		Flag(name+"-min-level", fmt.Sprintf("The minimum level of logs sent to the %s forwarder", name)).
+		Envar(EnvarName(name, "MIN_LEVEL")).
+		Default("trace").Enum(logservice.LevelNames...)
+	opts.FilterInclude = new(matcher.List)
+	app.
+		Flag(name+"-filter-include", fmt.Sprintf("The semicolon separated rules of logs to keep for the %s forwarder", name)).
+		Envar(EnvarName(name, "FILTER_INCLUDE")).
+		Default("").SetValue(opts.FilterInclude)
+	opts.FilterExclude = new(matcher.List)
+	app.
+		Flag(name+"-filter-exclude", fmt.Sprintf("The semicolon separated rules of logs to drop for the %s forwarder", name)).
+		Envar(EnvarName(name, "FILTER_EXCLUDE")).
+		Default("").SetValue(opts.FilterExclude)
+	opts.Redact = app.
+		Flag(name+"-redact", fmt.Sprintf("Redact the sensitive data of logs sent to the %s forwarder; disable it for trusted destinations", name)).
+		Envar(EnvarName(name, "REDACT")).
+		Default("true").Bool()
+	opts.RateLimit = app.
+		Flag(name+"-rate-limit", fmt.Sprintf("The maximum logs per second sent to the %s forwarder, 0 is unlimited", name)).
+		Envar(EnvarName(name, "RATE_LIMIT")).
+		Default("0").Float64()
+	opts.RateBurst = app.
+		Flag(name+"-rate-burst", fmt.Sprintf("The maximum burst of logs sent to the %s forwarder when rate limit is set", name)).
+		Envar(EnvarName(name, "RATE_BURST")).
+		Default("1000").Int()
+	return opts
+}
+
+// EnvarName returns the environment variable of the setting of the named forwarder, e.g. LS_NEWRELIC_TEAM_LICENSE_KEY
+func EnvarName(name, suffix string) string {
+	return "LS_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_" + suffix
+}
@@ -0,0 +1,32 @@
+package forwardservice
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket_Allow(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 3, now)
+
+	// burst
+	for i := 0; i < 3; i++ {
+		assert.True(t, b.allow(now))
+	}
+	assert.False(t, b.allow(now))
+
+	// refill 2 tokens per second
+	now = now.Add(time.Second)
+	assert.True(t, b.allow(now))
+	assert.True(t, b.allow(now))
+	assert.False(t, b.allow(now))
+
+	// never exceed the capacity
+	now = now.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		assert.True(t, b.allow(now))
+	}
+	assert.False(t, b.allow(now))
+}
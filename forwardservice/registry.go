@@ -0,0 +1,85 @@
+package forwardservice
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Factory creates the named instance of a type of forwarder, which is the default instance if the name is empty
+type Factory func(instance string) ForwarderV2
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register adds the type of forwarder, which is called by the init() of its package. A custom binary adds its own
+// forwarders by importing their packages. It panics if the type is registered twice.
+func Register(forwarderType string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if forwarderType == "" || strings.Contains(forwarderType, "-") {
+		panic(fmt.Sprintf("forwardservice: invalid forwarder type %q", forwarderType))
+	}
+	if factory == nil {
+		panic("forwardservice: nil factory of forwarder " + forwarderType)
+	}
+	if _, ok := factories[forwarderType]; ok {
+		panic("forwardservice: forwarder " + forwarderType + " is registered twice")
+	}
+	factories[forwarderType] = factory
+}
+
+// Types returns the sorted types of the registered forwarders
+func Types() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	return sortedTypes()
+}
+
+// Build creates the default instances of the types of forwarders, where `*` is all the registered types, and then the
+// named instances
+func Build(types []string, instances []Instance) ([]ForwarderV2, error) {
+	for _, t := range types {
+		if t == AllForwarders {
+			types = Types()
+			break
+		}
+	}
+
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	var forwarders []ForwarderV2
+	built := make(map[string]bool)
+	for _, t := range types {
+		factory, ok := factories[t]
+		if !ok {
+			return nil, fmt.Errorf("forwardservice: unknown forwarder %q, expect one of %s", t, strings.Join(sortedTypes(), ", "))
+		}
+		if built[t] {
+			return nil, fmt.Errorf("forwardservice: duplicated forwarder %q", t)
+		}
+		built[t] = true
+		forwarders = append(forwarders, factory(""))
+	}
+	for _, i := range instances {
+		factory, ok := factories[i.Type]
+		if !ok {
+			return nil, fmt.Errorf("forwardservice: unknown forwarder type of instance %q", i.String())
+		}
+		forwarders = append(forwarders, factory(i.Name))
+	}
+	return forwarders, nil
+}
+
+// sortedTypes is Types without the lock, which is held by the caller
+func sortedTypes() []string {
+	types := make([]string, 0, len(factories))
+	for t := range factories {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
@@ -0,0 +1,46 @@
+package forwardservice
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	factory := func(forwarderType string) Factory {
+		return func(instance string) ForwarderV2 {
+			return Adapt(namedForwarder{name: InstanceName(forwarderType, instance)})
+		}
+	}
+	Register("testa", factory("testa"))
+	Register("testb", factory("testb"))
+	defer func() {
+		factoriesMu.Lock()
+		defer factoriesMu.Unlock()
+		delete(factories, "testa")
+		delete(factories, "testb")
+	}()
+
+	assert.Panics(t, func() { Register("testa", factory("testa")) })
+	assert.Panics(t, func() { Register("test-c", factory("test-c")) })
+	assert.Panics(t, func() { Register("testc", nil) })
+	assert.Subset(t, Types(), []string{"testa", "testb"})
+
+	instances, err := ParseInstances("testa-team", Types())
+	require.NoError(t, err)
+	forwarders, err := Build([]string{"testb"}, instances)
+	require.NoError(t, err)
+	require.Len(t, forwarders, 2)
+	assert.Equal(t, "testb", forwarders[0].Name())
+	assert.Equal(t, "testa-team", forwarders[1].Name())
+
+	forwarders, err = Build([]string{AllForwarders}, nil)
+	require.NoError(t, err)
+	assert.Len(t, forwarders, len(Types()))
+
+	_, err = Build([]string{"testc"}, nil)
+	assert.Error(t, err)
+	_, err = Build([]string{"testa", "testa"}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,155 @@
+package forwardservice
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/matcher"
+	"github.com/david7482/lambda-extension-log-shipper/utils"
+)
+
+// AllForwarders routes logs to all the enabled forwarders
+const AllForwarders = "*"
+
+// Route sends the logs matching its matcher to its forwarders. If Stop is set, the following routes are not evaluated.
+type Route struct {
+	Matcher    *matcher.Matcher
+	Forwarders []string
+	Stop       bool
+}
+
+// Routes is the semicolon separated routing table, e.g.
+//
+//	type=platform.report -> newrelic; level>=error -> newrelic,stdout stop; field.audit=true -> *
+//
+// It implements kingpin.Value so that it could be used as a flag.
+type Routes []Route
+
+func (r *Routes) Set(value string) error {
+	var routes Routes
+	for _, rule := range strings.Split(value, ";") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		parts := strings.SplitN(rule, "->", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("forwardservice: invalid route %q, expect <rule> -> <forwarders>", rule)
+		}
+		m, err := matcher.Parse(parts[0])
+		if err != nil {
+			return err
+		}
+
+		route := Route{Matcher: m}
+		targets := strings.TrimSpace(parts[1])
+		if strings.HasSuffix(targets, " stop") || targets == "stop" {
+			route.Stop = true
+			targets = strings.TrimSuffix(targets, "stop")
+		}
+		route.Forwarders = utils.SplitList(targets)
+		if len(route.Forwarders) == 0 {
+			return fmt.Errorf("forwardservice: invalid route %q, no forwarder", rule)
+		}
+		routes = append(routes, route)
+	}
+	*r = routes
+	return nil
+}
+
+func (r *Routes) String() string {
+	var rules []string
+	for _, route := range *r {
+		rule := route.Matcher.String() + " -> " + strings.Join(route.Forwarders, ",")
+		if route.Stop {
+			rule += " stop"
+		}
+		rules = append(rules, rule)
+	}
+	return strings.Join(rules, "; ")
+}
+
+// ListSeparator returns the separator of the items in the config file
+func (r *Routes) ListSeparator() string {
+	return "; "
+}
+
+// ValidateRoutes checks that the forwarders of all routes exist
+func ValidateRoutes(routes Routes, defaults []string, forwarders []ForwarderV2) error {
+	names := map[string]bool{AllForwarders: true}
+	for _, f := range forwarders {
+		names[f.Name()] = true
+	}
+	for _, route := range routes {
+		for _, name := range route.Forwarders {
+			if !names[name] {
+				return fmt.Errorf("forwardservice: unknown forwarder %q in route %q", name, route.Matcher)
+			}
+		}
+	}
+	for _, name := range defaults {
+		if !names[name] {
+			return fmt.Errorf("forwardservice: unknown forwarder %q in default route", name)
+		}
+	}
+	return nil
+}
+
+// router evaluates the routes of each log
+type router struct {
+	routes   Routes
+	defaults []string
+}
+
+// route returns the indexes of the logs which should be sent to each forwarder.
+// It returns nil if there is no route, i.e. all logs are sent to all forwarders.
+func (r *router) route(logs []logservice.Log, forwarders []*forwarder) [][]int {
+	if len(r.routes) == 0 {
+		return nil
+	}
+
+	index := make(map[string]int, len(forwarders))
+	for i, f := range forwarders {
+		index[f.Name()] = i
+	}
+	routed := make([][]int, len(forwarders))
+	add := func(i int, targets []string) {
+		for _, name := range targets {
+			if name == AllForwarders {
+				for j := range forwarders {
+					routed[j] = appendOnce(routed[j], i)
+				}
+				continue
+			}
+			if j, ok := index[name]; ok {
+				routed[j] = appendOnce(routed[j], i)
+			}
+		}
+	}
+
+	for i, log := range logs {
+		matched := false
+		for _, route := range r.routes {
+			if !route.Matcher.Match(log) {
+				continue
+			}
+			matched = true
+			add(i, route.Forwarders)
+			if route.Stop {
+				break
+			}
+		}
+		if !matched {
+			add(i, r.defaults)
+		}
+	}
+	return routed
+}
+
+// appendOnce appends the log index unless it is the last one, since indexes are appended in order
+func appendOnce(indexes []int, i int) []int {
+	if n := len(indexes); n > 0 && indexes[n-1] == i {
+		return indexes
+	}
+	return append(indexes, i)
+}
@@ -0,0 +1,83 @@
+package forwardservice
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+)
+
+type namedForwarder struct {
+	name string
+}
+
+func (f namedForwarder) Name() string                        { return f.name }
+func (f namedForwarder) SetupConfigs(_ *kingpin.Application) {}
+func (f namedForwarder) Init(_ ForwarderParams)              {}
+func (f namedForwarder) IsEnable() bool                      { return true }
+func (f namedForwarder) SendLog(_ []logservice.Log)          {}
+func (f namedForwarder) Shutdown()                           {}
+
+func TestRouter_Route(t *testing.T) {
+	forwarders := []*forwarder{
+		newForwarder(Adapt(namedForwarder{name: "stdout"}), ForwarderOptions{}),
+		newForwarder(Adapt(namedForwarder{name: "newrelic"}), ForwarderOptions{}),
+		newForwarder(Adapt(namedForwarder{name: "audit"}), ForwarderOptions{}),
+	}
+	logs := []logservice.Log{
+		{Type: logservice.PlatformReport},
+		{Type: logservice.Function, Level: logservice.ErrorLevel},
+		{Type: logservice.Function, Level: logservice.ErrorLevel, Fields: map[string]interface{}{"audit": true}},
+		{Type: logservice.Function, Level: logservice.InfoLevel},
+	}
+	tests := []struct {
+		name     string
+		routes   string
+		defaults []string
+		want     [][]int
+	}{
+		{
+			name: "No routes",
+			want: nil,
+		},
+		{
+			name:     "Routes with default",
+			routes:   "type=platform.report -> newrelic; level>=error -> stdout,newrelic; field.audit=true -> audit",
+			defaults: []string{"stdout"},
+			want:     [][]int{{1, 2, 3}, {0, 1, 2}, {2}},
+		},
+		{
+			name:     "Stop",
+			routes:   "level>=error -> stdout stop; field.audit=true -> audit",
+			defaults: []string{"*"},
+			want:     [][]int{{0, 1, 2, 3}, {0, 3}, {0, 3}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var routes Routes
+			require.NoError(t, routes.Set(tt.routes))
+			r := router{routes: routes, defaults: tt.defaults}
+			assert.Equal(t, tt.want, r.route(logs, forwarders))
+		})
+	}
+}
+
+func TestRoutes_Set(t *testing.T) {
+	var routes Routes
+	require.NoError(t, routes.Set("type=platform.report -> newrelic; level>=error -> stdout, newrelic stop"))
+	assert.Equal(t, "type=platform.report -> newrelic; level>=error -> stdout,newrelic stop", routes.String())
+
+	for _, value := range []string{"type=function", "type=function ->", "foo=bar -> stdout"} {
+		assert.Error(t, routes.Set(value), value)
+	}
+
+	forwarders := []ForwarderV2{Adapt(namedForwarder{name: "stdout"}), Adapt(namedForwarder{name: "newrelic"})}
+	assert.NoError(t, ValidateRoutes(routes, []string{"*"}, forwarders))
+	require.NoError(t, routes.Set("type=function -> splunk"))
+	assert.Error(t, ValidateRoutes(routes, nil, forwarders))
+	assert.Error(t, ValidateRoutes(nil, []string{"splunk"}, forwarders))
+}
@@ -0,0 +1,126 @@
+package forwardservice
+
+import (
+	"context"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+)
+
+// ForwarderV2 is the interface of forwarders which report failures, honor the deadline of the context and flush their
+// buffered logs on demand. The forward service works with ForwarderV2, and a Forwarder is adapted by Adapt.
+type ForwarderV2 interface {
+	Name() string
+	SetupConfigs(app *kingpin.Application)
+	// Init returns an error if the enabled forwarder could not work, e.g. its configs are invalid, which fails the
+	// extension at startup
+	Init(params ForwarderParams) error
+	IsEnable() bool
+	// Send sends the batch, or buffers it until Flush. It should only return an error if the batch could be sent
+	// later, e.g. network errors, throttling or server errors, so that the batch is spilled to disk and sent again
+	// when the destination recovers.
+	Send(ctx context.Context, logs []logservice.Log) error
+	// Flush sends the buffered logs
+	Flush(ctx context.Context) error
+	// Shutdown releases the resources of the forwarder after the last Flush
+	Shutdown(ctx context.Context) error
+}
+
+// BatchLimits are the limits of a batch sent to a forwarder, where 0 is unlimited
+type BatchLimits struct {
+	MaxLogs int
+	// MaxBytes is the maximum size of the contents of the logs. A log larger than it is sent alone.
+	MaxBytes int
+}
+
+// BatchLimiter is implemented by forwarders whose destination limits the size of a request. The logs are split into
+// batches within the limits before they are sent.
+type BatchLimiter interface {
+	BatchLimits() BatchLimits
+}
+
+// HealthChecker is implemented by forwarders which could check whether their destination is reachable. It is called
+// when the forward service starts, and a failure is only logged.
+type HealthChecker interface {
+	HealthCheck(ctx context.Context) error
+}
+
+// Adapt returns the ForwarderV2 of the Forwarder. A Forwarder does not report its failures, so its undelivered logs are
+// not spilled. The BatchLimiter and HealthChecker of the Forwarder are kept.
+func Adapt(f Forwarder) ForwarderV2 {
+	return &adapter{Forwarder: f}
+}
+
+type adapter struct {
+	Forwarder
+}
+
+func (a *adapter) Init(params ForwarderParams) error {
+	a.Forwarder.Init(params)
+	return nil
+}
+
+func (a *adapter) Send(ctx context.Context, logs []logservice.Log) error {
+	// The forwarder could not be cancelled, so the batch is not started after the deadline
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.SendLog(logs)
+	return nil
+}
+
+// BatchLimits returns the limits of the Forwarder if it is a BatchLimiter, otherwise a batch is unlimited
+func (a *adapter) BatchLimits() BatchLimits {
+	if limiter, ok := a.Forwarder.(BatchLimiter); ok {
+		return limiter.BatchLimits()
+	}
+	return BatchLimits{}
+}
+
+// HealthCheck checks the destination of the Forwarder if it is a HealthChecker, otherwise it passes
+func (a *adapter) HealthCheck(ctx context.Context) error {
+	if checker, ok := a.Forwarder.(HealthChecker); ok {
+		return checker.HealthCheck(ctx)
+	}
+	return nil
+}
+
+func (a *adapter) Flush(_ context.Context) error {
+	return nil
+}
+
+func (a *adapter) Shutdown(_ context.Context) error {
+	a.Forwarder.Shutdown()
+	return nil
+}
+
+// reportsFailures tells whether Send returns an error when the logs are not delivered
+func reportsFailures(f ForwarderV2) bool {
+	_, adapted := f.(*adapter)
+	return !adapted
+}
+
+// batches splits the logs into the batches within the limits
+func batches(logs []logservice.Log, limits BatchLimits) [][]logservice.Log {
+	if limits.MaxLogs <= 0 && limits.MaxBytes <= 0 {
+		return [][]logservice.Log{logs}
+	}
+	var result [][]logservice.Log
+	for len(logs) > 0 {
+		n, size := 0, 0
+		for n < len(logs) {
+			if limits.MaxLogs > 0 && n >= limits.MaxLogs {
+				break
+			}
+			if limits.MaxBytes > 0 && n > 0 && size+len(logs[n].Content) > limits.MaxBytes {
+				break
+			}
+			size += len(logs[n].Content)
+			n++
+		}
+		result = append(result, logs[:n])
+		logs = logs[n:]
+	}
+	return result
+}
@@ -0,0 +1,158 @@
+package forwardservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/david7482/lambda-extension-log-shipper/extension"
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/metrics"
+)
+
+// bufferedForwarder is a ForwarderV2 which buffers the batches until they are flushed
+type bufferedForwarder struct {
+	namedForwarder
+	limits   BatchLimits
+	batches  [][]string
+	buffered [][]string
+	flushed  bool
+	closed   bool
+	initErr  error
+}
+
+func (f *bufferedForwarder) Init(_ ForwarderParams) error {
+	return f.initErr
+}
+
+func (f *bufferedForwarder) Send(_ context.Context, logs []logservice.Log) error {
+	var batch []string
+	for _, log := range logs {
+		batch = append(batch, log.RequestID)
+	}
+	f.buffered = append(f.buffered, batch)
+	return nil
+}
+
+func (f *bufferedForwarder) Flush(_ context.Context) error {
+	f.batches = append(f.batches, f.buffered...)
+	f.buffered = nil
+	f.flushed = true
+	return nil
+}
+
+func (f *bufferedForwarder) Shutdown(_ context.Context) error {
+	f.closed = true
+	return nil
+}
+
+func (f *bufferedForwarder) BatchLimits() BatchLimits {
+	return f.limits
+}
+
+func (f *bufferedForwarder) HealthCheck(_ context.Context) error {
+	return errors.New("unreachable")
+}
+
+func TestForwarder_sendV2(t *testing.T) {
+	logger := zerolog.Nop()
+	buffered := &bufferedForwarder{namedForwarder: namedForwarder{name: "buffered"}, limits: BatchLimits{MaxLogs: 2}}
+	f := newForwarder(buffered, ForwarderOptions{})
+	f.instrument(metrics.New())
+	f.healthCheck(context.Background(), &logger)
+
+	f.send(context.Background(), []logservice.Log{{RequestID: "1"}, {RequestID: "2"}, {RequestID: "3"}}, &logger)
+	assert.Empty(t, buffered.batches)
+	f.shutdown(context.Background(), &logger)
+	assert.True(t, buffered.flushed)
+	assert.True(t, buffered.closed)
+	assert.Equal(t, [][]string{{"1", "2"}, {"3"}}, buffered.batches)
+}
+
+func TestNew_initError(t *testing.T) {
+	_, err := New(ServiceParams{
+		Forwarders: []ForwarderV2{
+			Adapt(namedForwarder{name: "stdout"}),
+			&bufferedForwarder{namedForwarder: namedForwarder{name: "buffered"}, initErr: errors.New("missing url")},
+		},
+		Metrics: metrics.New(),
+	})
+	require.Error(t, err)
+	assert.Equal(t, extension.ForwarderInitFailed, extension.TypeOf(err))
+	assert.Contains(t, err.Error(), "buffered")
+}
+
+func TestAdapt(t *testing.T) {
+	stdout := &sentForwarder{namedForwarder: namedForwarder{name: "stdout"}}
+	f := Adapt(stdout)
+	assert.Equal(t, "stdout", f.Name())
+	assert.False(t, reportsFailures(f))
+	assert.True(t, reportsFailures(&flakyForwarder{namedForwarder: namedForwarder{name: "flaky"}}))
+
+	require.NoError(t, f.Send(context.Background(), []logservice.Log{{RequestID: "1"}}))
+
+	// The batch is not started after the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, f.Send(ctx, []logservice.Log{{RequestID: "2"}}))
+	assert.Equal(t, []string{"1"}, stdout.sent)
+	assert.NoError(t, f.Flush(context.Background()))
+	assert.NoError(t, f.Shutdown(context.Background()))
+}
+
+// sentForwarder is a Forwarder which keeps the request ids of the sent logs
+type sentForwarder struct {
+	namedForwarder
+	sent []string
+}
+
+func (f *sentForwarder) SendLog(logs []logservice.Log) {
+	for _, log := range logs {
+		f.sent = append(f.sent, log.RequestID)
+	}
+}
+
+// limitedForwarder is a Forwarder whose destination limits the batches
+type limitedForwarder struct {
+	namedForwarder
+}
+
+func (f limitedForwarder) BatchLimits() BatchLimits {
+	return BatchLimits{MaxBytes: 10}
+}
+
+func (f limitedForwarder) HealthCheck(_ context.Context) error {
+	return errors.New("unreachable")
+}
+
+func TestAdapt_capabilities(t *testing.T) {
+	f := Adapt(limitedForwarder{namedForwarder: namedForwarder{name: "limited"}})
+	limiter, ok := f.(BatchLimiter)
+	require.True(t, ok)
+	assert.Equal(t, BatchLimits{MaxBytes: 10}, limiter.BatchLimits())
+	checker, ok := f.(HealthChecker)
+	require.True(t, ok)
+	assert.Error(t, checker.HealthCheck(context.Background()))
+
+	f = Adapt(namedForwarder{name: "stdout"})
+	assert.Equal(t, BatchLimits{}, f.(BatchLimiter).BatchLimits())
+	assert.NoError(t, f.(HealthChecker).HealthCheck(context.Background()))
+}
+
+func TestBatches(t *testing.T) {
+	logs := []logservice.Log{
+		{Content: []byte("aaaa")},
+		{Content: []byte("bb")},
+		{Content: []byte("cccccccc")},
+		{Content: []byte("d")},
+	}
+	assert.Equal(t, [][]logservice.Log{logs}, batches(logs, BatchLimits{}))
+	assert.Equal(t, [][]logservice.Log{logs[:3], logs[3:]}, batches(logs, BatchLimits{MaxLogs: 3}))
+	// A log larger than the max bytes is sent alone
+	assert.Equal(t, [][]logservice.Log{logs[:2], logs[2:3], logs[3:]}, batches(logs, BatchLimits{MaxBytes: 6}))
+	assert.Empty(t, batches(nil, BatchLimits{MaxLogs: 1}))
+}
@@ -15,4 +15,5 @@ require (
 	github.com/stretchr/testify v1.6.1
 	github.com/wallix/awless v0.1.11 // indirect
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v3 v3.0.0-20200615113413-eeeca48fe776
 )
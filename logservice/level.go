@@ -0,0 +1,97 @@
+package logservice
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Level is the severity of a log
+type Level int8
+
+const (
+	TraceLevel Level = iota
+	DebugLevel
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+	FatalLevel
+)
+
+// LevelNames are the names of all levels in ascending order, which could be used as config enum
+var LevelNames = []string{"trace", "debug", "info", "warn", "error", "fatal"}
+
+// levelFieldKeys are the structured fields which might hold the level of a log
+var levelFieldKeys = []string{FieldLevel, "severity", "lvl", "log.level", "levelname"}
+
+var (
+	// levelPrefixRegexp matches the level written by runtimes or loggers, e.g. `[ERROR]`, `\tWARN\t` or `ERROR: `.
+	// The bare word is only matched in upper case, so that a sentence like "Error loading user" is not a level.
+	levelPrefixRegexp = regexp.MustCompile(`(?i:^\[(TRACE|DEBUG|INFO|WARN|WARNING|ERROR|FATAL|CRITICAL)\]|\t(TRACE|DEBUG|INFO|WARN|WARNING|ERROR|FATAL|CRITICAL)\t)|^(TRACE|DEBUG|INFO|WARN|WARNING|ERROR|FATAL|CRITICAL)[:\s]`)
+)
+
+func (l Level) String() string {
+	if l < TraceLevel || l > FatalLevel {
+		return ""
+	}
+	return LevelNames[l]
+}
+
+// ParseLevel converts a level name into Level. Common aliases like "warning", "err" or "critical" are accepted.
+func ParseLevel(value string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "trace":
+		return TraceLevel, nil
+	case "debug":
+		return DebugLevel, nil
+	case "info", "information", "notice":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error", "err":
+		return ErrorLevel, nil
+	case "fatal", "critical", "crit", "panic", "emerg", "alert":
+		return FatalLevel, nil
+	}
+	return InfoLevel, fmt.Errorf("logservice: unknown level: %s", value)
+}
+
+// detectLevel finds the level of a log from its structured fields, its runtime prefix or its type.
+// Logs without any level are regarded as info.
+func detectLevel(log Log) Level {
+	switch log.Type {
+	case PlatformFault:
+		return ErrorLevel
+	case PlatformLogsDropped:
+		return WarnLevel
+	case Function:
+		if lvl, ok := levelFromFields(log.Fields); ok {
+			return lvl
+		}
+		if m := levelPrefixRegexp.FindStringSubmatch(log.Line()); m != nil {
+			for _, name := range m[1:] {
+				if lvl, err := ParseLevel(name); name != "" && err == nil {
+					return lvl
+				}
+			}
+		}
+	}
+	return InfoLevel
+}
+
+func levelFromFields(fields map[string]interface{}) (Level, bool) {
+	for _, key := range levelFieldKeys {
+		switch v := fields[key].(type) {
+		case string:
+			if lvl, err := ParseLevel(v); err == nil {
+				return lvl, true
+			}
+		case float64:
+			// numeric levels of pino and bunyan: 10 trace, 20 debug, 30 info, 40 warn, 50 error, 60 fatal
+			if v >= 10 && v <= 60 {
+				return Level(int(v)/10 - 1), true
+			}
+		}
+	}
+	return InfoLevel, false
+}
@@ -0,0 +1,71 @@
+package logservice
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectLevel(t *testing.T) {
+	tests := []struct {
+		name string
+		log  Log
+		want Level
+	}{
+		{
+			name: "Structured level",
+			log:  Log{Type: Function, Content: []byte(`"{\"severity\":\"WARNING\"}"`), Fields: map[string]interface{}{"severity": "WARNING"}},
+			want: WarnLevel,
+		},
+		{
+			name: "Numeric level",
+			log:  Log{Type: Function, Content: []byte(`"{\"level\":50}"`), Fields: map[string]interface{}{"level": float64(50)}},
+			want: ErrorLevel,
+		},
+		{
+			name: "Python prefix",
+			log:  Log{Type: Function, Content: []byte(`"[ERROR]\t2020-08-20T12:31:32.123Z\t6f7f0961-f834-4211-8a7a-f6fe80b88d56\tboom\n"`)},
+			want: ErrorLevel,
+		},
+		{
+			name: "Node prefix",
+			log:  Log{Type: Function, Content: []byte(`"2020-08-20T12:31:32.123Z\t6f7f0961-f834-4211-8a7a-f6fe80b88d56\tWARN\tcareful\n"`)},
+			want: WarnLevel,
+		},
+		{
+			name: "Upper case word prefix",
+			log:  Log{Type: Function, Content: []byte(`"ERROR: connection refused"`)},
+			want: ErrorLevel,
+		},
+		{
+			name: "Lower case bracket prefix",
+			log:  Log{Type: Function, Content: []byte(`"[warn] disk almost full"`)},
+			want: WarnLevel,
+		},
+		{
+			name: "Sentence starting with a level word",
+			log:  Log{Type: Function, Content: []byte(`"Error loading user 42 from cache, retrying"`)},
+			want: InfoLevel,
+		},
+		{
+			name: "Sentence starting with debug",
+			log:  Log{Type: Function, Content: []byte(`"Debug mode enabled"`)},
+			want: InfoLevel,
+		},
+		{
+			name: "Plain text",
+			log:  Log{Type: Function, Content: []byte(`"hello world"`)},
+			want: InfoLevel,
+		},
+		{
+			name: "Platform fault",
+			log:  Log{Type: PlatformFault, Content: []byte(`"RequestId: 6f7f0961 Process exited before completing request"`)},
+			want: ErrorLevel,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, detectLevel(tt.log))
+		})
+	}
+}
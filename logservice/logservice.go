@@ -12,7 +12,9 @@ import (
 
 	"github.com/rs/zerolog"
 
+	"github.com/david7482/lambda-extension-log-shipper/emf"
 	"github.com/david7482/lambda-extension-log-shipper/extension"
+	"github.com/david7482/lambda-extension-log-shipper/metrics"
 )
 
 //go:generate mockgen -destination=automocks/logapiclient.go -package=automocks . LogAPIClient
@@ -27,14 +29,30 @@ const (
 	PlatformReport      LogType = "platform.report"
 	PlatformFault       LogType = "platform.fault"
 	PlatformLogsDropped LogType = "platform.logsDropped"
+	PlatformRuntimeDone LogType = "platform.runtimeDone"
 	Function            LogType = "function"
+	// Metric is a synthetic log of the metrics derived from function logs, whose content is a MetricRecord
+	Metric LogType = "metric"
 )
 
+// defaultShutdownTimeout is the time to wait for the requests in flight when the service is not shutdown explicitly
+const defaultShutdownTimeout = 1 * time.Second
+
 type Log struct {
-	Time      time.Time
-	Type      LogType `faker:"oneof: platform.start, platform.report, platform.fault, platform.logsDropped, function"`
-	RequestID string
-	Content   []byte
+	Time        time.Time
+	Type        LogType `faker:"oneof: platform.start, platform.report, platform.fault, platform.logsDropped, function"`
+	RequestID   string
+	Content     []byte
+	FunctionArn string
+	Tracing     extension.Tracing
+	// Fields are the structured fields parsed from a function log, nil if the log is plain text
+	Fields map[string]interface{}
+	Level  Level
+	// SampleRate is the probability of this log being kept by sampling, 0 if it is not sampled
+	SampleRate float64
+	// Metadata is the Lambda environment metadata attached by the enrich processor. It might be shared by
+	// many logs, so it must not be modified.
+	Metadata map[string]interface{}
 }
 
 type Message struct {
@@ -47,11 +65,31 @@ type StartRecord struct {
 	RequestID string `json:"requestId"`
 }
 
+type RuntimeDoneRecord struct {
+	RequestID string `json:"requestId"`
+	Status    string `json:"status"`
+}
+
 type ReportRecord struct {
 	RequestID string          `json:"requestId"`
 	Metrics   json.RawMessage `json:"metrics"`
 }
 
+// MetricRecord is a metric of an invocation aggregated from its function logs. A counter has the value, and a
+// histogram has the statistics and the distinct values with their counts.
+type MetricRecord struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value,omitempty"`
+	Count  uint64            `json:"count,omitempty"`
+	Sum    float64           `json:"sum,omitempty"`
+	Min    float64           `json:"min,omitempty"`
+	Max    float64           `json:"max,omitempty"`
+	Values []float64         `json:"values,omitempty"`
+	Counts []float64         `json:"counts,omitempty"`
+}
+
 type ServiceParams struct {
 	LogAPIClient         LogAPIClient
 	LogTypes             []extension.LogType
@@ -61,6 +99,10 @@ type ServiceParams struct {
 	MaxBytes             int
 	TimeoutMS            int
 	EnablePlatformReport bool
+	ParseFormats         []ParseFormat
+	MinLevel             Level
+	Multiline            *Multiline
+	Metrics              *metrics.Registry
 }
 
 type LogService struct {
@@ -72,9 +114,42 @@ type LogService struct {
 	maxBytes             int
 	timeoutMS            int
 	enablePlatformReport bool
+	parseFormats         []ParseFormat
+	minLevel             Level
+	multiline            *Multiline
+
+	requests *requestTracker
+	metrics  serviceMetrics
+
+	server       *http.Server
+	shutdownOnce sync.Once
+	// stopping is closed when the shutdown starts, and draining is closed once no more request is waited
+	stopping chan struct{}
+	draining chan struct{}
+	// closed is closed once the logs queue is closed
+	closed chan struct{}
+	// errs receives the error of serving the logs
+	errs chan error
+	// queueClosed is set under the write lock of queueMu, so the requests still in flight drop their logs
+	queueMu     sync.RWMutex
+	queueClosed bool
+}
+
+type serviceMetrics struct {
+	batches     *metrics.Counter
+	records     *metrics.Counter
+	bytes       *metrics.Counter
+	parseErrors *metrics.Counter
+	ignored     *metrics.Counter
+	dropped     *metrics.Counter
+	// shutdownDropped are the logs received after the logs queue is closed
+	shutdownDropped *metrics.Counter
 }
 
 func New(params ServiceParams) *LogService {
+	params.Metrics.Gauge(metrics.QueueDepth, emf.Count, metrics.Labels{"Queue": "logs"}, func() float64 {
+		return float64(len(params.LogsQueue))
+	})
 	return &LogService{
 		logAPIClient:         params.LogAPIClient,
 		logTypes:             params.LogTypes,
@@ -84,10 +159,38 @@ func New(params ServiceParams) *LogService {
 		maxBytes:             params.MaxBytes,
 		timeoutMS:            params.TimeoutMS,
 		enablePlatformReport: params.EnablePlatformReport,
+		parseFormats:         params.ParseFormats,
+		minLevel:             params.MinLevel,
+		multiline:            params.Multiline,
+		requests:             newRequestTracker(),
+		stopping:             make(chan struct{}),
+		draining:             make(chan struct{}),
+		closed:               make(chan struct{}),
+		errs:                 make(chan error, 1),
+		metrics: serviceMetrics{
+			batches:         params.Metrics.Counter(metrics.LogBatches, emf.Count, nil),
+			records:         params.Metrics.Counter(metrics.LogRecords, emf.Count, nil),
+			bytes:           params.Metrics.Counter(metrics.LogBytes, emf.Bytes, nil),
+			parseErrors:     params.Metrics.Counter(metrics.ParseErrors, emf.Count, nil),
+			ignored:         params.Metrics.Counter(metrics.IgnoredRecords, emf.Count, nil),
+			dropped:         params.Metrics.Counter(metrics.DroppedLogs, emf.Count, metrics.Labels{"Stage": "minLevel"}),
+			shutdownDropped: params.Metrics.Counter(metrics.DroppedLogs, emf.Count, metrics.Labels{"Stage": "shutdown"}),
+		},
+	}
+}
+
+// AddInvocation records the invoke event so that logs of this invocation could be linked with its request id,
+// function arn and tracing
+func (s *LogService) AddInvocation(event extension.NextEventResponse) {
+	if event.EventType != extension.Invoke || event.RequestID == "" {
+		return
 	}
+	s.requests.invoke(event)
 }
 
-func (s *LogService) Run(ctx context.Context, wg *sync.WaitGroup) {
+// Run starts the log service and subscribes to the Logs API. It returns the error of listening or subscribing, which is
+// typed to be reported to the Extensions API. The error of serving the logs afterwards is sent to Err.
+func (s *LogService) Run(ctx context.Context, wg *sync.WaitGroup) error {
 	router := http.NewServeMux()
 	router.HandleFunc("/", s.logHandler)
 
@@ -98,19 +201,42 @@ func (s *LogService) Run(ctx context.Context, wg *sync.WaitGroup) {
 			return ctx
 		},
 	}
+	s.server = server
 
-	go func() {
-		// Wait for ctx done
-		<-ctx.Done()
+	// Listen before the subscription, so that the Logs API could reach the log service
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		wg.Done()
+		return extension.NewError(extension.ListenFailed, err)
+	}
 
-		// Give 3 second to shutdown server
-		ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
-		defer cancel()
-		server.SetKeepAlivesEnabled(false)
-		_ = server.Shutdown(ctx)
+	// Flush the pending multiline logs which have no more continuation lines
+	go func() {
+		if s.multiline == nil {
+			return
+		}
+		ticker := time.NewTicker(s.multiline.flushTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stopping:
+				return
+			case now := <-ticker.C:
+				s.enqueue(s.finalize(s.multiline.flushIdle(now)))
+			}
+		}
+	}()
 
-		// Close log queue channel to notify forwarder
-		close(s.logsQueue)
+	go func() {
+		// The service is shutdown explicitly, or with the default timeout once ctx is done
+		select {
+		case <-s.closed:
+		case <-ctx.Done():
+			// ctx is already done, so the timeout of the shutdown is not derived from it
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
+			_ = s.Shutdown(shutdownCtx)
+			cancel()
+		}
 
 		// Notify when server is closed
 		zerolog.Ctx(ctx).Info().Msg("log service is closed")
@@ -119,22 +245,25 @@ func (s *LogService) Run(ctx context.Context, wg *sync.WaitGroup) {
 
 	go func() {
 		zerolog.Ctx(ctx).Info().Msgf("log service is running on http://%s", server.Addr)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			zerolog.Ctx(ctx).Fatal().Err(err).Str("Addr", server.Addr).Msg("Fail to start log service")
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			s.errs <- extension.NewError(extension.ListenFailed, err)
 		}
 	}()
 
 	// Subscribe to logs API after log service is running
 	// Logs start being delivered only after the subscription happens.
-	_, err := s.logAPIClient.SubscribeLogs(ctx, s.logTypes, extension.SubscribeLogsParams{
+	_, err = s.logAPIClient.SubscribeLogs(ctx, s.logTypes, extension.SubscribeLogsParams{
 		ListenPort: s.listenPort,
 		MaxItems:   s.maxItems,
 		MaxBytes:   s.maxBytes,
 		TimeoutMS:  s.timeoutMS,
 	})
-	if err != nil {
-		zerolog.Ctx(ctx).Fatal().Err(err).Msg("fail to subscribe log API")
-	}
+	return extension.NewError(extension.SubscribeFailed, err)
+}
+
+// Err returns the channel of the error which stops the log service after it is started
+func (s *LogService) Err() <-chan error {
+	return s.errs
 }
 
 func (s *LogService) logHandler(w http.ResponseWriter, r *http.Request) {
@@ -146,58 +275,187 @@ func (s *LogService) logHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if err := s.Ingest(ctx, body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// Ingest parses a batch of the Logs API and writes the logs into the logs queue, the same as the batch is received by
+// the log service. It is used to replay the captured batches without the Logs API.
+func (s *LogService) Ingest(ctx context.Context, body []byte) error {
+	s.metrics.batches.Inc()
+	s.metrics.bytes.Add(uint64(len(body)))
 
 	var messages []Message
-	err = json.Unmarshal(body, &messages)
-	if err != nil {
+	if err := json.Unmarshal(body, &messages); err != nil {
+		s.metrics.parseErrors.Inc()
 		zerolog.Ctx(ctx).Error().Err(err).Msg("fail to parse the logs")
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		return err
 	}
 
+	s.metrics.records.Add(uint64(len(messages)))
+
 	var logs []Log
-	var requestID string
+	now := time.Now()
 	for _, msg := range messages {
 		switch LogType(msg.Type) {
 		case PlatformStart:
 			var startRecord StartRecord
 			if err := json.Unmarshal(msg.Record, &startRecord); err != nil {
 				zerolog.Ctx(ctx).Error().Err(err).Msg("fail to parse platform.start record")
+				s.metrics.parseErrors.Inc()
 				continue
 			}
-			requestID = startRecord.RequestID
-		case PlatformReport:
-			// Check if we need to send platform report to forwarders
-			if !s.enablePlatformReport {
+			s.requests.start(startRecord.RequestID)
+		case PlatformRuntimeDone:
+			var runtimeDoneRecord RuntimeDoneRecord
+			if err := json.Unmarshal(msg.Record, &runtimeDoneRecord); err != nil {
+				zerolog.Ctx(ctx).Error().Err(err).Msg("fail to parse platform.runtimeDone record")
+				s.metrics.parseErrors.Inc()
 				continue
 			}
+			s.requests.runtimeDone(runtimeDoneRecord.RequestID)
 
+			// The runtime is done, so the pending multiline log of the invocation is complete
+			logs = append(logs, s.flushMultiline()...)
+		case PlatformReport:
 			var reportRecord ReportRecord
 			if err := json.Unmarshal(msg.Record, &reportRecord); err != nil {
 				zerolog.Ctx(ctx).Error().Err(err).Msg("fail to parse platform.report record")
+				s.metrics.parseErrors.Inc()
 				continue
 			}
-			logs = append(logs, Log{
-				Time:      msg.Time,
-				Type:      LogType(msg.Type),
-				RequestID: reportRecord.RequestID,
-				Content:   reportRecord.Metrics,
-			})
+
+			// The report is the last log of an invocation
+			invocation := s.requests.invocation(reportRecord.RequestID)
+			s.requests.finish(reportRecord.RequestID)
+
+			// Check if we need to send platform report to forwarders
+			if !s.enablePlatformReport {
+				logs = append(logs, s.flushMultiline()...)
+				continue
+			}
+			logs = append(logs, s.aggregate(Log{
+				Time:        msg.Time,
+				Type:        LogType(msg.Type),
+				RequestID:   reportRecord.RequestID,
+				Content:     reportRecord.Metrics,
+				FunctionArn: invocation.InvokedFunctionArn,
+				Tracing:     invocation.Tracing,
+			}, now)...)
 		case Function, PlatformFault, PlatformLogsDropped:
-			logs = append(logs, Log{
-				Time:      msg.Time,
-				Type:      LogType(msg.Type),
-				RequestID: requestID,
-				Content:   msg.Record,
-			})
+			requestID := s.requests.current()
+			if LogType(msg.Type) == Function {
+				// Prefer the request id written by the runtime, which is accurate for concurrent invocations
+				if id := runtimeRequestID(msg.Record); id != "" {
+					requestID = id
+				}
+			}
+			invocation := s.requests.invocation(requestID)
+			logs = append(logs, s.aggregate(Log{
+				Time:        msg.Time,
+				Type:        LogType(msg.Type),
+				RequestID:   requestID,
+				Content:     msg.Record,
+				FunctionArn: invocation.InvokedFunctionArn,
+				Tracing:     invocation.Tracing,
+			}, now)...)
 		default:
+			// e.g. platform.end completes the pending multiline log of the invocation
+			logs = append(logs, s.flushMultiline()...)
+			s.metrics.ignored.Inc()
 			zerolog.Ctx(ctx).Debug().Str("type", msg.Type).Msg("ignored log with unsupported type")
 		}
-		zerolog.Ctx(ctx).Debug().Str("requestId", requestID).Msg(msg.Type)
+		zerolog.Ctx(ctx).Debug().Str("requestId", s.requests.current()).Msg(msg.Type)
 	}
 
 	// write logs into logsQueue in batch
-	if len(logs) > 0 {
-		s.logsQueue <- logs
+	s.enqueue(s.finalize(logs))
+	return nil
+}
+
+// Shutdown stops receiving logs and waits for the requests in flight until ctx is done, then the pending multiline
+// logs are flushed and the logs queue is closed. The Logs API flushes the logs of the last invocation after the
+// SHUTDOWN event, so they are still received until its platform.report or ctx is done. The logs of the requests still
+// in flight are dropped.
+func (s *LogService) Shutdown(ctx context.Context) error {
+	var err error
+	s.shutdownOnce.Do(func() {
+		close(s.stopping)
+		if s.server != nil {
+			select {
+			case <-s.requests.lastFinished():
+			case <-ctx.Done():
+			}
+			s.server.SetKeepAlivesEnabled(false)
+			err = s.server.Shutdown(ctx)
+		}
+		close(s.draining)
+
+		s.queueMu.Lock()
+		defer s.queueMu.Unlock()
+		// Flush the rest of multiline logs
+		if logs := s.finalize(s.flushMultiline()); len(logs) > 0 {
+			select {
+			case s.logsQueue <- logs:
+			case <-ctx.Done():
+				s.metrics.shutdownDropped.Add(uint64(len(logs)))
+			}
+		}
+		// Close log queue channel to notify the process service
+		s.queueClosed = true
+		close(s.logsQueue)
+		close(s.closed)
+	})
+	return err
+}
+
+// enqueue writes the logs into the logs queue, unless it is closed by the shutdown
+func (s *LogService) enqueue(logs []Log) {
+	if len(logs) == 0 {
+		return
+	}
+	s.queueMu.RLock()
+	defer s.queueMu.RUnlock()
+	if s.queueClosed {
+		s.metrics.shutdownDropped.Add(uint64(len(logs)))
+		return
+	}
+	select {
+	case s.logsQueue <- logs:
+	case <-s.draining:
+		s.metrics.shutdownDropped.Add(uint64(len(logs)))
+	}
+}
+
+// aggregate runs the log through multiline aggregation and returns the completed logs
+func (s *LogService) aggregate(log Log, now time.Time) []Log {
+	if s.multiline == nil {
+		return []Log{log}
+	}
+	return s.multiline.add(log, now)
+}
+
+func (s *LogService) flushMultiline() []Log {
+	if s.multiline == nil {
+		return nil
+	}
+	return s.multiline.flush()
+}
+
+// finalize parses the structured fields and level of the completed logs, and drops the logs below the minimum level
+func (s *LogService) finalize(logs []Log) []Log {
+	var finalized []Log
+	for _, log := range logs {
+		if log.Type == Function && len(s.parseFormats) > 0 {
+			log.Fields = parseLine(log.Line(), s.parseFormats)
+		}
+		log.Level = detectLevel(log)
+		if log.Level >= s.minLevel {
+			finalized = append(finalized, log)
+		} else {
+			s.metrics.dropped.Inc()
+		}
 	}
+	return finalized
 }
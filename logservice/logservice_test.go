@@ -2,18 +2,22 @@ package logservice
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/david7482/lambda-extension-log-shipper/extension"
 	"github.com/david7482/lambda-extension-log-shipper/logservice/automocks"
+	"github.com/david7482/lambda-extension-log-shipper/metrics"
 )
 
 func logAPIClient(_ *testing.T, ctrl *gomock.Controller) LogAPIClient {
@@ -77,7 +81,7 @@ func TestLogService_Run(t *testing.T) {
 			ctx, cancel := context.WithCancel(context.Background())
 
 			wg.Add(1)
-			s.Run(ctx, &wg)
+			require.NoError(t, s.Run(ctx, &wg))
 
 			time.Sleep(100 * time.Millisecond)
 			cancel()
@@ -86,6 +90,137 @@ func TestLogService_Run(t *testing.T) {
 	}
 }
 
+func TestLogService_Shutdown_lastInvocation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	logsQueue := make(chan []Log, 4)
+	s := New(ServiceParams{
+		LogAPIClient:         logAPIClient(t, ctrl),
+		LogTypes:             []extension.LogType{extension.Platform, extension.Function},
+		LogsQueue:            logsQueue,
+		ListenPort:           8084,
+		EnablePlatformReport: true,
+		Metrics:              metrics.New(),
+	})
+	wg := sync.WaitGroup{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wg.Add(1)
+	require.NoError(t, s.Run(ctx, &wg))
+	time.Sleep(100 * time.Millisecond)
+	s.AddInvocation(extension.NextEventResponse{EventType: extension.Invoke, RequestID: "1"})
+
+	// The logs of the last invocation are flushed by the Logs API after the SHUTDOWN event
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(shutdownCtx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	resp, err := http.Post("http://127.0.0.1:8084", "", strings.NewReader(`[
+		{"time": "2020-08-20T12:31:32.123Z", "type": "function", "record": "bye"},
+		{"time": "2020-08-20T12:31:32.200Z", "type": "platform.runtimeDone", "record": {"requestId": "1"}},
+		{"time": "2020-08-20T12:31:32.300Z", "type": "platform.report", "record": {"requestId": "1", "metrics": {"durationMs": 1}}}
+	]`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The shutdown stops receiving logs once the platform.report is received, before ctx is done
+	require.NoError(t, <-done)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	wg.Wait()
+	logs := <-logsQueue
+	require.Len(t, logs, 2)
+	assert.Equal(t, Function, logs[0].Type)
+	assert.Equal(t, "1", logs[0].RequestID)
+	assert.Equal(t, PlatformReport, logs[1].Type)
+	_, ok := <-logsQueue
+	assert.False(t, ok)
+}
+
+func TestLogService_Shutdown(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	logsQueue := make(chan []Log, 1)
+	registry := metrics.New()
+	s := New(ServiceParams{
+		LogAPIClient: logAPIClient(t, ctrl),
+		LogTypes:     []extension.LogType{extension.Platform, extension.Function},
+		LogsQueue:    logsQueue,
+		ListenPort:   8082,
+		MaxItems:     128,
+		MaxBytes:     128,
+		TimeoutMS:    1000,
+		Metrics:      registry,
+	})
+	wg := sync.WaitGroup{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wg.Add(1)
+	require.NoError(t, s.Run(ctx, &wg))
+	time.Sleep(100 * time.Millisecond)
+
+	// The queue is full, and the logs blocked are dropped once the shutdown stops waiting for them
+	s.enqueue([]Log{{RequestID: "1"}})
+	blocked := make(chan struct{})
+	go func() {
+		s.enqueue([]Log{{RequestID: "2"}})
+		close(blocked)
+	}()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Second)
+	defer shutdownCancel()
+	require.NoError(t, s.Shutdown(shutdownCtx))
+	<-blocked
+	wg.Wait()
+
+	// The queue is closed after the logs are drained
+	require.Equal(t, []Log{{RequestID: "1"}}, <-logsQueue)
+	_, ok := <-logsQueue
+	require.False(t, ok)
+	s.enqueue([]Log{{RequestID: "3"}})
+	require.Equal(t, uint64(2), registry.Total(metrics.DroppedLogs))
+}
+
+func TestLogService_RunErrors(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	client := automocks.NewMockLogAPIClient(ctrl)
+	client.EXPECT().SubscribeLogs(gomock.Any(), gomock.Any(), gomock.Any()).Return(extension.SubscribeResponse{}, errors.New("forbidden")).Times(1)
+	params := ServiceParams{
+		LogAPIClient: client,
+		LogTypes:     []extension.LogType{extension.Platform, extension.Function},
+		LogsQueue:    make(chan []Log, 1),
+		ListenPort:   8083,
+		MaxItems:     128,
+		MaxBytes:     128,
+		TimeoutMS:    1000,
+	}
+	wg := sync.WaitGroup{}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	wg.Add(1)
+	err := New(params).Run(ctx, &wg)
+	require.Error(t, err)
+	require.Equal(t, extension.SubscribeFailed, extension.TypeOf(err))
+
+	// The port is still taken by the first log service
+	wg.Add(1)
+	err = New(params).Run(ctx, &wg)
+	require.Error(t, err)
+	require.Equal(t, extension.ListenFailed, extension.TypeOf(err))
+
+	cancel()
+	wg.Wait()
+}
+
 func TestLogService_logHandler(t *testing.T) {
 	type args struct {
 		Params       ServiceParams
@@ -108,6 +243,8 @@ func TestLogService_logHandler(t *testing.T) {
 					MaxItems:     128,
 					MaxBytes:     128,
 					TimeoutMS:    1000,
+
+					EnablePlatformReport: true,
 				}
 
 				logs := `
@@ -169,18 +306,21 @@ func TestLogService_logHandler(t *testing.T) {
 						Type:      Function,
 						RequestID: "6f7f0961f83442118a7af6fe80b88d56",
 						Content:   []byte(`"ERROR something happened"`),
+						Level:     ErrorLevel,
 					},
 					{
 						Time:      timeMustParse("2020-08-20T12:31:32.123Z"),
 						Type:      PlatformLogsDropped,
 						RequestID: "6f7f0961f83442118a7af6fe80b88d56",
 						Content:   []byte(`{"reason": "Consumer seems to have fallen behind as it has not acknowledged receipt of logs.","droppedRecords": 123,"droppedBytes": 12345}`),
+						Level:     WarnLevel,
 					},
 					{
 						Time:      timeMustParse("2020-08-20T12:31:32.123Z"),
 						Type:      PlatformReport,
 						RequestID: "6f7f0961f83442118a7af6fe80b88d56",
 						Content:   []byte(`{"durationMs": 101.51,"billedDurationMs": 300,"memorySizeMB": 512,"maxMemoryUsedMB": 33,"initDurationMs": 116.67}`),
+						Level:     InfoLevel,
 					},
 				}
 
@@ -206,12 +346,14 @@ func TestLogService_logHandler(t *testing.T) {
 				MaxItems:     tt.args.Params.MaxItems,
 				MaxBytes:     tt.args.Params.MaxBytes,
 				TimeoutMS:    tt.args.Params.TimeoutMS,
+
+				EnablePlatformReport: tt.args.Params.EnablePlatformReport,
 			})
 			wg := sync.WaitGroup{}
 			ctx, cancel := context.WithCancel(context.Background())
 
 			wg.Add(1)
-			s.Run(ctx, &wg)
+			require.NoError(t, s.Run(ctx, &wg))
 
 			time.Sleep(100 * time.Millisecond)
 
@@ -229,3 +371,85 @@ func TestLogService_logHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestLogService_requestID(t *testing.T) {
+	type batch struct {
+		logs           string
+		wantRequestIDs []string
+	}
+	tests := []struct {
+		name        string
+		invocations []extension.NextEventResponse
+		batches     []batch
+	}{
+		{
+			name: "Across batches",
+			batches: []batch{
+				{
+					logs: `[
+						{"time": "2020-08-20T12:31:32.123Z", "type": "platform.start", "record": {"requestId": "A"}},
+						{"time": "2020-08-20T12:31:32.123Z", "type": "function", "record": "first"}
+					]`,
+					wantRequestIDs: []string{"A"},
+				},
+				{
+					logs: `[
+						{"time": "2020-08-20T12:31:32.123Z", "type": "function", "record": "second"},
+						{"time": "2020-08-20T12:31:32.123Z", "type": "platform.runtimeDone", "record": {"requestId": "A", "status": "success"}},
+						{"time": "2020-08-20T12:31:32.123Z", "type": "function", "record": "late"}
+					]`,
+					wantRequestIDs: []string{"A", "A"},
+				},
+			},
+		},
+		{
+			name: "Invoke event as fallback",
+			invocations: []extension.NextEventResponse{
+				{EventType: extension.Invoke, RequestID: "B"},
+			},
+			batches: []batch{
+				{
+					logs:           `[{"time": "2020-08-20T12:31:32.123Z", "type": "function", "record": "before start"}]`,
+					wantRequestIDs: []string{"B"},
+				},
+			},
+		},
+		{
+			name: "Runtime prefix",
+			batches: []batch{
+				{
+					logs: `[
+						{"time": "2020-08-20T12:31:32.123Z", "type": "platform.start", "record": {"requestId": "A"}},
+						{"time": "2020-08-20T12:31:32.123Z", "type": "function", "record": "2020-08-20T12:31:32.123Z\tc0ffee00-f834-4211-8a7a-f6fe80b88d56\tINFO\thello\n"}
+					]`,
+					wantRequestIDs: []string{"c0ffee00-f834-4211-8a7a-f6fe80b88d56"},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logsQueue := make(chan []Log, len(tt.batches))
+			s := New(ServiceParams{
+				LogsQueue: logsQueue,
+			})
+			for _, invocation := range tt.invocations {
+				s.AddInvocation(invocation)
+			}
+
+			for _, b := range tt.batches {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(b.logs))
+				s.logHandler(w, r)
+				require.EqualValues(t, http.StatusOK, w.Code)
+
+				logs := <-logsQueue
+				var requestIDs []string
+				for _, log := range logs {
+					requestIDs = append(requestIDs, log.RequestID)
+				}
+				require.Equal(t, b.wantRequestIDs, requestIDs)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package logservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MultilineParams are the settings to join the continuation lines of function logs, e.g. stack traces
+type MultilineParams struct {
+	// Presets are the names of built-in continuation rules, e.g. java, python, go, node
+	Presets []string
+	// StartPattern matches the first line of a log. Lines not matching it are joined with the previous log.
+	StartPattern string
+	// FlushTimeout is the time to wait for the next continuation line before the pending log is flushed
+	FlushTimeout time.Duration
+	MaxLines     int
+	MaxBytes     int
+}
+
+// multilineRule regards a line matching Continue as the continuation of the pending log.
+// If Within is set, the rule only applies when the pending log matches it.
+type multilineRule struct {
+	Within   *regexp.Regexp
+	Continue *regexp.Regexp
+}
+
+var multilinePresets = map[string][]multilineRule{
+	"java": {
+		{Continue: regexp.MustCompile(`^\s+at\s|^\s+\.\.\. \d+ (more|common frames omitted)|^Caused by:\s|^\s+Suppressed:\s`)},
+	},
+	"python": {
+		{
+			Within:   regexp.MustCompile(`(?m)^Traceback \(most recent call last\):`),
+			Continue: regexp.MustCompile(`^\s+\S|^[A-Za-z_][\w.]*(Error|Exception|Exit|Interrupt|Warning)\b|^During handling of the above exception|^The above exception was the direct cause|^$`),
+		},
+	},
+	"go": {
+		{
+			Within:   regexp.MustCompile(`(?m)^(panic: |fatal error: )`),
+			Continue: regexp.MustCompile(`^\s+|^$|^goroutine \d+ \[|^\[signal |^[\w./*()\-]+\(.*\)$|^created by |^exit status \d+`),
+		},
+	},
+	"node": {
+		{Continue: regexp.MustCompile(`^\s+at\s|^\s+\.\.\. \d+ more`)},
+	},
+}
+
+// Multiline aggregates the continuation lines of function logs into the first log of them.
+// It is safe for concurrent use.
+type Multiline struct {
+	rules        []multilineRule
+	startPattern *regexp.Regexp
+	flushTimeout time.Duration
+	maxLines     int
+	maxBytes     int
+
+	mu      sync.Mutex
+	pending *Log
+	text    string
+	lines   int
+	updated time.Time
+}
+
+// NewMultiline creates the multiline aggregation. It returns nil if no preset or start pattern is configured.
+func NewMultiline(params MultilineParams) (*Multiline, error) {
+	if params.FlushTimeout <= 0 {
+		return nil, fmt.Errorf("logservice: invalid multiline flush timeout: %s", params.FlushTimeout)
+	}
+	m := &Multiline{
+		flushTimeout: params.FlushTimeout,
+		maxLines:     params.MaxLines,
+		maxBytes:     params.MaxBytes,
+	}
+	for _, name := range params.Presets {
+		rules, ok := multilinePresets[name]
+		if !ok {
+			return nil, fmt.Errorf("logservice: unknown multiline preset: %s", name)
+		}
+		m.rules = append(m.rules, rules...)
+	}
+	if params.StartPattern != "" {
+		re, err := regexp.Compile(params.StartPattern)
+		if err != nil {
+			return nil, fmt.Errorf("logservice: invalid multiline start pattern: %w", err)
+		}
+		m.startPattern = re
+	}
+	if len(m.rules) == 0 && m.startPattern == nil {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// add puts the log into the aggregation and returns the logs which are complete
+func (m *Multiline) add(log Log, now time.Time) []Log {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Only function logs could be aggregated; others terminate the pending log to keep the order
+	if log.Type != Function {
+		return append(m.flushLocked(), log)
+	}
+
+	line := strings.TrimRight(log.Line(), "\r\n")
+	if m.pending != nil && log.RequestID == m.pending.RequestID && m.isContinuation(line) &&
+		m.lines+1 <= m.maxLines && len(m.text)+1+len(line) <= m.maxBytes {
+		m.text += "\n" + line
+		m.lines++
+		m.updated = now
+		return nil
+	}
+
+	completed := m.flushLocked()
+	m.pending = &log
+	m.text = line
+	m.lines = 1
+	m.updated = now
+	return completed
+}
+
+// flushIdle returns the pending log if no continuation line has been received within the flush timeout
+func (m *Multiline) flushIdle(now time.Time) []Log {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pending == nil || now.Sub(m.updated) < m.flushTimeout {
+		return nil
+	}
+	return m.flushLocked()
+}
+
+// flush returns the pending log regardless of the timeout
+func (m *Multiline) flush() []Log {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.flushLocked()
+}
+
+func (m *Multiline) flushLocked() []Log {
+	if m.pending == nil {
+		return nil
+	}
+	log := *m.pending
+	if m.lines > 1 {
+		log.Content, _ = json.Marshal(m.text)
+	}
+	m.pending = nil
+	m.text = ""
+	m.lines = 0
+	return []Log{log}
+}
+
+func (m *Multiline) isContinuation(line string) bool {
+	for _, rule := range m.rules {
+		if rule.Within != nil && !rule.Within.MatchString(m.text) {
+			continue
+		}
+		if rule.Continue.MatchString(line) {
+			return true
+		}
+	}
+	return m.startPattern != nil && !m.startPattern.MatchString(line)
+}
@@ -0,0 +1,114 @@
+package logservice
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func functionLog(requestID string, line string) Log {
+	content, _ := json.Marshal(line)
+	return Log{
+		Time:      timeMustParse("2020-08-20T12:31:32.123Z"),
+		Type:      Function,
+		RequestID: requestID,
+		Content:   content,
+	}
+}
+
+func TestMultiline(t *testing.T) {
+	type args struct {
+		params MultilineParams
+		logs   []Log
+	}
+	tests := []struct {
+		name      string
+		args      args
+		wantLines []string
+	}{
+		{
+			name: "Java",
+			args: args{
+				params: MultilineParams{Presets: []string{"java"}, FlushTimeout: time.Second, MaxLines: 100, MaxBytes: 4096},
+				logs: []Log{
+					functionLog("1", "start\n"),
+					functionLog("1", "java.lang.IllegalStateException: boom\n"),
+					functionLog("1", "\tat com.example.Handler.handle(Handler.java:10)\n"),
+					functionLog("1", "Caused by: java.io.IOException: closed\n"),
+					functionLog("1", "\t... 3 more\n"),
+					functionLog("1", "done\n"),
+				},
+			},
+			wantLines: []string{
+				"start\n",
+				"java.lang.IllegalStateException: boom\n\tat com.example.Handler.handle(Handler.java:10)\nCaused by: java.io.IOException: closed\n\t... 3 more",
+				"done\n",
+			},
+		},
+		{
+			name: "Python",
+			args: args{
+				params: MultilineParams{Presets: []string{"python"}, FlushTimeout: time.Second, MaxLines: 100, MaxBytes: 4096},
+				logs: []Log{
+					functionLog("1", "Traceback (most recent call last):\n"),
+					functionLog("1", "  File \"/var/task/app.py\", line 3, in handler\n"),
+					functionLog("1", "    raise ValueError(\"boom\")\n"),
+					functionLog("1", "ValueError: boom\n"),
+				},
+			},
+			wantLines: []string{
+				"Traceback (most recent call last):\n  File \"/var/task/app.py\", line 3, in handler\n    raise ValueError(\"boom\")\nValueError: boom",
+			},
+		},
+		{
+			name: "Start pattern with bounds and request id",
+			args: args{
+				params: MultilineParams{StartPattern: `^\d{4}-`, FlushTimeout: time.Second, MaxLines: 2, MaxBytes: 4096},
+				logs: []Log{
+					functionLog("1", "2020-08-20 first"),
+					functionLog("1", "a"),
+					functionLog("1", "b"),
+					functionLog("2", "c"),
+				},
+			},
+			wantLines: []string{"2020-08-20 first\na", "b", "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMultiline(tt.args.params)
+			require.NoError(t, err)
+			require.NotNil(t, m)
+
+			now := time.Now()
+			var logs []Log
+			for _, log := range tt.args.logs {
+				logs = append(logs, m.add(log, now)...)
+			}
+			assert.Empty(t, m.flushIdle(now))
+			logs = append(logs, m.flushIdle(now.Add(time.Second))...)
+
+			var lines []string
+			for _, log := range logs {
+				assert.Equal(t, tt.args.logs[0].Time, log.Time)
+				lines = append(lines, log.Line())
+			}
+			assert.Equal(t, tt.wantLines, lines)
+		})
+	}
+}
+
+func TestNewMultiline(t *testing.T) {
+	m, err := NewMultiline(MultilineParams{FlushTimeout: time.Second})
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+
+	_, err = NewMultiline(MultilineParams{Presets: []string{"cobol"}, FlushTimeout: time.Second})
+	assert.Error(t, err)
+
+	_, err = NewMultiline(MultilineParams{StartPattern: "(", FlushTimeout: time.Second})
+	assert.Error(t, err)
+}
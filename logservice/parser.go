@@ -0,0 +1,225 @@
+package logservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/david7482/lambda-extension-log-shipper/utils"
+)
+
+// ParseFormat is the format of function logs which could be parsed into structured fields
+type ParseFormat string
+
+const (
+	// JSONFormat parses a log line of a JSON object
+	JSONFormat ParseFormat = "json"
+	// LogfmtFormat parses a log line of logfmt key=value pairs
+	LogfmtFormat ParseFormat = "logfmt"
+	// RuntimeFormat parses the log line prefix written by Node.js and Python runtimes
+	RuntimeFormat ParseFormat = "runtime"
+)
+
+// Field names set by the RuntimeFormat parser
+const (
+	FieldTimestamp = "timestamp"
+	FieldRequestID = "requestId"
+	FieldLevel     = "level"
+	FieldMessage   = "message"
+)
+
+var (
+	// nodeRuntimeRegexp matches `2020-08-20T12:31:32.123Z\t6f7f0961-f834-4211-8a7a-f6fe80b88d56\tINFO\tmessage`
+	nodeRuntimeRegexp = regexp.MustCompile(`(?s)^(\d{4}-\d{2}-\d{2}T[0-9:.]+Z)\t([0-9a-fA-F-]+|undefined)\t([A-Z]+)\t(.*)$`)
+	// pythonRuntimeRegexp matches `[INFO]\t2020-08-20T12:31:32.123Z\t6f7f0961-f834-4211-8a7a-f6fe80b88d56\tmessage`
+	pythonRuntimeRegexp = regexp.MustCompile(`(?s)^\[([A-Z]+)\]\t(\d{4}-\d{2}-\d{2}T[0-9:.]+Z)\t([0-9a-fA-F-]+)\t(.*)$`)
+)
+
+// ParseFormats converts a comma separated list of formats, e.g. "json,runtime", into ParseFormat
+func ParseFormats(value string) ([]ParseFormat, error) {
+	var formats []ParseFormat
+	for _, v := range utils.SplitList(value) {
+		switch ParseFormat(v) {
+		case JSONFormat, LogfmtFormat, RuntimeFormat:
+			formats = append(formats, ParseFormat(v))
+		default:
+			return nil, fmt.Errorf("logservice: unsupported parse format: %s", v)
+		}
+	}
+	return formats, nil
+}
+
+// Line returns the text of the log if its content is a JSON string, e.g. function logs
+func (l Log) Line() string {
+	var line string
+	if err := json.Unmarshal(l.Content, &line); err != nil {
+		return ""
+	}
+	return line
+}
+
+// runtimeRequestID returns the request id in the runtime prefix of a function log record
+func runtimeRequestID(record json.RawMessage) string {
+	var line string
+	if err := json.Unmarshal(record, &line); err != nil {
+		return ""
+	}
+	var requestID string
+	if m := nodeRuntimeRegexp.FindStringSubmatch(line); m != nil {
+		requestID = m[2]
+	} else if m := pythonRuntimeRegexp.FindStringSubmatch(line); m != nil {
+		requestID = m[3]
+	}
+	if requestID == "undefined" {
+		return ""
+	}
+	return requestID
+}
+
+// parseLine parses a function log line into structured fields with the given formats.
+// It returns nil if the line could not be parsed by any of them.
+func parseLine(line string, formats []ParseFormat) map[string]interface{} {
+	line = strings.TrimRight(line, "\r\n")
+
+	if hasFormat(formats, RuntimeFormat) {
+		if fields := parseRuntime(line); fields != nil {
+			// The message of runtime format could be a structured log as well
+			message, _ := fields[FieldMessage].(string)
+			if nested := parseStructured(message, formats); nested != nil {
+				for k, v := range nested {
+					// the request id and timestamp written by the runtime are always preferred
+					if k == FieldRequestID || k == FieldTimestamp {
+						continue
+					}
+					fields[k] = v
+				}
+				if _, ok := nested[FieldMessage]; !ok {
+					delete(fields, FieldMessage)
+				}
+			}
+			return fields
+		}
+	}
+	return parseStructured(line, formats)
+}
+
+func parseStructured(line string, formats []ParseFormat) map[string]interface{} {
+	if hasFormat(formats, JSONFormat) {
+		if fields := parseJSON(line); fields != nil {
+			return fields
+		}
+	}
+	if hasFormat(formats, LogfmtFormat) {
+		if fields := parseLogfmt(line); fields != nil {
+			return fields
+		}
+	}
+	return nil
+}
+
+func hasFormat(formats []ParseFormat, format ParseFormat) bool {
+	for _, f := range formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+func parseJSON(line string) map[string]interface{} {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "{") {
+		return nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return nil
+	}
+	return fields
+}
+
+func parseRuntime(line string) map[string]interface{} {
+	if m := nodeRuntimeRegexp.FindStringSubmatch(line); m != nil {
+		return map[string]interface{}{
+			FieldTimestamp: m[1],
+			FieldRequestID: m[2],
+			FieldLevel:     m[3],
+			FieldMessage:   m[4],
+		}
+	}
+	if m := pythonRuntimeRegexp.FindStringSubmatch(line); m != nil {
+		return map[string]interface{}{
+			FieldLevel:     m[1],
+			FieldTimestamp: m[2],
+			FieldRequestID: m[3],
+			FieldMessage:   m[4],
+		}
+	}
+	return nil
+}
+
+// parseLogfmt parses `key=value key2="quoted value"` pairs. Every token of the line has to be a pair,
+// otherwise the line is regarded as plain text.
+func parseLogfmt(line string) map[string]interface{} {
+	fields := make(map[string]interface{})
+	i := 0
+	for {
+		// skip spaces
+		for i < len(line) && line[i] == ' ' {
+			i++
+		}
+		if i >= len(line) {
+			break
+		}
+
+		// key
+		start := i
+		for i < len(line) && line[i] != '=' && line[i] != ' ' && line[i] != '"' {
+			i++
+		}
+		if i >= len(line) || line[i] != '=' || i == start {
+			return nil
+		}
+		key := line[start:i]
+		i++
+
+		// value
+		var value string
+		if i < len(line) && line[i] == '"' {
+			i++
+			var sb strings.Builder
+			closed := false
+			for i < len(line) {
+				c := line[i]
+				if c == '\\' && i+1 < len(line) {
+					sb.WriteByte(line[i+1])
+					i += 2
+					continue
+				}
+				i++
+				if c == '"' {
+					closed = true
+					break
+				}
+				sb.WriteByte(c)
+			}
+			if !closed {
+				return nil
+			}
+			value = sb.String()
+		} else {
+			start = i
+			for i < len(line) && !unicode.IsSpace(rune(line[i])) {
+				i++
+			}
+			value = line[start:i]
+		}
+		fields[key] = value
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
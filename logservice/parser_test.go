@@ -0,0 +1,79 @@
+package logservice
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFormats(t *testing.T) {
+	formats, err := ParseFormats("json, logfmt,,runtime")
+	require.NoError(t, err)
+	assert.Equal(t, []ParseFormat{JSONFormat, LogfmtFormat, RuntimeFormat}, formats)
+
+	_, err = ParseFormats("json,xml")
+	assert.Error(t, err)
+}
+
+func TestParseLine(t *testing.T) {
+	all := []ParseFormat{JSONFormat, LogfmtFormat, RuntimeFormat}
+	tests := []struct {
+		name    string
+		line    string
+		formats []ParseFormat
+		want    map[string]interface{}
+	}{
+		{
+			name:    "JSON",
+			line:    `{"level":"info","msg":"hello","count":1}` + "\n",
+			formats: all,
+			want:    map[string]interface{}{"level": "info", "msg": "hello", "count": float64(1)},
+		},
+		{
+			name:    "JSON disabled",
+			line:    `{"level":"info"}`,
+			formats: []ParseFormat{RuntimeFormat},
+			want:    nil,
+		},
+		{
+			name:    "Logfmt",
+			line:    `level=warn msg="something \"quoted\" happened" route=/users`,
+			formats: all,
+			want:    map[string]interface{}{"level": "warn", "msg": `something "quoted" happened`, "route": "/users"},
+		},
+		{
+			name:    "Plain text",
+			line:    "ERROR something happened",
+			formats: all,
+			want:    nil,
+		},
+		{
+			name:    "Node runtime",
+			line:    "2020-08-20T12:31:32.123Z\t6f7f0961-f834-4211-8a7a-f6fe80b88d56\tINFO\thello world\n",
+			formats: all,
+			want: map[string]interface{}{
+				FieldTimestamp: "2020-08-20T12:31:32.123Z",
+				FieldRequestID: "6f7f0961-f834-4211-8a7a-f6fe80b88d56",
+				FieldLevel:     "INFO",
+				FieldMessage:   "hello world",
+			},
+		},
+		{
+			name:    "Python runtime with JSON message",
+			line:    "[ERROR]\t2020-08-20T12:31:32.123Z\t6f7f0961-f834-4211-8a7a-f6fe80b88d56\t{\"error\":\"boom\",\"requestId\":\"other\"}\n",
+			formats: all,
+			want: map[string]interface{}{
+				FieldTimestamp: "2020-08-20T12:31:32.123Z",
+				FieldRequestID: "6f7f0961-f834-4211-8a7a-f6fe80b88d56",
+				FieldLevel:     "ERROR",
+				"error":        "boom",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseLine(tt.line, tt.formats))
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package logservice
+
+import (
+	"sync"
+
+	"github.com/david7482/lambda-extension-log-shipper/extension"
+)
+
+// requestTracker keeps track of the invocation which the function logs belong to. It is safe for concurrent use.
+//
+// The Logs API delivers logs in order, so the request id of platform.start is kept across batches until
+// platform.runtimeDone of the same invocation. The request id of the latest INVOKE event is used as a fallback,
+// e.g. logs before the first platform.start is received. INVOKE events are not used directly because they could be
+// received before the buffered logs of the previous invocation.
+type requestTracker struct {
+	mu sync.Mutex
+	// active is the request id of the invocation started in the logs stream
+	active string
+	// invoked is the request id of the latest INVOKE event
+	invoked string
+	// done is the request id of the latest invocation finished in the logs stream
+	done string
+	// invocations keeps the invoke events received from Extensions API by request id
+	invocations map[string]extension.NextEventResponse
+	// finished is closed once the platform.report of the latest INVOKE event is received
+	finished chan struct{}
+}
+
+func newRequestTracker() *requestTracker {
+	finished := make(chan struct{})
+	close(finished)
+	return &requestTracker{
+		invocations: make(map[string]extension.NextEventResponse),
+		finished:    finished,
+	}
+}
+
+func (t *requestTracker) invoke(event extension.NextEventResponse) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.invocations[event.RequestID] = event
+	if t.invoked != event.RequestID {
+		t.finished = make(chan struct{})
+	}
+	t.invoked = event.RequestID
+}
+
+func (t *requestTracker) start(requestID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active = requestID
+}
+
+func (t *requestTracker) runtimeDone(requestID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active == requestID {
+		t.active = ""
+	}
+	t.done = requestID
+}
+
+// current returns the request id which the next function log belongs to
+func (t *requestTracker) current() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active != "" {
+		return t.active
+	}
+	if t.invoked != "" && t.invoked != t.done {
+		return t.invoked
+	}
+	return t.done
+}
+
+func (t *requestTracker) invocation(requestID string) extension.NextEventResponse {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.invocations[requestID]
+}
+
+// finish forgets the invocation once its platform.report, the last log of an invocation, is received
+func (t *requestTracker) finish(requestID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.invocations, requestID)
+	if requestID != t.invoked {
+		return
+	}
+	select {
+	case <-t.finished:
+	default:
+		close(t.finished)
+	}
+}
+
+// lastFinished returns the channel closed once the platform.report of the latest INVOKE event is received, which is
+// closed already if there is no invocation
+func (t *requestTracker) lastFinished() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.finished
+}
@@ -0,0 +1,303 @@
+package matcher
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+)
+
+// Matcher tells whether a log matches all of its conditions. The expression is conditions joined by ` && `, e.g.
+//
+//	type=function && content~health-?check && field.route!=/users && level>=warn
+//
+// The `&&` must be surrounded by whitespace, so that a regex like `content~a&&b` is kept as a whole.
+// The keys of a condition are type, level, requestId, content and field.<name>.
+// The operators are = and != for equality, ~ and !~ for regex, and >, >=, <, <= for levels and numbers.
+type Matcher struct {
+	expr       string
+	conditions []condition
+}
+
+type operator string
+
+const (
+	opEqual        operator = "="
+	opNotEqual     operator = "!="
+	opMatch        operator = "~"
+	opNotMatch     operator = "!~"
+	opGreater      operator = ">"
+	opGreaterEqual operator = ">="
+	opLess         operator = "<"
+	opLessEqual    operator = "<="
+)
+
+// operators are ordered so that the longer ones are found first
+var operators = []operator{opNotEqual, opNotMatch, opGreaterEqual, opLessEqual, opEqual, opMatch, opGreater, opLess}
+
+const fieldPrefix = "field."
+
+// conditionSeparator joins the conditions of an expression
+var conditionSeparator = regexp.MustCompile(`\s+&&\s+`)
+
+type condition struct {
+	key    string
+	op     operator
+	value  string
+	regex  *regexp.Regexp
+	level  logservice.Level
+	number float64
+}
+
+// Parse compiles the matcher expression
+func Parse(expr string) (*Matcher, error) {
+	m := &Matcher{expr: strings.TrimSpace(expr)}
+	for _, part := range conditionSeparator.Split(expr, -1) {
+		c, err := parseCondition(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("matcher: invalid expression %q: %w", expr, err)
+		}
+		m.conditions = append(m.conditions, c)
+	}
+	return m, nil
+}
+
+// MustParse is like Parse but panics if the expression could not be parsed
+func MustParse(expr string) *Matcher {
+	m, err := Parse(expr)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func parseCondition(s string) (condition, error) {
+	var c condition
+
+	// key
+	i := 0
+	for i < len(s) && isKeyChar(s[i]) {
+		i++
+	}
+	c.key = s[:i]
+	switch {
+	case c.key == "type", c.key == "level", c.key == "requestId", c.key == "content":
+	case strings.HasPrefix(c.key, fieldPrefix) && len(c.key) > len(fieldPrefix):
+	default:
+		return c, fmt.Errorf("unknown key %q", c.key)
+	}
+
+	// operator
+	rest := strings.TrimLeft(s[i:], " ")
+	for _, op := range operators {
+		if strings.HasPrefix(rest, string(op)) {
+			c.op = op
+			break
+		}
+	}
+	if c.op == "" {
+		return c, fmt.Errorf("missing operator after %q", c.key)
+	}
+	c.value = strings.TrimSpace(rest[len(c.op):])
+
+	// value
+	switch c.op {
+	case opMatch, opNotMatch:
+		re, err := regexp.Compile(c.value)
+		if err != nil {
+			return c, err
+		}
+		c.regex = re
+	case opGreater, opGreaterEqual, opLess, opLessEqual:
+		if c.key == "level" {
+			lvl, err := logservice.ParseLevel(c.value)
+			if err != nil {
+				return c, err
+			}
+			c.level = lvl
+		} else if strings.HasPrefix(c.key, fieldPrefix) {
+			n, err := strconv.ParseFloat(c.value, 64)
+			if err != nil {
+				return c, fmt.Errorf("%q is not a number", c.value)
+			}
+			c.number = n
+		} else {
+			return c, fmt.Errorf("operator %s is not supported by %q", c.op, c.key)
+		}
+	default:
+		if c.key == "level" {
+			lvl, err := logservice.ParseLevel(c.value)
+			if err != nil {
+				return c, err
+			}
+			c.level = lvl
+		}
+	}
+	return c, nil
+}
+
+func isKeyChar(c byte) bool {
+	return c == '.' || c == '_' || c == '-' || c == '@' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// Match tells whether the log matches all conditions
+func (m *Matcher) Match(log logservice.Log) bool {
+	for _, c := range m.conditions {
+		if !c.match(log) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Matcher) String() string {
+	return m.expr
+}
+
+// MarshalText writes the expression of the matcher, e.g. when configs are logged
+func (m *Matcher) MarshalText() ([]byte, error) {
+	return []byte(m.expr), nil
+}
+
+func (c condition) match(log logservice.Log) bool {
+	if c.key == "level" {
+		switch c.op {
+		case opEqual:
+			return log.Level == c.level
+		case opNotEqual:
+			return log.Level != c.level
+		case opGreater:
+			return log.Level > c.level
+		case opGreaterEqual:
+			return log.Level >= c.level
+		case opLess:
+			return log.Level < c.level
+		case opLessEqual:
+			return log.Level <= c.level
+		}
+	}
+
+	value, ok := c.lookup(log)
+	switch c.op {
+	case opEqual:
+		return ok && value == c.value
+	case opNotEqual:
+		return !ok || value != c.value
+	case opMatch:
+		return ok && c.regex.MatchString(value)
+	case opNotMatch:
+		return !ok || !c.regex.MatchString(value)
+	}
+
+	// numeric comparison of fields
+	n, err := strconv.ParseFloat(value, 64)
+	if !ok || err != nil {
+		return false
+	}
+	switch c.op {
+	case opGreater:
+		return n > c.number
+	case opGreaterEqual:
+		return n >= c.number
+	case opLess:
+		return n < c.number
+	case opLessEqual:
+		return n <= c.number
+	}
+	return false
+}
+
+// lookup returns the value of the key from the log
+func (c condition) lookup(log logservice.Log) (string, bool) {
+	switch c.key {
+	case "type":
+		return string(log.Type), true
+	case "requestId":
+		return log.RequestID, true
+	case "content":
+		if log.Type == logservice.Function {
+			return log.Line(), true
+		}
+		return string(log.Content), true
+	}
+	return Field(log.Fields, strings.TrimPrefix(c.key, fieldPrefix))
+}
+
+// Field returns the structured field of the name as string. The name could be a nested path, e.g. `http.status`.
+func Field(fields map[string]interface{}, name string) (string, bool) {
+	v, ok := LookupField(fields, name)
+	if !ok || v == nil {
+		return "", false
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+// LookupField returns the raw value of the structured field of the name, which could be a nested path as Field
+func LookupField(fields map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := fields[name]; ok {
+		return v, true
+	}
+	// e.g. http.status => fields["http"]["status"]
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+	nested, ok := fields[parts[0]].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	return LookupField(nested, parts[1])
+}
+
+// List is a `;` separated list of matchers. It implements kingpin.Value so that it could be used as a flag.
+type List []*Matcher
+
+// Set parses the `;` separated matcher expressions
+func (l *List) Set(value string) error {
+	var list List
+	for _, expr := range strings.Split(value, ";") {
+		if strings.TrimSpace(expr) == "" {
+			continue
+		}
+		m, err := Parse(expr)
+		if err != nil {
+			return err
+		}
+		list = append(list, m)
+	}
+	*l = list
+	return nil
+}
+
+func (l *List) String() string {
+	var exprs []string
+	for _, m := range *l {
+		exprs = append(exprs, m.String())
+	}
+	return strings.Join(exprs, "; ")
+}
+
+// ListSeparator returns the separator of the items in the config file
+func (l *List) ListSeparator() string {
+	return "; "
+}
+
+// MatchAny returns the index of the first matcher which matches the log, or -1 if none matches
+func (l List) MatchAny(log logservice.Log) int {
+	for i, m := range l {
+		if m.Match(log) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,86 @@
+package matcher
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+)
+
+func TestMatcher_Match(t *testing.T) {
+	log := logservice.Log{
+		Type:      logservice.Function,
+		RequestID: "6f7f0961",
+		Content:   []byte(`"{\"route\":\"/health\",\"latency_ms\":12,\"http\":{\"status\":200},\"audit\":true}"`),
+		Level:     logservice.WarnLevel,
+		Fields: map[string]interface{}{
+			"route":      "/health",
+			"latency_ms": float64(12),
+			"http":       map[string]interface{}{"status": float64(200)},
+			"audit":      true,
+		},
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{expr: "type=function", want: true},
+		{expr: "type=platform.report", want: false},
+		{expr: "type!=platform.report", want: true},
+		{expr: "requestId=6f7f0961", want: true},
+		{expr: "content~health", want: true},
+		{expr: "content!~health", want: false},
+		{expr: "level>=warn", want: true},
+		{expr: "level>=error", want: false},
+		{expr: "level=warning", want: true},
+		{expr: "field.route=/health", want: true},
+		{expr: "field.audit=true", want: true},
+		{expr: "field.http.status=200", want: true},
+		{expr: "field.latency_ms>10", want: true},
+		{expr: "field.latency_ms<=10", want: false},
+		{expr: "field.missing!=x", want: true},
+		{expr: "field.missing=x", want: false},
+		{expr: "type=function && field.route=/health && level>warn", want: false},
+		{expr: "type = function && content ~ ^\\{", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			m, err := Parse(tt.expr)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, m.Match(log))
+		})
+	}
+}
+
+func TestParse_regexWithAnd(t *testing.T) {
+	log := logservice.Log{Type: logservice.Function, Content: []byte(`"make build&&make test"`)}
+	for _, expr := range []string{"content~build&&make", "type=function\t&&\tcontent~build&&make"} {
+		t.Run(expr, func(t *testing.T) {
+			m, err := Parse(expr)
+			require.NoError(t, err)
+			assert.True(t, m.Match(log))
+		})
+	}
+}
+
+func TestParse_Error(t *testing.T) {
+	for _, expr := range []string{"", "foo=bar", "type", "content~(", "level>=loud", "type>1", "field.latency_ms>fast"} {
+		t.Run(expr, func(t *testing.T) {
+			_, err := Parse(expr)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestList_Set(t *testing.T) {
+	var l List
+	require.NoError(t, l.Set("type=function; ;level>=error"))
+	assert.Len(t, l, 2)
+	assert.Equal(t, "type=function; level>=error", l.String())
+	assert.Equal(t, 1, l.MatchAny(logservice.Log{Type: logservice.PlatformFault, Level: logservice.ErrorLevel}))
+	assert.Equal(t, -1, l.MatchAny(logservice.Log{Type: logservice.PlatformReport}))
+
+	assert.Error(t, l.Set("type=function;foo"))
+}
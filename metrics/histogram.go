@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds in milliseconds of the latency histograms
+var LatencyBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// Histogram counts the values by buckets. Report writes the values observed since the last report.
+type Histogram struct {
+	descriptor
+	// buckets are the ascending upper bounds; the last count is for the values above all bounds
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type histogramSnapshot struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(d descriptor, buckets []float64) *Histogram {
+	return &Histogram{
+		descriptor: d,
+		buckets:    buckets,
+		counts:     make([]uint64, len(buckets)+1),
+	}
+}
+
+// Observe adds the value into its bucket
+func (h *Histogram) Observe(value float64) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := 0
+	for i < len(h.buckets) && value > h.buckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += value
+}
+
+// ObserveSince adds the milliseconds elapsed since the start
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(float64(time.Since(start)) / float64(time.Millisecond))
+}
+
+// snapshot returns the values observed since the last snapshot, and resets them
+func (h *Histogram) snapshot() histogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := histogramSnapshot{
+		buckets: h.buckets,
+		counts:  h.counts,
+		count:   h.count,
+		sum:     h.sum,
+	}
+	h.counts = make([]uint64, len(h.buckets)+1)
+	h.count = 0
+	h.sum = 0
+	return s
+}
+
+// quantile estimates the value at the quantile by the upper bound of its bucket
+func (s histogramSnapshot) quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(s.count)))
+	var seen uint64
+	for i, c := range s.counts {
+		seen += c
+		if seen >= rank {
+			return s.bound(i)
+		}
+	}
+	return s.bound(len(s.counts) - 1)
+}
+
+// bound returns the upper bound of the bucket; the values above all bounds are regarded as the last bound
+func (s histogramSnapshot) bound(i int) float64 {
+	if i >= len(s.buckets) {
+		i = len(s.buckets) - 1
+	}
+	return s.buckets[i]
+}
+
+// distribution returns the upper bounds and counts of the non-empty buckets
+func (s histogramSnapshot) distribution() ([]float64, []float64) {
+	var values, counts []float64
+	for i, c := range s.counts {
+		if c > 0 {
+			values = append(values, s.bound(i))
+			counts = append(counts, float64(c))
+		}
+	}
+	return values, counts
+}
@@ -0,0 +1,308 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/emf"
+)
+
+// Names of the metrics of the pipeline
+const (
+	LogBatches       = "LogBatches"
+	LogRecords       = "LogRecords"
+	LogBytes         = "LogBytes"
+	ParseErrors      = "ParseErrors"
+	IgnoredRecords   = "IgnoredRecords"
+	DroppedLogs      = "DroppedLogs"
+	QueueDepth       = "QueueDepth"
+	ForwarderSent    = "ForwarderSent"
+	ForwarderFailed  = "ForwarderFailed"
+	ForwarderDropped = "ForwarderDropped"
+	ForwarderBytes   = "ForwarderBytes"
+	ForwarderRetried = "ForwarderRetried"
+	ForwarderSpilled = "ForwarderSpilled"
+	ForwarderLatency = "ForwarderLatency"
+)
+
+// Registry holds the metrics of the pipeline and reports them periodically. A nil *Registry is valid and records
+// nothing, so that components could be used without metrics, e.g. in tests.
+type Registry struct {
+	cfg    config
+	logger zerolog.Logger
+	params Params
+	// out is where the EMF documents are written, which is stdout
+	out io.Writer
+
+	mu         sync.Mutex
+	counters   map[string]*Counter
+	gauges     map[string]*gauge
+	histograms map[string]*Histogram
+}
+
+type config struct {
+	Interval  *time.Duration
+	EMF       *bool
+	Namespace *string
+}
+
+// Params are the settings of the registry known after the configs are parsed
+type Params struct {
+	LambdaName string
+}
+
+// Labels are the dimensions of a metric, e.g. the forwarder name
+type Labels map[string]string
+
+type descriptor struct {
+	name   string
+	unit   emf.Unit
+	labels Labels
+}
+
+// Counter is a monotonic counter. Report writes the increase since the last report.
+type Counter struct {
+	descriptor
+	value    uint64
+	reported uint64
+}
+
+type gauge struct {
+	descriptor
+	fn func() float64
+}
+
+func New() *Registry {
+	return &Registry{
+		logger:     zerolog.New(os.Stdout).With().Str("component", "metrics").Timestamp().Logger(),
+		out:        os.Stdout,
+		counters:   make(map[string]*Counter),
+		gauges:     make(map[string]*gauge),
+		histograms: make(map[string]*Histogram),
+	}
+}
+
+func (r *Registry) SetupConfigs(app *kingpin.Application) {
+	r.cfg.Interval = app.
+		Flag("metrics-interval", "The interval to report the metrics of the pipeline, 0 reports them only when the extension is shutting down").
+		Envar("LS_METRICS_INTERVAL").
+		Default("60s").Duration()
+	r.cfg.EMF = app.
+		Flag("metrics-emf", "Write the metrics of the pipeline to stdout in CloudWatch Embedded Metric Format").
+		Envar("LS_METRICS_EMF").
+		Default("false").Bool()
+	r.cfg.Namespace = app.
+		Flag("metrics-namespace", "The CloudWatch namespace of the metrics of the pipeline").
+		Envar("LS_METRICS_NAMESPACE").
+		Default("LambdaExtensionLogShipper").String()
+}
+
+func (r *Registry) Init(params Params) {
+	r.params = params
+	r.logger = r.logger.With().Str("lambdaName", params.LambdaName).Logger()
+}
+
+// Counter returns the counter of the name and labels, which is created at the first call
+func (r *Registry) Counter(name string, unit emf.Unit, labels Labels) *Counter {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := metricKey(name, labels)
+	c, ok := r.counters[key]
+	if !ok {
+		c = &Counter{descriptor: descriptor{name: name, unit: unit, labels: labels}}
+		r.counters[key] = c
+	}
+	return c
+}
+
+// Gauge registers the function which returns the current value of the gauge, e.g. the depth of a queue
+func (r *Registry) Gauge(name string, unit emf.Unit, labels Labels, fn func() float64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gauges[metricKey(name, labels)] = &gauge{descriptor: descriptor{name: name, unit: unit, labels: labels}, fn: fn}
+}
+
+// Histogram returns the histogram of the name and labels, which is created at the first call
+func (r *Registry) Histogram(name string, unit emf.Unit, labels Labels, buckets []float64) *Histogram {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := metricKey(name, labels)
+	h, ok := r.histograms[key]
+	if !ok {
+		h = newHistogram(descriptor{name: name, unit: unit, labels: labels}, buckets)
+		r.histograms[key] = h
+	}
+	return h
+}
+
+// Add increases the counter by n
+func (c *Counter) Add(n uint64) {
+	if c == nil {
+		return
+	}
+	atomic.AddUint64(&c.value, n)
+}
+
+// Inc increases the counter by 1
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Value returns the total of the counter
+func (c *Counter) Value() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.value)
+}
+
+// Total returns the sum of the counters of the name with any labels
+func (r *Registry) Total(name string) uint64 {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var total uint64
+	for _, c := range r.counters {
+		if c.name == name {
+			total += c.Value()
+		}
+	}
+	return total
+}
+
+// Run reports the metrics every interval until the context is done
+func (r *Registry) Run(ctx context.Context) {
+	if *r.cfg.Interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(*r.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.Report()
+			}
+		}
+	}()
+}
+
+// Report writes the metrics to the extension's own logs, and to stdout in EMF if it is enabled
+func (r *Registry) Report() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e := r.logger.Info()
+	docs := make(map[string]*emf.Document)
+	now := time.Now()
+	add := func(d descriptor, m emf.Metric) {
+		key := metricKey("", d.labels)
+		doc, ok := docs[key]
+		if !ok {
+			dimensions := map[string]string{"FunctionName": r.params.LambdaName}
+			for k, v := range d.labels {
+				dimensions[k] = v
+			}
+			doc = &emf.Document{Namespace: *r.cfg.Namespace, Timestamp: now, Dimensions: dimensions}
+			docs[key] = doc
+		}
+		m.Name, m.Unit = d.name, d.unit
+		doc.Metrics = append(doc.Metrics, m)
+	}
+
+	var counterKeys, gaugeKeys, histogramKeys, docKeys []string
+	for key := range r.counters {
+		counterKeys = append(counterKeys, key)
+	}
+	for key := range r.gauges {
+		gaugeKeys = append(gaugeKeys, key)
+	}
+	for key := range r.histograms {
+		histogramKeys = append(histogramKeys, key)
+	}
+
+	for _, key := range sortKeys(counterKeys) {
+		c := r.counters[key]
+		value := atomic.LoadUint64(&c.value)
+		e = e.Uint64(key, value)
+		add(c.descriptor, emf.Metric{Value: float64(value - c.reported)})
+		c.reported = value
+	}
+	for _, key := range sortKeys(gaugeKeys) {
+		g := r.gauges[key]
+		value := g.fn()
+		e = e.Float64(key, value)
+		add(g.descriptor, emf.Metric{Value: value})
+	}
+	for _, key := range sortKeys(histogramKeys) {
+		h := r.histograms[key]
+		snapshot := h.snapshot()
+		e = e.Dict(key, zerolog.Dict().
+			Uint64("count", snapshot.count).
+			Float64("sum", snapshot.sum).
+			Float64("p50", snapshot.quantile(0.5)).
+			Float64("p99", snapshot.quantile(0.99)))
+		if values, counts := snapshot.distribution(); len(values) > 0 {
+			add(h.descriptor, emf.Metric{Values: values, Counts: counts})
+		}
+	}
+	e.Msg("pipeline metrics")
+
+	if !*r.cfg.EMF {
+		return
+	}
+	for key := range docs {
+		docKeys = append(docKeys, key)
+	}
+	for _, key := range sortKeys(docKeys) {
+		for _, doc := range docs[key].Split() {
+			b, err := doc.MarshalJSON()
+			if err != nil {
+				r.logger.Error().Err(err).Msg("fail to marshal EMF metrics")
+				continue
+			}
+			fmt.Fprintln(r.out, string(b))
+		}
+	}
+}
+
+// metricKey identifies the metric by its name and labels, e.g. `ForwarderSent{forwarder=newrelic}`
+func metricKey(name string, labels Labels) string {
+	if len(labels) == 0 {
+		return name
+	}
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortKeys(keys []string) []string {
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/david7482/lambda-extension-log-shipper/configtest"
+	"github.com/david7482/lambda-extension-log-shipper/emf"
+)
+
+func TestRegistry_Report(t *testing.T) {
+	r := New()
+	configtest.Parse(t, r.SetupConfigs, "--metrics-emf")
+	r.Init(Params{LambdaName: "hello"})
+	var out bytes.Buffer
+	r.out = &out
+
+	labels := Labels{"Forwarder": "newrelic"}
+	r.Counter(LogRecords, emf.Count, nil).Add(10)
+	r.Counter(ForwarderSent, emf.Count, labels).Add(3)
+	r.Gauge(QueueDepth, emf.Count, Labels{"Queue": "logs"}, func() float64 { return 2 })
+	latency := r.Histogram(ForwarderLatency, emf.Milliseconds, labels, LatencyBuckets)
+	latency.Observe(3)
+	latency.Observe(42)
+	latency.Observe(20000)
+
+	r.Report()
+	docs := decodeDocuments(t, out.String())
+	require.Len(t, docs, 3)
+	// the documents are ordered by their labels
+	assert.Equal(t, float64(10), docs[0]["LogRecords"])
+	assert.Equal(t, "hello", docs[0]["FunctionName"])
+	assert.Equal(t, float64(3), docs[1]["ForwarderSent"])
+	assert.Equal(t, "newrelic", docs[1]["Forwarder"])
+	assert.Equal(t, map[string]interface{}{
+		"Values": []interface{}{float64(5), float64(50), float64(10000)},
+		"Counts": []interface{}{float64(1), float64(1), float64(1)},
+	}, docs[1]["ForwarderLatency"])
+	assert.Equal(t, float64(2), docs[2]["QueueDepth"])
+
+	// counters are reported by their increase since the last report
+	out.Reset()
+	r.Counter(ForwarderSent, emf.Count, labels).Inc()
+	r.Report()
+	docs = decodeDocuments(t, out.String())
+	assert.Equal(t, float64(0), docs[0]["LogRecords"])
+	assert.Equal(t, float64(1), docs[1]["ForwarderSent"])
+	assert.NotContains(t, docs[1], "ForwarderLatency")
+	assert.Equal(t, uint64(4), r.Counter(ForwarderSent, emf.Count, labels).Value())
+
+	r.Counter(ForwarderSent, emf.Count, Labels{"Forwarder": "stdout"}).Add(2)
+	assert.Equal(t, uint64(6), r.Total(ForwarderSent))
+	assert.Equal(t, uint64(0), r.Total(ForwarderFailed))
+}
+
+func decodeDocuments(t *testing.T, out string) []map[string]interface{} {
+	var docs []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		var doc map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &doc))
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+func TestRegistry_nil(t *testing.T) {
+	var r *Registry
+	assert.NotPanics(t, func() {
+		r.Counter(LogRecords, emf.Count, nil).Inc()
+		r.Gauge(QueueDepth, emf.Count, nil, func() float64 { return 0 })
+		r.Histogram(ForwarderLatency, emf.Milliseconds, nil, LatencyBuckets).Observe(1)
+	})
+	assert.Equal(t, uint64(0), r.Counter(LogRecords, emf.Count, nil).Value())
+	assert.Equal(t, uint64(0), r.Total(LogRecords))
+}
+
+func TestHistogram_quantile(t *testing.T) {
+	h := newHistogram(descriptor{}, []float64{10, 100, 1000})
+	for i := 0; i < 98; i++ {
+		h.Observe(5)
+	}
+	h.Observe(50)
+	h.Observe(5000)
+
+	s := h.snapshot()
+	assert.Equal(t, uint64(100), s.count)
+	assert.Equal(t, float64(10), s.quantile(0.5))
+	assert.Equal(t, float64(100), s.quantile(0.99))
+	assert.Equal(t, float64(1000), s.quantile(1))
+	assert.Equal(t, uint64(0), h.snapshot().count)
+}
@@ -0,0 +1,201 @@
+package enrich
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/processservice"
+	"github.com/david7482/lambda-extension-log-shipper/utils"
+)
+
+// Enrich attaches the metadata of the Lambda environment to each log as logservice.Log.Metadata,
+// so that all forwarders emit consistent metadata.
+type Enrich struct {
+	cfg    config
+	logger zerolog.Logger
+
+	mu        sync.Mutex
+	static    map[string]interface{}
+	cold      map[string]interface{}
+	accountID string
+	// coldStartRequestID is the request id of the first invocation of this execution environment
+	coldStartRequestID string
+}
+
+type config struct {
+	Enable          *bool
+	Tags            *tags
+	FunctionVersion *string
+	MemorySize      *string
+	LogStream       *string
+	Runtime         *string
+}
+
+func New() *Enrich {
+	return &Enrich{
+		logger: zerolog.New(os.Stdout).With().Str("processor", "enrich").Timestamp().Logger(),
+	}
+}
+
+func (p *Enrich) Name() string {
+	return "enrich"
+}
+
+func (p *Enrich) SetupConfigs(app *kingpin.Application) {
+	p.cfg.Enable = app.
+		Flag("enrich-enable", "Attach the Lambda environment metadata to each log").
+		Envar("LS_ENRICH_ENABLE").
+		Default("true").Bool()
+	p.cfg.Tags = new(tags)
+	app.
+		Flag("tags", "The comma separated static tags attached to each log, e.g. team=payments,env=prod").
+		Envar("LS_TAGS").
+		Default("").SetValue(p.cfg.Tags)
+
+	// the followings would read from lambda runtime environment variables
+	p.cfg.FunctionVersion = app.
+		Flag("lambda-function-version", "The version of the lambda function").
+		Envar("AWS_LAMBDA_FUNCTION_VERSION").
+		Default("").String()
+	p.cfg.MemorySize = app.
+		Flag("lambda-memory-size", "The memory size in MB of the lambda function").
+		Envar("AWS_LAMBDA_FUNCTION_MEMORY_SIZE").
+		Default("").String()
+	p.cfg.LogStream = app.
+		Flag("lambda-log-stream", "The log stream name, which identifies the execution environment of the lambda function").
+		Envar("AWS_LAMBDA_LOG_STREAM_NAME").
+		Default("").String()
+	p.cfg.Runtime = app.
+		Flag("lambda-runtime", "The runtime of the lambda function").
+		Envar("AWS_EXECUTION_ENV").
+		Default("").String()
+}
+
+func (p *Enrich) Init(params processservice.ProcessorParams) {
+	p.logger = p.logger.With().Str("lambdaName", params.LambdaName).Str("awsRegion", params.AWSRegion).Logger()
+
+	p.static = map[string]interface{}{
+		"architecture": architecture(runtime.GOARCH),
+		"coldStart":    false,
+	}
+	version := params.FunctionVersion
+	if version == "" {
+		version = *p.cfg.FunctionVersion
+	}
+	setString(p.static, "functionVersion", version)
+	setString(p.static, "handler", params.Handler)
+	setString(p.static, "logStream", *p.cfg.LogStream)
+	setString(p.static, "runtime", *p.cfg.Runtime)
+	if memorySize, err := strconv.Atoi(*p.cfg.MemorySize); err == nil {
+		p.static["memorySize"] = memorySize
+	}
+	for k, v := range *p.cfg.Tags {
+		p.static[k] = v
+	}
+	p.cold = withColdStart(p.static)
+}
+
+func (p *Enrich) IsEnable() bool {
+	return *p.cfg.Enable
+}
+
+func (p *Enrich) Process(logs []logservice.Log) []logservice.Log {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range logs {
+		log := &logs[i]
+		if p.accountID == "" && log.FunctionArn != "" {
+			if accountID := accountIDFromArn(log.FunctionArn); accountID != "" {
+				p.accountID = accountID
+				p.static = copyMetadata(p.static)
+				p.static["accountId"] = accountID
+				p.cold = withColdStart(p.static)
+			}
+		}
+		if p.coldStartRequestID == "" && log.RequestID != "" {
+			p.coldStartRequestID = log.RequestID
+		}
+
+		if log.RequestID != "" && log.RequestID == p.coldStartRequestID {
+			log.Metadata = p.cold
+		} else {
+			log.Metadata = p.static
+		}
+	}
+	return logs
+}
+
+func (p *Enrich) Shutdown() {
+
+}
+
+// accountIDFromArn returns the account id of arn:aws:lambda:<region>:<account-id>:function:<name>[:<qualifier>]
+func accountIDFromArn(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) < 6 || parts[0] != "arn" {
+		return ""
+	}
+	return parts[4]
+}
+
+func architecture(goarch string) string {
+	if goarch == "amd64" {
+		return "x86_64"
+	}
+	return goarch
+}
+
+func setString(m map[string]interface{}, key, value string) {
+	if value != "" {
+		m[key] = value
+	}
+}
+
+func copyMetadata(m map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(m)+1)
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func withColdStart(m map[string]interface{}) map[string]interface{} {
+	c := copyMetadata(m)
+	c["coldStart"] = true
+	return c
+}
+
+// tags is the comma separated key=value pairs. It implements kingpin.Value.
+type tags map[string]string
+
+func (t *tags) Set(value string) error {
+	parsed := make(tags)
+	for _, item := range utils.SplitList(value) {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return fmt.Errorf("enrich: invalid tag %q, expect key=value", item)
+		}
+		parsed[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	*t = parsed
+	return nil
+}
+
+func (t *tags) String() string {
+	var items []string
+	for k, v := range *t {
+		items = append(items, k+"="+v)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,54 @@
+package enrich
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/david7482/lambda-extension-log-shipper/configtest"
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/processservice"
+)
+
+func TestEnrich_Process(t *testing.T) {
+	p := New()
+	configtest.Parse(t, p.SetupConfigs,
+		"--tags=team=payments, env=prod",
+		"--lambda-memory-size=512",
+		"--lambda-log-stream=2020/08/20/[$LATEST]6f7f0961f83442118a7af6fe80b88d56",
+		"--lambda-runtime=AWS_Lambda_go1.x",
+	)
+	p.Init(processservice.ProcessorParams{FunctionVersion: "$LATEST", Handler: "bootstrap"})
+	require.True(t, p.IsEnable())
+
+	arn := "arn:aws:lambda:us-west-2:123456789012:function:hello"
+	logs := p.Process([]logservice.Log{
+		{Type: logservice.Function, RequestID: "A", FunctionArn: arn},
+		{Type: logservice.Function, RequestID: "B", FunctionArn: arn},
+	})
+	require.Len(t, logs, 2)
+
+	want := map[string]interface{}{
+		"architecture":    architecture(runtime.GOARCH),
+		"coldStart":       true,
+		"functionVersion": "$LATEST",
+		"handler":         "bootstrap",
+		"logStream":       "2020/08/20/[$LATEST]6f7f0961f83442118a7af6fe80b88d56",
+		"runtime":         "AWS_Lambda_go1.x",
+		"memorySize":      512,
+		"accountId":       "123456789012",
+		"team":            "payments",
+		"env":             "prod",
+	}
+	assert.Equal(t, want, logs[0].Metadata)
+
+	want["coldStart"] = false
+	assert.Equal(t, want, logs[1].Metadata)
+}
+
+func TestAccountIDFromArn(t *testing.T) {
+	assert.Equal(t, "123456789012", accountIDFromArn("arn:aws:lambda:us-west-2:123456789012:function:hello:prod"))
+	assert.Equal(t, "", accountIDFromArn("hello"))
+}
@@ -0,0 +1,132 @@
+package filter
+
+import (
+	"os"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/matcher"
+	"github.com/david7482/lambda-extension-log-shipper/processservice"
+)
+
+// Filter keeps the logs matching any include rule (or all logs if there is none),
+// and then drops the logs matching any exclude rule. It is safe for concurrent use.
+type Filter struct {
+	include matcher.List
+	exclude matcher.List
+
+	mu          sync.Mutex
+	notIncluded uint64
+	excluded    []uint64
+}
+
+// NewFilter creates a filter with the include and exclude rules
+func NewFilter(include, exclude matcher.List) *Filter {
+	return &Filter{
+		include:  include,
+		exclude:  exclude,
+		excluded: make([]uint64, len(exclude)),
+	}
+}
+
+// IsEmpty tells whether the filter has no rule at all
+func (f *Filter) IsEmpty() bool {
+	return len(f.include) == 0 && len(f.exclude) == 0
+}
+
+// Apply returns the logs which pass the filter and the number of dropped logs
+func (f *Filter) Apply(logs []logservice.Log) ([]logservice.Log, int) {
+	if f.IsEmpty() {
+		return logs, 0
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	filtered := make([]logservice.Log, 0, len(logs))
+	for _, log := range logs {
+		if len(f.include) > 0 && f.include.MatchAny(log) < 0 {
+			f.notIncluded++
+			continue
+		}
+		if i := f.exclude.MatchAny(log); i >= 0 {
+			f.excluded[i]++
+			continue
+		}
+		filtered = append(filtered, log)
+	}
+	return filtered, len(logs) - len(filtered)
+}
+
+// LogStats writes the counters of dropped logs into the event
+func (f *Filter) LogStats(e *zerolog.Event) *zerolog.Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	excluded := zerolog.Dict()
+	total := f.notIncluded
+	for i, m := range f.exclude {
+		excluded = excluded.Uint64(m.String(), f.excluded[i])
+		total += f.excluded[i]
+	}
+	return e.Uint64("dropped", total).Uint64("notIncluded", f.notIncluded).Dict("excluded", excluded)
+}
+
+// Processor is the global filter applied to the logs before they are sent to any forwarder
+type Processor struct {
+	cfg    config
+	logger zerolog.Logger
+	filter *Filter
+}
+
+type config struct {
+	Include *matcher.List
+	Exclude *matcher.List
+}
+
+func New() *Processor {
+	return &Processor{
+		logger: zerolog.New(os.Stdout).With().Str("processor", "filter").Timestamp().Logger(),
+	}
+}
+
+func (p *Processor) Name() string {
+	return "filter"
+}
+
+func (p *Processor) SetupConfigs(app *kingpin.Application) {
+	p.cfg.Include = new(matcher.List)
+	app.
+		Flag("filter-include", "The semicolon separated rules of logs to keep, e.g. type=function && field.audit=true").
+		Envar("LS_FILTER_INCLUDE").
+		Default("").SetValue(p.cfg.Include)
+	p.cfg.Exclude = new(matcher.List)
+	app.
+		Flag("filter-exclude", "The semicolon separated rules of logs to drop, e.g. content~health-?check").
+		Envar("LS_FILTER_EXCLUDE").
+		Default("").SetValue(p.cfg.Exclude)
+}
+
+func (p *Processor) Init(params processservice.ProcessorParams) {
+	p.filter = NewFilter(*p.cfg.Include, *p.cfg.Exclude)
+	p.logger = p.logger.With().Str("lambdaName", params.LambdaName).Str("awsRegion", params.AWSRegion).Logger()
+}
+
+func (p *Processor) IsEnable() bool {
+	return !p.filter.IsEmpty()
+}
+
+func (p *Processor) Process(logs []logservice.Log) []logservice.Log {
+	filtered, dropped := p.filter.Apply(logs)
+	if dropped > 0 {
+		p.logger.Debug().Int("dropped", dropped).Int("total", len(logs)).Msg("filter dropped logs")
+	}
+	return filtered
+}
+
+func (p *Processor) Shutdown() {
+	p.filter.LogStats(p.logger.Info()).Msg("filter stats")
+}
@@ -0,0 +1,56 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/matcher"
+)
+
+func TestFilter_Apply(t *testing.T) {
+	logs := []logservice.Log{
+		{Type: logservice.Function, Content: []byte(`"GET /health 200"`)},
+		{Type: logservice.Function, Content: []byte(`"GET /users 200"`)},
+		{Type: logservice.Function, Content: []byte(`"GET /users 500"`), Level: logservice.ErrorLevel},
+		{Type: logservice.PlatformReport, Content: []byte(`{"durationMs": 101.51}`)},
+	}
+	tests := []struct {
+		name        string
+		include     string
+		exclude     string
+		wantLogs    []logservice.Log
+		wantDropped int
+	}{
+		{
+			name:     "No rules",
+			wantLogs: logs,
+		},
+		{
+			name:        "Exclude",
+			exclude:     "content~/health",
+			wantLogs:    []logservice.Log{logs[1], logs[2], logs[3]},
+			wantDropped: 1,
+		},
+		{
+			name:        "Include and exclude",
+			include:     "type=function",
+			exclude:     "content~/health; level>=error",
+			wantLogs:    []logservice.Log{logs[1]},
+			wantDropped: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var include, exclude matcher.List
+			require.NoError(t, include.Set(tt.include))
+			require.NoError(t, exclude.Set(tt.exclude))
+
+			filtered, dropped := NewFilter(include, exclude).Apply(logs)
+			assert.Equal(t, tt.wantLogs, filtered)
+			assert.Equal(t, tt.wantDropped, dropped)
+		})
+	}
+}
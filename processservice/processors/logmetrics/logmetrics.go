@@ -0,0 +1,267 @@
+package logmetrics
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/matcher"
+	"github.com/david7482/lambda-extension-log-shipper/processservice"
+)
+
+// LogMetrics derives counters and histograms from the logs by rules, and aggregates them per invocation. The metrics
+// of an invocation are emitted as logs of the metric type once its platform.report is received, or the logs of
+// another invocation are received if platform reports are disabled, or the pipeline is shutting down.
+type LogMetrics struct {
+	cfg    config
+	logger zerolog.Logger
+
+	mu sync.Mutex
+	// pending are the invocations whose metrics are not emitted yet, in the order they are started
+	pending []*invocation
+	emitted uint64
+}
+
+type config struct {
+	Rules *Rules
+}
+
+// invocation keeps the aggregates of the metrics of an invocation
+type invocation struct {
+	requestID string
+	// last is the last log of the invocation, whose time, tracing and metadata are kept by the metric logs
+	last       logservice.Log
+	aggregates []*aggregate
+	index      map[string]*aggregate
+}
+
+// aggregate is a metric of a rule and its label values
+type aggregate struct {
+	rule   *Rule
+	labels map[string]string
+	value  float64
+	count  uint64
+	sum    float64
+	min    float64
+	max    float64
+	values []float64
+	counts []float64
+	// positions are the indexes of the distinct values
+	positions map[float64]int
+}
+
+func New() *LogMetrics {
+	return &LogMetrics{
+		logger: zerolog.New(os.Stdout).With().Str("processor", "logmetrics").Timestamp().Logger(),
+	}
+}
+
+func (s *LogMetrics) Name() string {
+	return "logmetrics"
+}
+
+func (s *LogMetrics) SetupConfigs(app *kingpin.Application) {
+	s.cfg.Rules = new(Rules)
+	app.
+		Flag("logmetrics-rules", "The semicolon separated rules of metrics derived from logs, e.g. counter errors when content~ERROR").
+		Envar("LS_LOGMETRICS_RULES").
+		Default("").SetValue(s.cfg.Rules)
+}
+
+func (s *LogMetrics) Init(params processservice.ProcessorParams) {
+	s.logger = s.logger.With().Str("lambdaName", params.LambdaName).Str("awsRegion", params.AWSRegion).Logger()
+}
+
+func (s *LogMetrics) IsEnable() bool {
+	return len(*s.cfg.Rules) > 0
+}
+
+func (s *LogMetrics) Process(logs []logservice.Log) []logservice.Log {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	processed := make([]logservice.Log, 0, len(logs))
+	for _, log := range logs {
+		if log.Type == logservice.Metric {
+			processed = append(processed, log)
+			continue
+		}
+		// The logs of an invocation are received in order, so the previous invocations are finished
+		if log.RequestID != "" {
+			processed = append(processed, s.flush(func(inv *invocation) bool { return inv.requestID != log.RequestID })...)
+		}
+		s.observe(log)
+		processed = append(processed, log)
+		if log.Type == logservice.PlatformReport {
+			processed = append(processed, s.flush(func(inv *invocation) bool { return inv.requestID == log.RequestID })...)
+		}
+	}
+	return processed
+}
+
+// Flush emits the metrics of the unfinished invocations, e.g. the last one whose platform.report is not received
+// before the shutdown
+func (s *LogMetrics) Flush() []logservice.Log {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush(func(*invocation) bool { return true })
+}
+
+func (s *LogMetrics) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger.Info().Uint64("emitted", s.emitted).Int("unfinished", len(s.pending)).Msg("logmetrics stats")
+}
+
+// observe adds the log to the metrics of the rules it matches
+func (s *LogMetrics) observe(log logservice.Log) {
+	var inv *invocation
+	for _, r := range *s.cfg.Rules {
+		if !r.match.Match(log) {
+			continue
+		}
+		value := 1.0
+		if r.valueField != "" {
+			v, ok := matcher.Field(log.Fields, r.valueField)
+			if !ok {
+				continue
+			}
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+				continue
+			}
+			value = n
+		}
+
+		if inv == nil {
+			inv = s.invocation(log.RequestID)
+		}
+		labels := make(map[string]string, len(r.labels))
+		key := []string{r.name}
+		for _, name := range r.labels {
+			if v, ok := matcher.Field(log.Fields, name); ok {
+				labels[name] = v
+				key = append(key, name+"="+v)
+			}
+		}
+		a := inv.aggregate(r, strings.Join(key, "\xff"), labels)
+		a.observe(value)
+	}
+	if inv != nil {
+		inv.last = log
+	}
+}
+
+// invocation returns the pending invocation of the request id, which is created if it does not exist
+func (s *LogMetrics) invocation(requestID string) *invocation {
+	for _, inv := range s.pending {
+		if inv.requestID == requestID {
+			return inv
+		}
+	}
+	inv := &invocation{requestID: requestID, index: make(map[string]*aggregate)}
+	s.pending = append(s.pending, inv)
+	return inv
+}
+
+// flush emits the metric logs of the pending invocations which are finished
+func (s *LogMetrics) flush(finished func(*invocation) bool) []logservice.Log {
+	var logs []logservice.Log
+	pending := s.pending[:0]
+	for _, inv := range s.pending {
+		if !finished(inv) {
+			pending = append(pending, inv)
+			continue
+		}
+		for _, a := range inv.aggregates {
+			content, err := json.Marshal(a.record())
+			if err != nil {
+				s.logger.Error().Err(err).Str("metric", a.rule.name).Msg("fail to marshal metric")
+				continue
+			}
+			logs = append(logs, logservice.Log{
+				Time:        inv.last.Time,
+				Type:        logservice.Metric,
+				RequestID:   inv.requestID,
+				Content:     content,
+				FunctionArn: inv.last.FunctionArn,
+				Tracing:     inv.last.Tracing,
+				Level:       logservice.InfoLevel,
+				Metadata:    inv.last.Metadata,
+			})
+		}
+	}
+	s.pending = pending
+	s.emitted += uint64(len(logs))
+	return logs
+}
+
+func (inv *invocation) aggregate(r *Rule, key string, labels map[string]string) *aggregate {
+	a, ok := inv.index[key]
+	if !ok {
+		a = &aggregate{rule: r, labels: labels, positions: make(map[float64]int)}
+		inv.index[key] = a
+		inv.aggregates = append(inv.aggregates, a)
+	}
+	return a
+}
+
+func (a *aggregate) observe(value float64) {
+	if a.rule.metricType == Counter {
+		a.value += value
+		return
+	}
+	if a.count == 0 || value < a.min {
+		a.min = value
+	}
+	if a.count == 0 || value > a.max {
+		a.max = value
+	}
+	a.count++
+	a.sum += value
+	if i, ok := a.positions[value]; ok {
+		a.counts[i]++
+		return
+	}
+	a.positions[value] = len(a.values)
+	a.values = append(a.values, value)
+	a.counts = append(a.counts, 1)
+}
+
+func (a *aggregate) record() logservice.MetricRecord {
+	record := logservice.MetricRecord{
+		Name: a.rule.name,
+		Type: a.rule.metricType,
+	}
+	if len(a.labels) > 0 {
+		record.Labels = a.labels
+	}
+	if a.rule.metricType == Counter {
+		record.Value = a.value
+		return record
+	}
+	record.Count = a.count
+	record.Sum = a.sum
+	record.Min = a.min
+	record.Max = a.max
+
+	// The distinct values are sorted
+	order := make([]int, len(a.values))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return a.values[order[i]] < a.values[order[j]] })
+	for _, i := range order {
+		record.Values = append(record.Values, a.values[i])
+		record.Counts = append(record.Counts, a.counts[i])
+	}
+	return record
+}
@@ -0,0 +1,146 @@
+package logmetrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/david7482/lambda-extension-log-shipper/configtest"
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/processservice"
+)
+
+func newLogMetrics(t *testing.T, args ...string) *LogMetrics {
+	s := New()
+	configtest.Parse(t, s.SetupConfigs, args...)
+	s.Init(processservice.ProcessorParams{})
+	return s
+}
+
+func functionLog(requestID string, line string, fields map[string]interface{}) logservice.Log {
+	return logservice.Log{
+		Time:      time.Unix(1600000000, 0),
+		Type:      logservice.Function,
+		RequestID: requestID,
+		Content:   []byte(`"` + line + `"`),
+		Fields:    fields,
+		Metadata:  map[string]interface{}{"env": "prod"},
+	}
+}
+
+func TestLogMetrics_Process(t *testing.T) {
+	s := newLogMetrics(t, "--logmetrics-rules",
+		"counter errors when content~ERROR; histogram latency value=latency_ms by=route; counter bytes value=size")
+	require.True(t, s.IsEnable())
+
+	report := logservice.Log{Type: logservice.PlatformReport, RequestID: "1", Content: []byte(`{"durationMs":1}`)}
+	logs := s.Process([]logservice.Log{
+		functionLog("1", "ERROR fail", nil),
+		functionLog("1", "ok", map[string]interface{}{"latency_ms": float64(30), "route": "/orders"}),
+		functionLog("1", "ok", map[string]interface{}{"latency_ms": float64(10), "route": "/orders"}),
+		functionLog("1", "ok", map[string]interface{}{"latency_ms": float64(30), "route": "/orders"}),
+		functionLog("1", "ok", map[string]interface{}{"latency_ms": "5", "route": "/users"}),
+		functionLog("1", "ERROR fail again", map[string]interface{}{"latency_ms": "slow"}),
+		report,
+	})
+	require.Len(t, logs, 10)
+	assert.Equal(t, report, logs[6])
+
+	var contents []string
+	for _, log := range logs[7:] {
+		assert.Equal(t, logservice.Metric, log.Type)
+		assert.Equal(t, "1", log.RequestID)
+		assert.Equal(t, logservice.InfoLevel, log.Level)
+		assert.Equal(t, time.Unix(1600000000, 0), log.Time)
+		assert.Equal(t, "prod", log.Metadata["env"])
+		contents = append(contents, string(log.Content))
+	}
+	assert.Equal(t, []string{
+		`{"name":"errors","type":"counter","value":2}`,
+		`{"name":"latency","type":"histogram","labels":{"route":"/orders"},"count":3,"sum":70,"min":10,"max":30,"values":[10,30],"counts":[1,2]}`,
+		`{"name":"latency","type":"histogram","labels":{"route":"/users"},"count":1,"sum":5,"min":5,"max":5,"values":[5],"counts":[1]}`,
+	}, contents)
+
+	// Metrics are not emitted again, and logs without matches create no metrics
+	logs = s.Process([]logservice.Log{functionLog("2", "ok", nil)})
+	assert.Len(t, logs, 1)
+	assert.Empty(t, s.pending)
+}
+
+func TestLogMetrics_Process_withoutReport(t *testing.T) {
+	s := newLogMetrics(t, "--logmetrics-rules", "counter bytes value=size by=user.id")
+
+	logs := s.Process([]logservice.Log{
+		functionLog("", "init", map[string]interface{}{"size": float64(1)}),
+		functionLog("1", "a", map[string]interface{}{"size": float64(2), "user": map[string]interface{}{"id": "u1"}}),
+	})
+	require.Len(t, logs, 3)
+	assert.Equal(t, logservice.Metric, logs[1].Type)
+	assert.Equal(t, "", logs[1].RequestID)
+	assert.Equal(t, `{"name":"bytes","type":"counter","value":1}`, string(logs[1].Content))
+
+	// The invocation is finished by the logs of the next invocation, which could be in another batch
+	logs = s.Process([]logservice.Log{
+		functionLog("1", "b", map[string]interface{}{"size": float64(3), "user": map[string]interface{}{"id": "u1"}}),
+	})
+	require.Len(t, logs, 1)
+	logs = s.Process([]logservice.Log{functionLog("2", "c", nil)})
+	require.Len(t, logs, 2)
+	assert.Equal(t, `{"name":"bytes","type":"counter","labels":{"user.id":"u1"},"value":5}`, string(logs[0].Content))
+	assert.Equal(t, "1", logs[0].RequestID)
+
+	// Metric logs are passed through
+	logs = s.Process(logs[:1])
+	assert.Len(t, logs, 1)
+	assert.Empty(t, s.pending)
+}
+
+func TestLogMetrics_Flush(t *testing.T) {
+	s := newLogMetrics(t, "--logmetrics-rules", "counter errors when content~ERROR")
+	var _ processservice.Flusher = s
+
+	// The last invocation is shutdown before its platform.report is received
+	logs := s.Process([]logservice.Log{functionLog("1", "ERROR fail", nil)})
+	require.Len(t, logs, 1)
+	logs = s.Flush()
+	require.Len(t, logs, 1)
+	assert.Equal(t, logservice.Metric, logs[0].Type)
+	assert.Equal(t, "1", logs[0].RequestID)
+	assert.Equal(t, `{"name":"errors","type":"counter","value":1}`, string(logs[0].Content))
+	assert.Empty(t, s.pending)
+	assert.Empty(t, s.Flush())
+}
+
+func TestParseRule(t *testing.T) {
+	r, err := ParseRule(" histogram latency value=latency_ms by=route,status when type=function && field.route~^/orders ")
+	require.NoError(t, err)
+	assert.Equal(t, Histogram, r.metricType)
+	assert.Equal(t, "latency", r.name)
+	assert.Equal(t, "latency_ms", r.valueField)
+	assert.Equal(t, []string{"route", "status"}, r.labels)
+	assert.Equal(t, "type=function && field.route~^/orders", r.match.String())
+
+	r, err = ParseRule("counter errors")
+	require.NoError(t, err)
+	assert.Equal(t, defaultMatch, r.match.String())
+
+	for _, expr := range []string{
+		"counter",
+		"gauge errors",
+		"counter 1errors",
+		"histogram latency",
+		"counter errors label=route",
+		"counter errors value",
+		"counter errors when unknown=1",
+	} {
+		_, err := ParseRule(expr)
+		assert.Error(t, err, expr)
+	}
+
+	var rules Rules
+	assert.Error(t, rules.Set("counter errors; counter errors when level>=error"))
+	require.NoError(t, rules.Set("counter errors; ; counter warnings when level=warn"))
+	assert.Equal(t, "counter errors; counter warnings when level=warn", rules.String())
+}
@@ -0,0 +1,132 @@
+package logmetrics
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/david7482/lambda-extension-log-shipper/matcher"
+	"github.com/david7482/lambda-extension-log-shipper/utils"
+)
+
+// Types of metrics
+const (
+	// Counter counts the matched logs, or sums the values of the value field
+	Counter = "counter"
+	// Histogram keeps the distribution of the values of the value field
+	Histogram = "histogram"
+)
+
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.:-]*$`)
+
+// defaultMatch is the match expression of rules without `when`
+const defaultMatch = "type=function"
+
+// Rule derives a metric from the logs which match the expression. The expression is
+//
+//	<type> <name> [value=<field>] [by=<field>,<field>] [when <match expression>]
+//
+// e.g. `counter errors when content~ERROR` or `histogram latency value=latency_ms by=route when type=function`.
+// The match expression is the syntax of package matcher, and it is `type=function` if it is not set.
+type Rule struct {
+	expr       string
+	metricType string
+	name       string
+	valueField string
+	labels     []string
+	match      *matcher.Matcher
+}
+
+// ParseRule compiles the rule expression
+func ParseRule(expr string) (*Rule, error) {
+	r, err := parseRule(strings.TrimSpace(expr))
+	if err != nil {
+		return nil, fmt.Errorf("logmetrics: invalid rule %q: %w", strings.TrimSpace(expr), err)
+	}
+	return r, nil
+}
+
+func parseRule(expr string) (*Rule, error) {
+	r := &Rule{expr: expr}
+
+	head, when := expr, defaultMatch
+	if i := strings.Index(expr, " when "); i >= 0 {
+		head, when = expr[:i], strings.TrimSpace(expr[i+len(" when "):])
+	}
+	m, err := matcher.Parse(when)
+	if err != nil {
+		return nil, err
+	}
+	r.match = m
+
+	tokens := strings.Fields(head)
+	if len(tokens) < 2 {
+		return nil, fmt.Errorf("expect <type> <name>")
+	}
+	r.metricType, r.name = tokens[0], tokens[1]
+	if r.metricType != Counter && r.metricType != Histogram {
+		return nil, fmt.Errorf("unknown metric type %q", r.metricType)
+	}
+	if !metricNameRegexp.MatchString(r.name) {
+		return nil, fmt.Errorf("invalid metric name %q", r.name)
+	}
+	for _, token := range tokens[2:] {
+		kv := strings.SplitN(token, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("unexpected %q", token)
+		}
+		switch kv[0] {
+		case "value":
+			r.valueField = kv[1]
+		case "by":
+			r.labels = utils.SplitList(kv[1])
+		default:
+			return nil, fmt.Errorf("unknown option %q", kv[0])
+		}
+	}
+	if r.metricType == Histogram && r.valueField == "" {
+		return nil, fmt.Errorf("histogram requires the value field")
+	}
+	return r, nil
+}
+
+func (r *Rule) String() string {
+	return r.expr
+}
+
+// Rules is a `;` separated list of rules. It implements kingpin.Value so that it could be used as a flag.
+type Rules []*Rule
+
+func (l *Rules) Set(value string) error {
+	var list Rules
+	names := make(map[string]bool)
+	for _, expr := range strings.Split(value, ";") {
+		if strings.TrimSpace(expr) == "" {
+			continue
+		}
+		r, err := ParseRule(expr)
+		if err != nil {
+			return err
+		}
+		if names[r.name] {
+			return fmt.Errorf("logmetrics: duplicated metric name %q", r.name)
+		}
+		names[r.name] = true
+		list = append(list, r)
+	}
+	*l = list
+	return nil
+}
+
+func (l *Rules) String() string {
+	var exprs []string
+	for _, r := range *l {
+		exprs = append(exprs, r.String())
+	}
+	return strings.Join(exprs, "; ")
+}
+
+// ListSeparator returns the separator of the items in the config file
+func (l *Rules) ListSeparator() string {
+	return "; "
+}
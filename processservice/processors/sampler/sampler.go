@@ -0,0 +1,163 @@
+package sampler
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/processservice"
+	"github.com/david7482/lambda-extension-log-shipper/utils"
+)
+
+// Sampler keeps a part of the function logs below warn by their level. Platform logs and function logs of
+// warn or above are always kept. With per-request sampling, all or none of the logs of an invocation are kept.
+type Sampler struct {
+	cfg    config
+	logger zerolog.Logger
+
+	mu      sync.Mutex
+	random  *rand.Rand
+	kept    uint64
+	dropped uint64
+}
+
+type config struct {
+	Rates      *levelRates
+	PerRequest *bool
+}
+
+func New() *Sampler {
+	return &Sampler{
+		logger: zerolog.New(os.Stdout).With().Str("processor", "sampler").Timestamp().Logger(),
+		random: rand.New(rand.NewSource(time.Now().UnixNano())), //nolint:gosec
+	}
+}
+
+func (s *Sampler) Name() string {
+	return "sampler"
+}
+
+func (s *Sampler) SetupConfigs(app *kingpin.Application) {
+	s.cfg.Rates = new(levelRates)
+	app.
+		Flag("sampler-rates", "The comma separated sample rates of function logs by level, e.g. debug=0.1,info=0.5").
+		Envar("LS_SAMPLER_RATES").
+		Default("").SetValue(s.cfg.Rates)
+	s.cfg.PerRequest = app.
+		Flag("sampler-per-request", "Keep all or none of the logs of an invocation based on the hash of its request id").
+		Envar("LS_SAMPLER_PER_REQUEST").
+		Default("true").Bool()
+}
+
+func (s *Sampler) Init(params processservice.ProcessorParams) {
+	s.logger = s.logger.With().Str("lambdaName", params.LambdaName).Str("awsRegion", params.AWSRegion).Logger()
+}
+
+func (s *Sampler) IsEnable() bool {
+	return len(*s.cfg.Rates) > 0
+}
+
+func (s *Sampler) Process(logs []logservice.Log) []logservice.Log {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sampled := make([]logservice.Log, 0, len(logs))
+	for _, log := range logs {
+		rate, ok := s.rate(log)
+		if !ok {
+			sampled = append(sampled, log)
+			continue
+		}
+		if s.score(log) >= rate {
+			s.dropped++
+			continue
+		}
+		s.kept++
+		log.SampleRate = rate
+		sampled = append(sampled, log)
+	}
+	return sampled
+}
+
+func (s *Sampler) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger.Info().Uint64("kept", s.kept).Uint64("dropped", s.dropped).Msg("sampler stats")
+}
+
+// rate returns the sample rate of the log, or false if the log is always kept
+func (s *Sampler) rate(log logservice.Log) (float64, bool) {
+	if log.Type != logservice.Function || log.Level >= logservice.WarnLevel {
+		return 0, false
+	}
+	rate, ok := (*s.cfg.Rates)[log.Level]
+	if !ok || rate >= 1 {
+		return 0, false
+	}
+	return rate, true
+}
+
+// score returns a number in [0, 1); the log is kept if it is less than the sample rate.
+// With per-request sampling, the score is the same for all logs of an invocation.
+func (s *Sampler) score(log logservice.Log) float64 {
+	if *s.cfg.PerRequest && log.RequestID != "" {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(log.RequestID))
+		// mix the bits so that similar request ids are spread uniformly
+		x := h.Sum64()
+		x ^= x >> 33
+		x *= 0xff51afd7ed558ccd
+		x ^= x >> 33
+		x *= 0xc4ceb9fe1a85ec53
+		x ^= x >> 33
+		return float64(x>>11) / float64(1<<53)
+	}
+	return s.random.Float64()
+}
+
+// levelRates is the comma separated sample rates by level, e.g. debug=0.1,info=0.5. It implements kingpin.Value.
+type levelRates map[logservice.Level]float64
+
+func (r *levelRates) Set(value string) error {
+	rates := make(levelRates)
+	for _, item := range utils.SplitList(value) {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("sampler: invalid rate %q, expect level=rate", item)
+		}
+		lvl, err := logservice.ParseLevel(kv[0])
+		if err != nil {
+			return err
+		}
+		if lvl >= logservice.WarnLevel {
+			return fmt.Errorf("sampler: logs of %s level are always kept", lvl)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || math.IsNaN(rate) || rate < 0 || rate > 1 {
+			return fmt.Errorf("sampler: invalid rate %q, expect a number between 0 and 1", kv[1])
+		}
+		rates[lvl] = rate
+	}
+	*r = rates
+	return nil
+}
+
+func (r *levelRates) String() string {
+	var items []string
+	for _, lvl := range []logservice.Level{logservice.TraceLevel, logservice.DebugLevel, logservice.InfoLevel} {
+		if rate, ok := (*r)[lvl]; ok {
+			items = append(items, fmt.Sprintf("%s=%g", lvl, rate))
+		}
+	}
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,71 @@
+package sampler
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/david7482/lambda-extension-log-shipper/configtest"
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/processservice"
+)
+
+func newSampler(t *testing.T, args ...string) *Sampler {
+	s := New()
+	configtest.Parse(t, s.SetupConfigs, args...)
+	s.Init(processservice.ProcessorParams{})
+	return s
+}
+
+func TestSampler_Process(t *testing.T) {
+	s := newSampler(t, "--sampler-rates=debug=0,info=0.5")
+	require.True(t, s.IsEnable())
+
+	var logs []logservice.Log
+	for i := 0; i < 1000; i++ {
+		requestID := fmt.Sprintf("request-%d", i)
+		logs = append(logs,
+			logservice.Log{Type: logservice.Function, RequestID: requestID, Level: logservice.DebugLevel},
+			logservice.Log{Type: logservice.Function, RequestID: requestID, Level: logservice.InfoLevel},
+			logservice.Log{Type: logservice.Function, RequestID: requestID, Level: logservice.InfoLevel},
+			logservice.Log{Type: logservice.Function, RequestID: requestID, Level: logservice.ErrorLevel},
+			logservice.Log{Type: logservice.PlatformReport, RequestID: requestID, Level: logservice.InfoLevel},
+		)
+	}
+
+	infos := make(map[string]int)
+	var errors, reports int
+	for _, log := range s.Process(logs) {
+		switch {
+		case log.Type == logservice.PlatformReport:
+			reports++
+			assert.Zero(t, log.SampleRate)
+		case log.Level == logservice.ErrorLevel:
+			errors++
+			assert.Zero(t, log.SampleRate)
+		case log.Level == logservice.InfoLevel:
+			infos[log.RequestID]++
+			assert.Equal(t, 0.5, log.SampleRate)
+		default:
+			t.Errorf("unexpected log of %s level", log.Level)
+		}
+	}
+	assert.Equal(t, 1000, errors)
+	assert.Equal(t, 1000, reports)
+	assert.InDelta(t, 500, len(infos), 75)
+	for requestID, n := range infos {
+		assert.Equal(t, 2, n, "all or none of the logs of %s are kept", requestID)
+	}
+}
+
+func TestLevelRates_Set(t *testing.T) {
+	var r levelRates
+	require.NoError(t, r.Set("debug=0.1, info=0.5"))
+	assert.Equal(t, "debug=0.1,info=0.5", r.String())
+
+	for _, value := range []string{"info", "info=2", "info=x", "loud=0.1", "error=0.5"} {
+		assert.Error(t, r.Set(value), value)
+	}
+}
@@ -0,0 +1,467 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/matcher"
+)
+
+// opName is the name of a transform operation
+type opName string
+
+const (
+	opSet        opName = "set"
+	opRename     opName = "rename"
+	opDelete     opName = "delete"
+	opCopy       opName = "copy"
+	opParseJSON  opName = "parse_json"
+	opParseRegex opName = "parse_regex"
+	opLowercase  opName = "lowercase"
+	opTruncate   opName = "truncate"
+	opDuration   opName = "duration"
+)
+
+const (
+	keyContent     = "content"
+	fieldPrefix    = "field."
+	metadataPrefix = "metadata."
+)
+
+// durationUnits are the units of the duration operation
+var durationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// refRegexp matches the references of a set value, e.g. `${metadata.env}`
+var refRegexp = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// Operation is a single step of the transformation, e.g. `rename field.msg field.message`
+type Operation struct {
+	expr   string
+	name   opName
+	source string
+	target string
+	value  string
+	regex  *regexp.Regexp
+	limit  int
+	unit   time.Duration
+}
+
+// ParseOperation compiles the operation expression. The syntax is `<op> <args>`:
+//
+//	set <target> <value>          the value could reference other keys, e.g. ${metadata.env}
+//	rename <field> <field>
+//	delete <field>
+//	copy <source> <target>
+//	parse_json <source> [<field>]  merge the JSON object into the fields, or put it into the field
+//	parse_regex <source> <regex>   put the named groups of the regex into the fields
+//	lowercase <target>
+//	truncate <target> <length>
+//	duration <field> <unit>        convert a duration string, e.g. 1m30s, into a number of the unit (ns, us, ms, s, m, h)
+//
+// The target is content or field.<name>. The source could also be type, level, requestId or metadata.<name>.
+func ParseOperation(expr string) (*Operation, error) {
+	op := &Operation{expr: strings.TrimSpace(expr)}
+	name, rest := cut(op.expr)
+	op.name = opName(name)
+
+	var err error
+	switch op.name {
+	case opSet:
+		op.target, op.value = cut(rest)
+		err = validateTarget(op.target)
+		if err == nil {
+			for _, ref := range refRegexp.FindAllStringSubmatch(op.value, -1) {
+				if err = validateSource(ref[1]); err != nil {
+					break
+				}
+			}
+		}
+	case opRename, opCopy:
+		var extra string
+		op.source, rest = cut(rest)
+		op.target, extra = cut(rest)
+		switch {
+		case extra != "":
+			err = fmt.Errorf("unexpected %q", extra)
+		case op.name == opRename:
+			if err = validateField(op.source); err == nil {
+				err = validateField(op.target)
+			}
+		default:
+			if err = validateSource(op.source); err == nil {
+				err = validateTarget(op.target)
+			}
+		}
+	case opDelete:
+		err = validateArgs(rest, 1)
+		op.target = rest
+		if err == nil {
+			err = validateField(op.target)
+		}
+	case opParseJSON:
+		op.source, op.target = cut(rest)
+		err = validateSource(op.source)
+		if err == nil && op.target != "" {
+			err = validateField(op.target)
+		}
+	case opParseRegex:
+		op.source, op.value = cut(rest)
+		if err = validateSource(op.source); err == nil {
+			op.regex, err = regexp.Compile(op.value)
+		}
+		if err == nil && !hasNamedGroup(op.regex) {
+			err = fmt.Errorf("regex %q has no named group", op.value)
+		}
+	case opLowercase:
+		err = validateArgs(rest, 1)
+		op.target = rest
+		if err == nil {
+			err = validateTarget(op.target)
+		}
+	case opTruncate:
+		var length string
+		op.target, length = cut(rest)
+		if err = validateTarget(op.target); err == nil {
+			op.limit, err = strconv.Atoi(length)
+			if err == nil && op.limit <= 0 {
+				err = fmt.Errorf("length %d is not positive", op.limit)
+			}
+		}
+	case opDuration:
+		var unit string
+		op.target, unit = cut(rest)
+		if err = validateField(op.target); err == nil {
+			var ok bool
+			if op.unit, ok = durationUnits[unit]; !ok {
+				err = fmt.Errorf("unknown unit %q, expect one of ns, us, ms, s, m, h", unit)
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown operation %q", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("transform: invalid operation %q: %w", expr, err)
+	}
+	return op, nil
+}
+
+// cut splits the first word from the rest of s
+func cut(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i+1:])
+	}
+	return s, ""
+}
+
+func hasNamedGroup(re *regexp.Regexp) bool {
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func validateArgs(rest string, n int) error {
+	if got := len(strings.Fields(rest)); got != n {
+		return fmt.Errorf("expect %d argument(s) but got %d", n, got)
+	}
+	return nil
+}
+
+func validateField(key string) error {
+	if !strings.HasPrefix(key, fieldPrefix) || len(key) == len(fieldPrefix) {
+		return fmt.Errorf("%q is not a field", key)
+	}
+	return nil
+}
+
+func validateTarget(key string) error {
+	if key == keyContent {
+		return nil
+	}
+	return validateField(key)
+}
+
+func validateSource(key string) error {
+	switch {
+	case key == "type", key == "level", key == "requestId":
+		return nil
+	case strings.HasPrefix(key, metadataPrefix) && len(key) > len(metadataPrefix):
+		return nil
+	}
+	return validateTarget(key)
+}
+
+func (op *Operation) String() string {
+	return op.expr
+}
+
+// apply runs the operation on the log. It returns false if the operation could not be applied, e.g. the source is
+// missing or is not a JSON object. The fields of the log should be owned by the caller.
+func (op *Operation) apply(log *logservice.Log) bool {
+	switch op.name {
+	case opSet:
+		value, ok := op.interpolate(*log)
+		return ok && set(log, op.target, value)
+	case opRename:
+		value, ok := get(*log, op.source)
+		if !ok {
+			return false
+		}
+		deleteField(log.Fields, strings.TrimPrefix(op.source, fieldPrefix))
+		return set(log, op.target, value)
+	case opDelete:
+		return deleteField(log.Fields, strings.TrimPrefix(op.target, fieldPrefix))
+	case opCopy:
+		value, ok := get(*log, op.source)
+		return ok && set(log, op.target, copyValue(value))
+	case opParseJSON:
+		value, ok := get(*log, op.source)
+		s, isString := value.(string)
+		if !ok || !isString {
+			return false
+		}
+		var parsed map[string]interface{}
+		if err := json.Unmarshal([]byte(strings.TrimSpace(s)), &parsed); err != nil {
+			return false
+		}
+		if op.target != "" {
+			return set(log, op.target, parsed)
+		}
+		for k, v := range parsed {
+			setField(log, k, v)
+		}
+		return true
+	case opParseRegex:
+		value, ok := get(*log, op.source)
+		if !ok {
+			return false
+		}
+		m := op.regex.FindStringSubmatch(format(value))
+		if m == nil {
+			return false
+		}
+		for i, name := range op.regex.SubexpNames() {
+			if name != "" {
+				setField(log, name, m[i])
+			}
+		}
+		return true
+	case opLowercase:
+		value, ok := get(*log, op.target)
+		s, isString := value.(string)
+		return ok && isString && set(log, op.target, strings.ToLower(s))
+	case opTruncate:
+		value, ok := get(*log, op.target)
+		s, isString := value.(string)
+		if !ok || !isString {
+			return false
+		}
+		if len(s) > op.limit {
+			// do not split a multi-byte character
+			n := op.limit
+			for n > 0 && !utf8.RuneStart(s[n]) {
+				n--
+			}
+			s = s[:n]
+		}
+		return set(log, op.target, s)
+	case opDuration:
+		value, ok := get(*log, op.target)
+		s, isString := value.(string)
+		if !ok || !isString {
+			return false
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil {
+			return false
+		}
+		return set(log, op.target, float64(d)/float64(op.unit))
+	}
+	return false
+}
+
+// interpolate replaces the references of the set value. If the value is a single reference, its type is kept.
+func (op *Operation) interpolate(log logservice.Log) (interface{}, bool) {
+	if m := refRegexp.FindStringSubmatch(op.value); m != nil && m[0] == op.value {
+		return get(log, m[1])
+	}
+	return refRegexp.ReplaceAllStringFunc(op.value, func(ref string) string {
+		value, _ := get(log, ref[2:len(ref)-1])
+		return format(value)
+	}), true
+}
+
+// get returns the value of the key from the log
+func get(log logservice.Log, key string) (interface{}, bool) {
+	switch {
+	case key == "type":
+		return string(log.Type), true
+	case key == "level":
+		return log.Level.String(), true
+	case key == "requestId":
+		return log.RequestID, log.RequestID != ""
+	case key == keyContent:
+		if log.Type != logservice.Function {
+			return string(log.Content), true
+		}
+		return log.Line(), true
+	case strings.HasPrefix(key, metadataPrefix):
+		v, ok := log.Metadata[strings.TrimPrefix(key, metadataPrefix)]
+		return v, ok
+	}
+	return matcher.LookupField(log.Fields, strings.TrimPrefix(key, fieldPrefix))
+}
+
+// set writes the value into the content or field of the log. Only the content of function logs could be set.
+func set(log *logservice.Log, key string, value interface{}) bool {
+	if key == keyContent {
+		if log.Type != logservice.Function {
+			return false
+		}
+		log.Content, _ = json.Marshal(format(value))
+		return true
+	}
+	setField(log, strings.TrimPrefix(key, fieldPrefix), value)
+	return true
+}
+
+// setField writes the value into the existing nested field of the name, or the top-level field of the name
+func setField(log *logservice.Log, name string, value interface{}) {
+	if log.Fields == nil {
+		log.Fields = make(map[string]interface{})
+	}
+	fields := log.Fields
+	for {
+		if _, ok := fields[name]; ok {
+			break
+		}
+		// e.g. http.status => fields["http"]["status"]
+		parts := strings.SplitN(name, ".", 2)
+		nested, ok := fields[parts[0]].(map[string]interface{})
+		if len(parts) != 2 || !ok {
+			break
+		}
+		fields, name = nested, parts[1]
+	}
+	fields[name] = value
+}
+
+func deleteField(fields map[string]interface{}, name string) bool {
+	if _, ok := fields[name]; ok {
+		delete(fields, name)
+		return true
+	}
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	nested, ok := fields[parts[0]].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	return deleteField(nested, parts[1])
+}
+
+// copyValue deep copies the maps and slices of structured fields, so that the copies could be modified separately
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = copyValue(item)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, item := range v {
+			a[i] = copyValue(item)
+		}
+		return a
+	default:
+		return v
+	}
+}
+
+func format(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(v)
+		return string(b)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Operations is the semicolon separated operations, where `\;` is a semicolon within an operation, e.g. of a regex.
+// It implements kingpin.Value.
+type Operations []*Operation
+
+func (l *Operations) Set(value string) error {
+	var list Operations
+	for _, expr := range splitOperations(value) {
+		if strings.TrimSpace(expr) == "" {
+			continue
+		}
+		op, err := ParseOperation(expr)
+		if err != nil {
+			return err
+		}
+		list = append(list, op)
+	}
+	*l = list
+	return nil
+}
+
+func (l *Operations) String() string {
+	var exprs []string
+	for _, op := range *l {
+		exprs = append(exprs, strings.ReplaceAll(op.String(), ";", `\;`))
+	}
+	return strings.Join(exprs, "; ")
+}
+
+// ListSeparator returns the separator of the items in the config file
+func (l *Operations) ListSeparator() string {
+	return "; "
+}
+
+// splitOperations splits the value by the semicolons which are not escaped, and unescapes the others
+func splitOperations(value string) []string {
+	var exprs []string
+	var expr strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '\\' && i+1 < len(value) && value[i+1] == ';':
+			expr.WriteByte(';')
+			i++
+		case value[i] == ';':
+			exprs = append(exprs, expr.String())
+			expr.Reset()
+		default:
+			expr.WriteByte(value[i])
+		}
+	}
+	return append(exprs, expr.String())
+}
@@ -0,0 +1,83 @@
+package transform
+
+import (
+	"os"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/processservice"
+)
+
+// Transform applies the ordered operations to the content and structured fields of each log
+type Transform struct {
+	cfg    config
+	logger zerolog.Logger
+
+	mu     sync.Mutex
+	failed []uint64
+}
+
+type config struct {
+	Operations *Operations
+}
+
+func New() *Transform {
+	return &Transform{
+		logger: zerolog.New(os.Stdout).With().Str("processor", "transform").Timestamp().Logger(),
+	}
+}
+
+func (t *Transform) Name() string {
+	return "transform"
+}
+
+func (t *Transform) SetupConfigs(app *kingpin.Application) {
+	t.cfg.Operations = new(Operations)
+	app.
+		Flag("transform-operations", "The semicolon separated operations applied to each log in order, e.g. rename field.msg field.message; delete field.password").
+		Envar("LS_TRANSFORM_OPERATIONS").
+		Default("").SetValue(t.cfg.Operations)
+}
+
+func (t *Transform) Init(params processservice.ProcessorParams) {
+	t.failed = make([]uint64, len(*t.cfg.Operations))
+	t.logger = t.logger.With().Str("lambdaName", params.LambdaName).Str("awsRegion", params.AWSRegion).Logger()
+}
+
+func (t *Transform) IsEnable() bool {
+	return len(*t.cfg.Operations) > 0
+}
+
+func (t *Transform) Process(logs []logservice.Log) []logservice.Log {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	transformed := make([]logservice.Log, len(logs))
+	for i, log := range logs {
+		// The fields are copied since the operations modify them in place
+		if log.Fields != nil {
+			log.Fields = copyValue(log.Fields).(map[string]interface{})
+		}
+		for j, op := range *t.cfg.Operations {
+			if !op.apply(&log) {
+				t.failed[j]++
+			}
+		}
+		transformed[i] = log
+	}
+	return transformed
+}
+
+func (t *Transform) Shutdown() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	failed := zerolog.Dict()
+	for i, op := range *t.cfg.Operations {
+		failed = failed.Uint64(op.String(), t.failed[i])
+	}
+	t.logger.Info().Dict("notApplied", failed).Msg("transform stats")
+}
@@ -0,0 +1,207 @@
+package transform
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/processservice"
+)
+
+func TestTransform_Process(t *testing.T) {
+	log := logservice.Log{
+		Type:      logservice.Function,
+		RequestID: "6f7f0961-f834-4211-8a7a-f6fe80b88d56",
+		Content:   []byte(`"{\"msg\":\"GET /users 200\",\"password\":\"secret\"}"`),
+		Level:     logservice.InfoLevel,
+		Fields: map[string]interface{}{
+			"msg":      "GET /users 200",
+			"password": "secret",
+			"http":     map[string]interface{}{"status": float64(200)},
+		},
+		Metadata: map[string]interface{}{"env": "prod"},
+	}
+	tests := []struct {
+		name       string
+		operations string
+		wantFields map[string]interface{}
+		wantLine   string
+	}{
+		{
+			name:       "Set, rename and delete",
+			operations: "set field.env ${metadata.env}; rename field.msg field.message; delete field.password",
+			wantFields: map[string]interface{}{
+				"env":     "prod",
+				"message": "GET /users 200",
+				"http":    map[string]interface{}{"status": float64(200)},
+			},
+		},
+		{
+			name:       "Set with references",
+			operations: "set field.summary ${level}: ${field.http.status} of ${field.missing}; set field.http.ok true",
+			wantFields: map[string]interface{}{
+				"msg":      "GET /users 200",
+				"password": "secret",
+				"http":     map[string]interface{}{"status": float64(200), "ok": "true"},
+				"summary":  "info: 200 of ",
+			},
+		},
+		{
+			name:       "Copy and parse regex",
+			operations: "copy requestId field.request.id; parse_regex field.msg ^(?P<method>[A-Z]+) (?P<path>\\S+)",
+			wantFields: map[string]interface{}{
+				"msg":        "GET /users 200",
+				"password":   "secret",
+				"http":       map[string]interface{}{"status": float64(200)},
+				"request.id": "6f7f0961-f834-4211-8a7a-f6fe80b88d56",
+				"method":     "GET",
+				"path":       "/users",
+			},
+		},
+		{
+			name:       "Lift message out of the JSON log",
+			operations: "parse_json content field.raw; copy field.raw.msg content; lowercase content; truncate content 9",
+			wantFields: map[string]interface{}{
+				"msg":      "GET /users 200",
+				"password": "secret",
+				"http":     map[string]interface{}{"status": float64(200)},
+				"raw":      map[string]interface{}{"msg": "GET /users 200", "password": "secret"},
+			},
+			wantLine: "get /user",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transform := New()
+			transform.cfg.Operations = new(Operations)
+			require.NoError(t, transform.cfg.Operations.Set(tt.operations))
+			transform.Init(processservice.ProcessorParams{})
+
+			logs := transform.Process([]logservice.Log{log})
+			require.Len(t, logs, 1)
+			assert.Equal(t, tt.wantFields, logs[0].Fields)
+			if tt.wantLine != "" {
+				assert.Equal(t, tt.wantLine, logs[0].Line())
+			}
+			// the original log is not modified
+			assert.Equal(t, "secret", log.Fields["password"])
+			assert.Equal(t, map[string]interface{}{"status": float64(200)}, log.Fields["http"])
+		})
+	}
+}
+
+func TestOperation_apply(t *testing.T) {
+	tests := []struct {
+		name        string
+		operation   string
+		log         logservice.Log
+		wantApplied bool
+		wantLog     logservice.Log
+	}{
+		{
+			name:        "Parse JSON into fields",
+			operation:   `parse_json content`,
+			log:         logservice.Log{Type: logservice.Function, Content: []byte(`"{\"a\":1}"`)},
+			wantApplied: true,
+			wantLog: logservice.Log{
+				Type: logservice.Function, Content: []byte(`"{\"a\":1}"`), Fields: map[string]interface{}{"a": float64(1)},
+			},
+		},
+		{
+			name:      "Parse JSON of plain text",
+			operation: `parse_json content`,
+			log:       logservice.Log{Type: logservice.Function, Content: []byte(`"plain text"`)},
+			wantLog:   logservice.Log{Type: logservice.Function, Content: []byte(`"plain text"`)},
+		},
+		{
+			name:      "Content of platform logs is not modified",
+			operation: `set content replaced`,
+			log:       logservice.Log{Type: logservice.PlatformReport, Content: []byte(`{}`)},
+			wantLog:   logservice.Log{Type: logservice.PlatformReport, Content: []byte(`{}`)},
+		},
+		{
+			name:      "Delete missing field",
+			operation: `delete field.missing`,
+			log:       logservice.Log{Type: logservice.Function, Fields: map[string]interface{}{"a": "b"}},
+			wantLog:   logservice.Log{Type: logservice.Function, Fields: map[string]interface{}{"a": "b"}},
+		},
+		{
+			name:        "Truncate multi-byte characters",
+			operation:   `truncate field.a 4`,
+			log:         logservice.Log{Type: logservice.Function, Fields: map[string]interface{}{"a": "a日本"}},
+			wantApplied: true,
+			wantLog:     logservice.Log{Type: logservice.Function, Fields: map[string]interface{}{"a": "a日"}},
+		},
+		{
+			name:        "Convert a nested duration",
+			operation:   `duration field.http.latency ms`,
+			log:         logservice.Log{Type: logservice.Function, Fields: map[string]interface{}{"http": map[string]interface{}{"latency": "1.5s"}}},
+			wantApplied: true,
+			wantLog:     logservice.Log{Type: logservice.Function, Fields: map[string]interface{}{"http": map[string]interface{}{"latency": float64(1500)}}},
+		},
+		{
+			name:      "Convert an invalid duration",
+			operation: `duration field.a s`,
+			log:       logservice.Log{Type: logservice.Function, Fields: map[string]interface{}{"a": "soon"}},
+			wantLog:   logservice.Log{Type: logservice.Function, Fields: map[string]interface{}{"a": "soon"}},
+		},
+		{
+			name:      "Lowercase a number",
+			operation: `lowercase field.a`,
+			log:       logservice.Log{Type: logservice.Function, Fields: map[string]interface{}{"a": float64(1)}},
+			wantLog:   logservice.Log{Type: logservice.Function, Fields: map[string]interface{}{"a": float64(1)}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op, err := ParseOperation(tt.operation)
+			require.NoError(t, err)
+
+			log := tt.log
+			assert.Equal(t, tt.wantApplied, op.apply(&log))
+			assert.Equal(t, tt.wantLog, log)
+		})
+	}
+}
+
+func TestParseOperation_invalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"upper field.a",
+		"set message hello",
+		"set field.a ${unknown}",
+		"rename content field.a",
+		"rename field.a field.b field.c",
+		"delete field.a field.b",
+		"copy field.a metadata.a",
+		"parse_json field.a content",
+		"parse_regex content ^(\\w+)$",
+		"parse_regex content (?P<a>",
+		"truncate field.a",
+		"truncate field.a 0",
+		"duration content ms",
+		"duration field.a days",
+	} {
+		_, err := ParseOperation(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestOperations_Set_escapedSemicolon(t *testing.T) {
+	var ops Operations
+	require.NoError(t, ops.Set(`parse_regex content ^(?P<key>\w+)\;(?P<value>\w+)$; set field.sep \;`))
+	require.Len(t, ops, 2)
+
+	log := logservice.Log{Type: logservice.Function, Content: []byte(`"color;blue"`)}
+	for _, op := range ops {
+		require.True(t, op.apply(&log))
+	}
+	assert.Equal(t, map[string]interface{}{"key": "color", "value": "blue", "sep": ";"}, log.Fields)
+
+	// the escaped semicolons are kept, so that the operations could be parsed again
+	var again Operations
+	require.NoError(t, again.Set(ops.String()))
+	assert.Equal(t, ops.String(), again.String())
+}
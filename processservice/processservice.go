@@ -0,0 +1,157 @@
+package processservice
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/emf"
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/metrics"
+)
+
+type ProcessorParams struct {
+	LambdaName      string
+	AWSRegion       string
+	FunctionVersion string
+	Handler         string
+}
+
+type Processor interface {
+	Name() string
+	SetupConfigs(app *kingpin.Application)
+	Init(params ProcessorParams)
+	IsEnable() bool
+	Process([]logservice.Log) []logservice.Log
+	Shutdown()
+}
+
+// Flusher is implemented by processors which keep logs until the later logs arrive, e.g. the metrics aggregated per
+// invocation. Flush returns the kept logs when the logs queue is closed, and they are run through the processors after
+// the one flushing them.
+type Flusher interface {
+	Flush() []logservice.Log
+}
+
+type ServiceParams struct {
+	Processors      []Processor
+	LogsQueue       <-chan []logservice.Log
+	OutputQueue     chan<- []logservice.Log
+	LambdaName      string
+	AWSRegion       string
+	FunctionVersion string
+	Handler         string
+	Metrics         *metrics.Registry
+}
+
+// ProcessService runs the logs from log service through the enabled processors in order
+// and passes the results to forward service.
+type ProcessService struct {
+	processors  []Processor
+	logsQueue   <-chan []logservice.Log
+	outputQueue chan<- []logservice.Log
+	// dropped are the counters of logs dropped by each processor
+	dropped []*metrics.Counter
+	// done is closed once the service is closed
+	done chan struct{}
+}
+
+func New(params ServiceParams) *ProcessService {
+	s := &ProcessService{
+		logsQueue:   params.LogsQueue,
+		outputQueue: params.OutputQueue,
+		done:        make(chan struct{}),
+	}
+	for _, p := range params.Processors {
+		p.Init(ProcessorParams{
+			LambdaName:      params.LambdaName,
+			AWSRegion:       params.AWSRegion,
+			FunctionVersion: params.FunctionVersion,
+			Handler:         params.Handler,
+		})
+		if p.IsEnable() {
+			s.processors = append(s.processors, p)
+			s.dropped = append(s.dropped, params.Metrics.Counter(metrics.DroppedLogs, emf.Count, metrics.Labels{"Stage": p.Name()}))
+		}
+	}
+	params.Metrics.Gauge(metrics.QueueDepth, emf.Count, metrics.Labels{"Queue": "processed"}, func() float64 {
+		return float64(len(params.OutputQueue))
+	})
+	return s
+}
+
+// Process runs the logs through the enabled processors in order
+func (s *ProcessService) Process(logs []logservice.Log) []logservice.Log {
+	for i := range s.processors {
+		if len(logs) == 0 {
+			break
+		}
+		logs = s.processWith(i, logs)
+	}
+	return logs
+}
+
+// processWith runs the logs through the i-th processor and counts the logs dropped by it
+func (s *ProcessService) processWith(i int, logs []logservice.Log) []logservice.Log {
+	if len(logs) == 0 {
+		return logs
+	}
+	n := len(logs)
+	logs = s.processors[i].Process(logs)
+	if n > len(logs) {
+		s.dropped[i].Add(uint64(n - len(logs)))
+	}
+	return logs
+}
+
+// flush collects the logs kept by the processors which are Flusher
+func (s *ProcessService) flush() []logservice.Log {
+	var logs []logservice.Log
+	for i, p := range s.processors {
+		logs = s.processWith(i, logs)
+		if f, ok := p.(Flusher); ok {
+			logs = append(logs, f.Flush()...)
+		}
+	}
+	return logs
+}
+
+func (s *ProcessService) Run(ctx context.Context, wg *sync.WaitGroup) {
+
+	go func() {
+		zerolog.Ctx(ctx).Info().Msg("process service is running")
+		for logs := range s.logsQueue {
+			if logs = s.Process(logs); len(logs) > 0 {
+				s.outputQueue <- logs
+			}
+		}
+
+		zerolog.Ctx(ctx).Info().Msg("process service is closing")
+		if logs := s.flush(); len(logs) > 0 {
+			s.outputQueue <- logs
+		}
+		for _, p := range s.processors {
+			p.Shutdown()
+		}
+
+		// Close output queue channel to notify forward service
+		close(s.outputQueue)
+
+		zerolog.Ctx(ctx).Info().Msg("process service is closed")
+		close(s.done)
+		wg.Done()
+	}()
+
+}
+
+// Wait waits until the logs queue is drained and the service is closed, or ctx is done
+func (s *ProcessService) Wait(ctx context.Context) error {
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
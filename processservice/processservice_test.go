@@ -0,0 +1,80 @@
+package processservice
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/metrics"
+)
+
+// keepProcessor keeps the logs of the kept type until it is flushed, and drops the logs of the dropped type
+type keepProcessor struct {
+	kept    logservice.LogType
+	dropped logservice.LogType
+	logs    []logservice.Log
+}
+
+func (p *keepProcessor) Name() string                        { return "keep" }
+func (p *keepProcessor) SetupConfigs(_ *kingpin.Application) {}
+func (p *keepProcessor) Init(_ ProcessorParams)              {}
+func (p *keepProcessor) IsEnable() bool                      { return true }
+func (p *keepProcessor) Shutdown()                           {}
+
+func (p *keepProcessor) Process(logs []logservice.Log) []logservice.Log {
+	var processed []logservice.Log
+	for _, log := range logs {
+		switch log.Type {
+		case p.kept:
+			p.logs = append(p.logs, log)
+		case p.dropped:
+		default:
+			processed = append(processed, log)
+		}
+	}
+	return processed
+}
+
+func (p *keepProcessor) Flush() []logservice.Log {
+	logs := p.logs
+	p.logs = nil
+	return logs
+}
+
+func TestProcessService_Run_flush(t *testing.T) {
+	logsQueue := make(chan []logservice.Log, 1)
+	outputQueue := make(chan []logservice.Log, 2)
+	s := New(ServiceParams{
+		Processors: []Processor{
+			&keepProcessor{kept: logservice.Function},
+			&keepProcessor{kept: logservice.PlatformReport, dropped: logservice.Function},
+		},
+		LogsQueue:   logsQueue,
+		OutputQueue: outputQueue,
+		Metrics:     metrics.New(),
+	})
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	s.Run(context.Background(), wg)
+	logsQueue <- []logservice.Log{
+		{Type: logservice.Function},
+		{Type: logservice.PlatformReport},
+		{Type: logservice.PlatformStart},
+	}
+	close(logsQueue)
+	wg.Wait()
+
+	var types []logservice.LogType
+	for logs := range outputQueue {
+		for _, log := range logs {
+			types = append(types, log.Type)
+		}
+	}
+	// The logs flushed by the first processor are run through the second one, which drops them
+	assert.Equal(t, []logservice.LogType{logservice.PlatformStart, logservice.PlatformReport}, types)
+}
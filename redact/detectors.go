@@ -0,0 +1,108 @@
+package redact
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// detector finds the sensitive data by regex. If group is set, only the submatch of the group is redacted.
+// If validate is set, the match is only redacted when it returns true.
+type detector struct {
+	name     string
+	regex    *regexp.Regexp
+	group    int
+	validate func(string) bool
+}
+
+var builtins = map[string]detector{
+	"email": {
+		name:  "email",
+		regex: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+	},
+	"creditcard": {
+		name:     "creditcard",
+		regex:    regexp.MustCompile(`\b(?:\d[ \-]?){12,18}\d\b`),
+		validate: luhn,
+	},
+	"awskey": {
+		name:  "awskey",
+		regex: regexp.MustCompile(`\b(?:AKIA|ASIA|AGPA|AIDA|AROA|AIPA|ANPA|ANVA)[A-Z0-9]{16}\b`),
+	},
+	"bearer": {
+		name:  "bearer",
+		regex: regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]+=*)`),
+		group: 1,
+	},
+	"jwt": {
+		name:  "jwt",
+		regex: regexp.MustCompile(`\beyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]*`),
+	},
+	"ip": {
+		name:  "ip",
+		regex: regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b|\b(?:[0-9a-fA-F]{1,4}:){7}[0-9a-fA-F]{1,4}\b`),
+	},
+}
+
+func builtinNames() []string {
+	var names []string
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// replace redacts all matches in s with the replacement of the detected value
+func (d detector) replace(s string, replacement func(name, value string) string) string {
+	matches := d.regex.FindAllStringSubmatchIndex(s, -1)
+	if matches == nil {
+		return s
+	}
+
+	var sb strings.Builder
+	last := 0
+	for _, m := range matches {
+		start, end := m[2*d.group], m[2*d.group+1]
+		if start < 0 {
+			continue
+		}
+		value := s[start:end]
+		if d.validate != nil && !d.validate(value) {
+			continue
+		}
+		sb.WriteString(s[last:start])
+		sb.WriteString(replacement(d.name, value))
+		last = end
+	}
+	sb.WriteString(s[last:])
+	return sb.String()
+}
+
+// luhn validates the check digit of card numbers
+func luhn(s string) bool {
+	var digits []int
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			digits = append(digits, int(c-'0'))
+		}
+	}
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := digits[i]
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
@@ -0,0 +1,192 @@
+package redact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/utils"
+)
+
+// Strategy is how the sensitive data is redacted
+type Strategy string
+
+const (
+	// Mask replaces the sensitive data with asterisks
+	Mask Strategy = "mask"
+	// Hash replaces the sensitive data with its salted SHA-256, so that it could still be correlated
+	Hash Strategy = "hash"
+	// Remove deletes the sensitive data
+	Remove Strategy = "remove"
+)
+
+// Redactor removes sensitive data, e.g. emails, card numbers and secrets, from the content and fields of logs
+type Redactor struct {
+	cfg       config
+	logger    zerolog.Logger
+	detectors []detector
+}
+
+type config struct {
+	Detectors *detectorList
+	Rules     *ruleList
+	Strategy  *string
+	HashSalt  *string
+}
+
+func New() *Redactor {
+	return &Redactor{
+		logger: zerolog.New(os.Stdout).With().Str("component", "redact").Timestamp().Logger(),
+	}
+}
+
+func (r *Redactor) SetupConfigs(app *kingpin.Application) {
+	r.cfg.Detectors = new(detectorList)
+	app.
+		Flag("redact-detectors", fmt.Sprintf("The comma separated built-in detectors (%s) of sensitive data to redact", strings.Join(builtinNames(), ", "))).
+		Envar("LS_REDACT_DETECTORS").
+		Default("").SetValue(r.cfg.Detectors)
+	r.cfg.Rules = new(ruleList)
+	app.
+		Flag("redact-rules", "The semicolon separated custom regexes of sensitive data to redact").
+		Envar("LS_REDACT_RULES").
+		Default("").SetValue(r.cfg.Rules)
+	r.cfg.Strategy = app.
+		Flag("redact-strategy", "How the sensitive data is redacted").
+		Envar("LS_REDACT_STRATEGY").
+		Default(string(Mask)).Enum(string(Mask), string(Hash), string(Remove))
+	r.cfg.HashSalt = app.
+		Flag("redact-hash-salt", "The salt of the hash strategy").
+		Envar("LS_REDACT_HASH_SALT").
+		Default("").String()
+}
+
+func (r *Redactor) Init() {
+	r.detectors = append(append([]detector(nil), *r.cfg.Detectors...), *r.cfg.Rules...)
+	r.logger.Debug().Int("detectors", len(r.detectors)).Str("strategy", *r.cfg.Strategy).Msg("redactor is initialized")
+}
+
+func (r *Redactor) IsEnable() bool {
+	return len(r.detectors) > 0
+}
+
+// Redact returns the copies of logs with sensitive data redacted from their content and fields
+func (r *Redactor) Redact(logs []logservice.Log) []logservice.Log {
+	redacted := make([]logservice.Log, len(logs))
+	for i, log := range logs {
+		if line := log.Line(); line != "" {
+			if replaced := r.redactString(line); replaced != line {
+				log.Content, _ = json.Marshal(replaced)
+			}
+		}
+		if log.Fields != nil {
+			log.Fields = r.redactValue(log.Fields).(map[string]interface{})
+		}
+		redacted[i] = log
+	}
+	return redacted
+}
+
+func (r *Redactor) redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return r.redactString(v)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = r.redactValue(item)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, item := range v {
+			a[i] = r.redactValue(item)
+		}
+		return a
+	default:
+		return v
+	}
+}
+
+func (r *Redactor) redactString(s string) string {
+	for _, d := range r.detectors {
+		s = d.replace(s, r.replacement)
+	}
+	return s
+}
+
+func (r *Redactor) replacement(name, value string) string {
+	switch Strategy(*r.cfg.Strategy) {
+	case Hash:
+		sum := sha256.Sum256([]byte(*r.cfg.HashSalt + value))
+		return fmt.Sprintf("[%s:%s]", name, hex.EncodeToString(sum[:])[:16])
+	case Remove:
+		return ""
+	default:
+		return strings.Repeat("*", len(value))
+	}
+}
+
+// detectorList is the comma separated names of built-in detectors. It implements kingpin.Value.
+type detectorList []detector
+
+func (l *detectorList) Set(value string) error {
+	var list detectorList
+	for _, name := range utils.SplitList(value) {
+		d, ok := builtins[name]
+		if !ok {
+			return fmt.Errorf("redact: unknown detector: %s", name)
+		}
+		list = append(list, d)
+	}
+	*l = list
+	return nil
+}
+
+func (l *detectorList) String() string {
+	var names []string
+	for _, d := range *l {
+		names = append(names, d.name)
+	}
+	return strings.Join(names, ",")
+}
+
+// ruleList is the semicolon separated custom regexes. It implements kingpin.Value.
+type ruleList []detector
+
+func (l *ruleList) Set(value string) error {
+	var list ruleList
+	for _, expr := range strings.Split(value, ";") {
+		if strings.TrimSpace(expr) == "" {
+			continue
+		}
+		re, err := regexp.Compile(strings.TrimSpace(expr))
+		if err != nil {
+			return fmt.Errorf("redact: invalid rule %q: %w", expr, err)
+		}
+		list = append(list, detector{name: "custom", regex: re})
+	}
+	*l = list
+	return nil
+}
+
+func (l *ruleList) String() string {
+	var exprs []string
+	for _, d := range *l {
+		exprs = append(exprs, d.regex.String())
+	}
+	return strings.Join(exprs, "; ")
+}
+
+// ListSeparator returns the separator of the items in the config file
+func (l *ruleList) ListSeparator() string {
+	return "; "
+}
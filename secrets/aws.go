@@ -0,0 +1,163 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/david7482/lambda-extension-log-shipper/awsauth"
+)
+
+// extensionRetryInterval is the interval to retry the AWS Parameters and Secrets Lambda Extension, which might not be
+// ready yet as the extensions are started together
+const extensionRetryInterval = 100 * time.Millisecond
+
+// apiError is the error response of SSM, Secrets Manager or the AWS Parameters and Secrets Lambda Extension
+type apiError struct {
+	StatusCode int
+	Type       string `json:"__type"`
+	Message    string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("status: %d, type: %s, message: %s", e.StatusCode, e.Type, e.Message)
+}
+
+type getParameterResponse struct {
+	Parameter struct {
+		Value string `json:"Value"`
+	} `json:"Parameter"`
+}
+
+type getSecretValueResponse struct {
+	SecretString string `json:"SecretString"`
+	// SecretBinary is decoded from base64
+	SecretBinary []byte `json:"SecretBinary"`
+}
+
+// getParameter returns the value of the parameter of SSM Parameter Store
+func (r *Resolver) getParameter(name string) (string, error) {
+	var res getParameterResponse
+	var err error
+	if *r.cfg.Extension {
+		query := url.Values{"name": {name}, "withDecryption": {strconv.FormatBool(*r.cfg.Decrypt)}}
+		err = r.callExtension("/systemsmanager/parameters/get", query, &res)
+	} else {
+		endpoint := *r.cfg.SSMEndpoint
+		if endpoint == "" {
+			endpoint = fmt.Sprintf("https://ssm.%s.amazonaws.com", r.params.AWSRegion)
+		}
+		err = r.call(endpoint, "ssm", "AmazonSSM.GetParameter", map[string]interface{}{
+			"Name":           name,
+			"WithDecryption": *r.cfg.Decrypt,
+		}, &res)
+	}
+	if err != nil {
+		return "", fmt.Errorf("fail to get parameter %s: %w", name, err)
+	}
+	return res.Parameter.Value, nil
+}
+
+// getSecretValue returns the value of the secret of Secrets Manager
+func (r *Resolver) getSecretValue(id string) (string, error) {
+	var res getSecretValueResponse
+	var err error
+	if *r.cfg.Extension {
+		err = r.callExtension("/secretsmanager/get", url.Values{"secretId": {id}}, &res)
+	} else {
+		endpoint := *r.cfg.SecretsManagerEndpoint
+		if endpoint == "" {
+			endpoint = fmt.Sprintf("https://secretsmanager.%s.amazonaws.com", r.params.AWSRegion)
+		}
+		err = r.call(endpoint, "secretsmanager", "secretsmanager.GetSecretValue", map[string]interface{}{
+			"SecretId": id,
+		}, &res)
+	}
+	if err != nil {
+		return "", fmt.Errorf("fail to get secret %s: %w", id, err)
+	}
+	if res.SecretString == "" && res.SecretBinary != nil {
+		return string(res.SecretBinary), nil
+	}
+	return res.SecretString, nil
+}
+
+// call makes the signed request of the action of the AWS JSON API
+func (r *Resolver) call(endpoint, service, target string, payload interface{}, out interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+
+	creds, err := awsauth.CredentialsFromEnv()
+	if err != nil {
+		return err
+	}
+	awsauth.Sign(req, body, creds, r.params.AWSRegion, service, time.Now())
+
+	res, err := r.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	return decode(res, out)
+}
+
+// callExtension gets the secret from the cache of the AWS Parameters and Secrets Lambda Extension. The connection is
+// retried until the timeout, as the extension might not be listening yet.
+func (r *Resolver) callExtension(path string, query url.Values, out interface{}) error {
+	u := url.URL{
+		Scheme:   "http",
+		Host:     net.JoinHostPort("localhost", strconv.Itoa(*r.cfg.ExtensionPort)),
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+	deadline := time.Now().Add(*r.cfg.Timeout)
+	for {
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Aws-Parameters-Secrets-Token", os.Getenv("AWS_SESSION_TOKEN"))
+
+		res, err := r.httpClient.Do(req)
+		if err == nil {
+			return decode(res, out)
+		}
+		if time.Now().Add(extensionRetryInterval).After(deadline) {
+			return err
+		}
+		time.Sleep(extensionRetryInterval)
+	}
+}
+
+func decode(res *http.Response, out interface{}) error {
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("fail to read response: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		apiErr := &apiError{StatusCode: res.StatusCode}
+		if json.Unmarshal(body, apiErr) != nil {
+			apiErr.Message = string(body)
+		}
+		return apiErr
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	return nil
+}
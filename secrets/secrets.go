@@ -0,0 +1,192 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// The prefixes of the config values which are references to secrets
+const (
+	// SSMPrefix refers to a parameter of SSM Parameter Store, e.g. `ssm:/prod/newrelic/license-key`
+	SSMPrefix = "ssm:"
+	// SecretsManagerPrefix refers to a secret of Secrets Manager, and optionally a key of its JSON object, e.g.
+	// `secretsmanager:arn:aws:secretsmanager:us-east-1:123456789012:secret:prod/newrelic#license-key`
+	SecretsManagerPrefix = "secretsmanager:"
+)
+
+// Resolver replaces the config values referring to secrets by the values of the secrets. The secrets are fetched
+// once at startup with the credentials of the Lambda execution role, or from the AWS Parameters and Secrets Lambda
+// Extension.
+type Resolver struct {
+	cfg        config
+	logger     zerolog.Logger
+	httpClient *http.Client
+	params     Params
+
+	// cache keeps the fetched secrets by their sources, so a secret is fetched once for all its references
+	cache map[string]string
+}
+
+type config struct {
+	Decrypt                *bool
+	SSMEndpoint            *string
+	SecretsManagerEndpoint *string
+	Extension              *bool
+	ExtensionPort          *int
+	Timeout                *time.Duration
+}
+
+// Params are the settings of the resolver known after the configs are parsed
+type Params struct {
+	AWSRegion string
+}
+
+// cumulative is the value of a repeatable flag, which could not be replaced by Set
+type cumulative interface {
+	IsCumulative() bool
+}
+
+// reference is a config value referring to a secret
+type reference struct {
+	prefix string
+	id     string
+	// key is the key of the JSON object of the secret, empty for the whole secret
+	key string
+}
+
+func New() *Resolver {
+	return &Resolver{
+		logger: zerolog.New(os.Stdout).With().Str("component", "secrets").Timestamp().Logger(),
+		cache:  make(map[string]string),
+	}
+}
+
+func (r *Resolver) SetupConfigs(app *kingpin.Application) {
+	r.cfg.Decrypt = app.
+		Flag("secrets-decrypt", "Decrypt the SecureString parameters of SSM Parameter Store").
+		Envar("LS_SECRETS_DECRYPT").
+		Default("true").Bool()
+	r.cfg.SSMEndpoint = app.
+		Flag("secrets-ssm-endpoint", "The endpoint of SSM Parameter Store, the regional endpoint if empty").
+		Envar("LS_SECRETS_SSM_ENDPOINT").
+		Default("").String()
+	r.cfg.SecretsManagerEndpoint = app.
+		Flag("secrets-secretsmanager-endpoint", "The endpoint of Secrets Manager, the regional endpoint if empty").
+		Envar("LS_SECRETS_SECRETSMANAGER_ENDPOINT").
+		Default("").String()
+	r.cfg.Extension = app.
+		Flag("secrets-extension", "Fetch the secrets from the cache of the AWS Parameters and Secrets Lambda Extension").
+		Envar("LS_SECRETS_EXTENSION").
+		Default("false").Bool()
+	r.cfg.ExtensionPort = app.
+		Flag("secrets-extension-port", "The port of the AWS Parameters and Secrets Lambda Extension").
+		Envar("PARAMETERS_SECRETS_EXTENSION_HTTP_PORT").
+		Default("2773").Int()
+	r.cfg.Timeout = app.
+		Flag("secrets-timeout", "The timeout to fetch a secret").
+		Envar("LS_SECRETS_TIMEOUT").
+		Default("5s").Duration()
+}
+
+func (r *Resolver) Init(params Params) {
+	r.params = params
+	r.httpClient = &http.Client{Timeout: *r.cfg.Timeout}
+}
+
+// Resolve replaces the values of the parsed flags which refer to secrets, so it has to be called before the configs
+// are used by any component. The secrets are never logged.
+func (r *Resolver) Resolve(app *kingpin.Application) error {
+	resolved := 0
+	for _, flag := range app.Model().Flags {
+		ref, ok, err := parseReference(flag.Value.String())
+		if !ok {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("secrets: invalid reference of --%s: %w", flag.Name, err)
+		}
+		if v, ok := flag.Value.(cumulative); ok && v.IsCumulative() {
+			return fmt.Errorf("secrets: --%s could not refer to a secret", flag.Name)
+		}
+		secret, err := r.get(ref)
+		if err != nil {
+			return fmt.Errorf("secrets: fail to resolve --%s: %w", flag.Name, err)
+		}
+		// The error is not wrapped, which might contain the secret
+		if err := flag.Value.Set(secret); err != nil {
+			return fmt.Errorf("secrets: invalid value of the secret of --%s", flag.Name)
+		}
+		r.logger.Debug().Str("flag", flag.Name).Str("source", ref.prefix+ref.id).Msg("secret resolved")
+		resolved++
+	}
+	if resolved > 0 {
+		r.logger.Info().Int("resolved", resolved).Int("fetched", len(r.cache)).Msg("secrets resolved")
+	}
+	return nil
+}
+
+// parseReference returns false if the value is not a reference to a secret
+func parseReference(value string) (reference, bool, error) {
+	var ref reference
+	switch {
+	case strings.HasPrefix(value, SSMPrefix):
+		ref = reference{prefix: SSMPrefix, id: strings.TrimPrefix(value, SSMPrefix)}
+	case strings.HasPrefix(value, SecretsManagerPrefix):
+		ref = reference{prefix: SecretsManagerPrefix, id: strings.TrimPrefix(value, SecretsManagerPrefix)}
+		if i := strings.LastIndex(ref.id, "#"); i >= 0 {
+			ref.id, ref.key = ref.id[:i], ref.id[i+1:]
+			if ref.key == "" {
+				return ref, true, fmt.Errorf("empty JSON key of %s", value)
+			}
+		}
+	default:
+		return ref, false, nil
+	}
+	if ref.id == "" {
+		return ref, true, fmt.Errorf("empty name of %s", value)
+	}
+	return ref, true, nil
+}
+
+// get returns the secret of the reference, which is fetched if it is not in the cache
+func (r *Resolver) get(ref reference) (string, error) {
+	source := ref.prefix + ref.id
+	secret, ok := r.cache[source]
+	if !ok {
+		var err error
+		if ref.prefix == SSMPrefix {
+			secret, err = r.getParameter(ref.id)
+		} else {
+			secret, err = r.getSecretValue(ref.id)
+		}
+		if err != nil {
+			return "", err
+		}
+		r.cache[source] = secret
+	}
+	if ref.key == "" {
+		return secret, nil
+	}
+
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(secret), &object); err != nil {
+		return "", fmt.Errorf("%s is not a JSON object", source)
+	}
+	raw, ok := object[ref.key]
+	if !ok {
+		return "", fmt.Errorf("%s has no key %s", source, ref.key)
+	}
+	// A string is unquoted, while other JSON values are kept as they are, e.g. numbers
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	}
+	return string(raw), nil
+}
@@ -0,0 +1,140 @@
+package secrets
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/configtest"
+)
+
+type testConfig struct {
+	LicenseKey *string
+	Password   *string
+	Token      *string
+	Plain      *string
+}
+
+func newTestResolver(t *testing.T, args ...string) (*Resolver, *kingpin.Application, *testConfig) {
+	var cfg testConfig
+	r := New()
+	app := configtest.Parse(t, func(app *kingpin.Application) {
+		cfg.LicenseKey = app.Flag("newrelic-license-key", "").Default("ssm:/prod/newrelic/license-key").String()
+		cfg.Password = app.Flag("promremotewrite-password", "").Default("").String()
+		cfg.Token = app.Flag("promremotewrite-bearer-token", "").Default("").String()
+		cfg.Plain = app.Flag("tags", "").Default("env=prod").String()
+		r.SetupConfigs(app)
+	}, args...)
+	r.Init(Params{AWSRegion: "us-east-1"})
+	return r, app, &cfg
+}
+
+func TestResolver_Resolve(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	calls := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		target := r.Header.Get("X-Amz-Target")
+		calls[target]++
+		switch target {
+		case "AmazonSSM.GetParameter":
+			assert.Contains(t, r.Header.Get("Authorization"), "Credential=AKIDEXAMPLE/")
+			assert.Contains(t, r.Header.Get("Authorization"), "/us-east-1/ssm/aws4_request")
+			assert.Equal(t, "/prod/newrelic/license-key", payload["Name"])
+			assert.Equal(t, true, payload["WithDecryption"])
+			_, _ = w.Write([]byte(`{"Parameter": {"Name": "/prod/newrelic/license-key", "Value": "nr-key"}}`))
+		case "secretsmanager.GetSecretValue":
+			assert.Contains(t, r.Header.Get("Authorization"), "/us-east-1/secretsmanager/aws4_request")
+			assert.Equal(t, "prod/remote-write", payload["SecretId"])
+			_, _ = w.Write([]byte(`{"SecretString": "{\"password\": \"p@ss\", \"token\": 1234}"}`))
+		default:
+			t.Errorf("unexpected target %s", target)
+		}
+	}))
+	defer srv.Close()
+
+	r, app, cfg := newTestResolver(t,
+		"--secrets-ssm-endpoint", srv.URL,
+		"--secrets-secretsmanager-endpoint", srv.URL,
+		"--promremotewrite-password", "secretsmanager:prod/remote-write#password",
+		"--promremotewrite-bearer-token", "secretsmanager:prod/remote-write#token",
+	)
+
+	require.NoError(t, r.Resolve(app))
+	assert.Equal(t, "nr-key", *cfg.LicenseKey)
+	assert.Equal(t, "p@ss", *cfg.Password)
+	assert.Equal(t, "1234", *cfg.Token)
+	assert.Equal(t, "env=prod", *cfg.Plain)
+	// Each secret is fetched once
+	assert.Equal(t, map[string]int{"AmazonSSM.GetParameter": 1, "secretsmanager.GetSecretValue": 1}, calls)
+}
+
+func TestResolver_Resolve_extension(t *testing.T) {
+	os.Setenv("AWS_SESSION_TOKEN", "session")
+	defer os.Unsetenv("AWS_SESSION_TOKEN")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "session", r.Header.Get("X-Aws-Parameters-Secrets-Token"))
+		switch r.URL.Path {
+		case "/systemsmanager/parameters/get":
+			assert.Equal(t, "/prod/newrelic/license-key", r.URL.Query().Get("name"))
+			assert.Equal(t, "false", r.URL.Query().Get("withDecryption"))
+			_, _ = w.Write([]byte(`{"Parameter": {"Value": "nr-key"}}`))
+		case "/secretsmanager/get":
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type": "ResourceNotFoundException", "message": "not found"}`))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	r, app, cfg := newTestResolver(t, "--secrets-extension", "--no-secrets-decrypt", "--secrets-extension-port", u.Port())
+	require.NoError(t, r.Resolve(app))
+	assert.Equal(t, "nr-key", *cfg.LicenseKey)
+
+	r, app, _ = newTestResolver(t, "--secrets-extension", "--secrets-extension-port", u.Port(),
+		"--newrelic-license-key", "", "--promremotewrite-password", "secretsmanager:prod/missing")
+	err = r.Resolve(app)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "--promremotewrite-password")
+	assert.Contains(t, err.Error(), "ResourceNotFoundException")
+}
+
+func TestParseReference(t *testing.T) {
+	ref, ok, err := parseReference("secretsmanager:arn:aws:secretsmanager:us-east-1:123456789012:secret:prod/nr-AbCdEf#license-key")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, reference{
+		prefix: SecretsManagerPrefix,
+		id:     "arn:aws:secretsmanager:us-east-1:123456789012:secret:prod/nr-AbCdEf",
+		key:    "license-key",
+	}, ref)
+
+	ref, ok, err = parseReference("ssm:/prod/key")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, reference{prefix: SSMPrefix, id: "/prod/key"}, ref)
+
+	_, ok, _ = parseReference("https://example.com")
+	assert.False(t, ok)
+	for _, value := range []string{"ssm:", "secretsmanager:", "secretsmanager:prod#"} {
+		_, ok, err := parseReference(value)
+		assert.True(t, ok)
+		assert.Error(t, err, value)
+	}
+}
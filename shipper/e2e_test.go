@@ -0,0 +1,179 @@
+package shipper
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/extension"
+	"github.com/david7482/lambda-extension-log-shipper/extension/extensiontest"
+	"github.com/david7482/lambda-extension-log-shipper/forwardservice"
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+)
+
+// captureForwarder is the fake destination of the end-to-end tests, which keeps the logs sent to it
+type captureForwarder struct {
+	mu   sync.Mutex
+	logs []logservice.Log
+}
+
+var capture = &captureForwarder{}
+
+func init() {
+	forwardservice.Register("capture", func(_ string) forwardservice.ForwarderV2 {
+		return capture
+	})
+}
+
+func (f *captureForwarder) Name() string                                { return "capture" }
+func (f *captureForwarder) SetupConfigs(_ *kingpin.Application)         {}
+func (f *captureForwarder) Init(_ forwardservice.ForwarderParams) error { return nil }
+func (f *captureForwarder) IsEnable() bool                              { return true }
+func (f *captureForwarder) Flush(_ context.Context) error               { return nil }
+func (f *captureForwarder) Shutdown(_ context.Context) error            { return nil }
+
+func (f *captureForwarder) Send(_ context.Context, logs []logservice.Log) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.logs = append(f.logs, logs...)
+	return nil
+}
+
+func (f *captureForwarder) reset() []logservice.Log {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	logs := f.logs
+	f.logs = nil
+	return logs
+}
+
+// freePort returns a port which is free to listen on
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startExtension runs the extension against the runtime on a free port, and returns the channel of the exit code once
+// the extension stops, which is 0 if the extension is shutdown
+func startExtension(t *testing.T, rt *extensiontest.Runtime, args ...string) <-chan int {
+	env := map[string]string{
+		"AWS_LAMBDA_RUNTIME_API":   rt.Addr(),
+		"AWS_LAMBDA_FUNCTION_NAME": "function",
+		"AWS_REGION":               "us-east-1",
+	}
+	for k, v := range env {
+		require.NoError(t, os.Setenv(k, v))
+	}
+
+	code := make(chan int, 1)
+	port := strconv.Itoa(freePort(t))
+	go func() {
+		c := run(append([]string{"--log-level", "error", "--metrics-interval", "0s", "--listen-port", port}, args...))
+		for k := range env {
+			_ = os.Unsetenv(k)
+		}
+		code <- c
+	}()
+	return code
+}
+
+func TestRun_invokeAndShutdown(t *testing.T) {
+	capture.reset()
+	rt := extensiontest.NewRuntime()
+	defer rt.Close()
+	code := startExtension(t, rt)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, rt.WaitSubscribed(ctx))
+	require.NoError(t, rt.Invoke(ctx, "request-1", "hello", "world"))
+	require.NoError(t, rt.Invoke(ctx, "request-2", "ERROR something happened"))
+	require.NoError(t, rt.Shutdown(ctx, extension.Spindown, 2*time.Second))
+
+	select {
+	case c := <-code:
+		require.Equal(t, 0, c)
+	case <-ctx.Done():
+		t.Fatal("the extension is not shutdown")
+	}
+	assert.Equal(t, extensionName, rt.ExtensionName())
+	assert.Empty(t, rt.Errors())
+
+	functionLogs := map[string][]string{}
+	var reports int
+	for _, log := range capture.reset() {
+		switch log.Type {
+		case logservice.Function:
+			functionLogs[log.RequestID] = append(functionLogs[log.RequestID], string(log.Content))
+		case logservice.PlatformReport:
+			reports++
+		}
+	}
+	assert.Equal(t, map[string][]string{
+		"request-1": {`"hello"`, `"world"`},
+		"request-2": {`"ERROR something happened"`},
+	}, functionLogs)
+	assert.Equal(t, 2, reports)
+}
+
+func TestRun_logsAfterShutdown(t *testing.T) {
+	capture.reset()
+	rt := extensiontest.NewRuntime()
+	defer rt.Close()
+	code := startExtension(t, rt)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, rt.WaitSubscribed(ctx))
+	require.NoError(t, rt.Invoke(ctx, "request-1", "hello"))
+
+	// The Logs API flushes the logs of the last invocation a while after the SHUTDOWN event
+	require.NoError(t, rt.SendInvoke(ctx, "request-2"))
+	require.NoError(t, rt.Shutdown(ctx, extension.Spindown, 2*time.Second))
+	time.Sleep(200 * time.Millisecond)
+	require.NoError(t, rt.SendLogs(ctx,
+		extensiontest.PlatformStart("request-2"),
+		extensiontest.Function("bye"),
+		extensiontest.PlatformRuntimeDone("request-2"),
+		extensiontest.PlatformReport("request-2", 12.5),
+	))
+
+	select {
+	case c := <-code:
+		require.Equal(t, 0, c)
+	case <-ctx.Done():
+		t.Fatal("the extension is not shutdown")
+	}
+
+	var late []string
+	for _, log := range capture.reset() {
+		if log.RequestID == "request-2" {
+			late = append(late, string(log.Type))
+		}
+	}
+	assert.Equal(t, []string{string(logservice.Function), string(logservice.PlatformReport)}, late)
+}
+
+func TestRun_configInvalid(t *testing.T) {
+	rt := extensiontest.NewRuntime()
+	defer rt.Close()
+	code := startExtension(t, rt, "--forwarders", "unknown")
+
+	select {
+	case c := <-code:
+		require.Equal(t, 1, c)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the extension does not exit")
+	}
+	assert.Equal(t, []extensiontest.ReportedError{{Phase: "init", Type: extension.ConfigInvalid}}, rt.Errors())
+}
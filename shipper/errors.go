@@ -0,0 +1,73 @@
+package shipper
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/david7482/lambda-extension-log-shipper/extension"
+)
+
+// reportTimeout is the time to report the error to the Extensions API before exiting
+const reportTimeout = 1 * time.Second
+
+// reporter reports the error which stops the extension to the Extensions API before it exits, so that it shows up in the
+// init error of Lambda before the extension waits for the first event, or in the exit error afterwards
+type reporter struct {
+	mu      sync.Mutex
+	client  *extension.Client
+	started bool
+}
+
+// setClient sets the client to report the errors, which is unknown until the runtime API is known
+func (r *reporter) setClient(client *extension.Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.client = client
+}
+
+// start is called before the extension waits for the first event, and the errors are reported as exit errors afterwards
+func (r *reporter) start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.started = true
+}
+
+// fail logs and reports the error, and returns the exit code of the extension. The error is reported with its
+// extension.ErrorType, or extension.Unknown if it is not typed.
+func (r *reporter) fail(logger *zerolog.Logger, err error) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	errorType := extension.TypeOf(err)
+	logger.Error().Err(err).Str("errorType", string(errorType)).Msg("extension failed")
+	if err := r.report(errorType); err != nil {
+		logger.Error().Err(err).Msg("fail to report the error to the Extensions API")
+	}
+	return 1
+}
+
+func (r *reporter) report(errorType extension.ErrorType) error {
+	if r.client == nil {
+		return errors.New("shipper: the runtime API is unknown")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+	defer cancel()
+
+	// An error is reported by the registered extension, e.g. the configs are invalid before the extension registers
+	if r.client.ExtensionID == "" {
+		if _, err := r.client.RegisterExtension(ctx, extensionName); err != nil {
+			return err
+		}
+	}
+	if r.started {
+		_, err := r.client.ExitError(ctx, string(errorType))
+		return err
+	}
+	_, err := r.client.InitError(ctx, string(errorType))
+	return err
+}
@@ -0,0 +1,50 @@
+package shipper
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/david7482/lambda-extension-log-shipper/extension"
+)
+
+func TestReporter_fail(t *testing.T) {
+	var reports []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/2020-01-01/extension/register":
+			w.Header().Set("Lambda-Extension-Identifier", "id")
+			_, _ = w.Write([]byte(`{}`))
+		case "/2020-01-01/extension/init/error", "/2020-01-01/extension/exit/error":
+			reports = append(reports, r.URL.Path[len("/2020-01-01/extension"):]+" "+r.Header.Get("Lambda-Extension-Function-Error-Type"))
+			_, _ = w.Write([]byte(`{"status":"OK"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	var codes []int
+	logger := zerolog.Nop()
+	r := &reporter{}
+	codes = append(codes, r.fail(&logger, errors.New("runtime API is unknown")))
+
+	// The extension is registered to report the invalid configs
+	r.setClient(extension.NewClient(strings.TrimPrefix(server.URL, "http://")))
+	codes = append(codes, r.fail(&logger, extension.NewError(extension.ConfigInvalid, errors.New("unknown forwarder"))))
+	r.start()
+	codes = append(codes, r.fail(&logger, extension.NewError(extension.ListenFailed, errors.New("address already in use"))))
+	codes = append(codes, r.fail(&logger, errors.New("connection refused")))
+
+	assert.Equal(t, []int{1, 1, 1, 1}, codes)
+	assert.Equal(t, []string{
+		"/init/error Extension.ConfigInvalid",
+		"/exit/error Extension.ListenFailed",
+		"/exit/error Extension.Unknown",
+	}, reports)
+}
@@ -0,0 +1,472 @@
+package shipper
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/extension"
+	"github.com/david7482/lambda-extension-log-shipper/forwardservice"
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/metrics"
+	"github.com/david7482/lambda-extension-log-shipper/processservice"
+	"github.com/david7482/lambda-extension-log-shipper/secrets"
+	"github.com/david7482/lambda-extension-log-shipper/utils"
+)
+
+// replayForwarderFlag is the only forwarder of the replay, which is looked up before the args are parsed
+const replayForwarderFlag = "forwarder"
+
+type replayConfig struct {
+	Input         *string
+	Forwarder     *string
+	DryRun        *bool
+	TimeScale     *float64
+	RebaseTime    *bool
+	NewRequestIDs *bool
+	FunctionArn   *string
+	FlushTimeout  *time.Duration
+}
+
+func setupReplayConfigs(app *kingpin.Application) (generalConfig, replayConfig) {
+	var config generalConfig
+	var options replayConfig
+
+	// the Lambda environment is simulated, so the settings have defaults
+	config.AWSLambdaName = app.
+		Flag("lambda-name", "The name of the lambda function").
+		Envar("AWS_LAMBDA_FUNCTION_NAME").
+		Default("replay").String()
+	config.AWSRegion = app.
+		Flag("region", "The AWS Region where the Lambda function is executed").
+		Envar("AWS_REGION").
+		Default("us-east-1").String()
+	setupPipelineConfigs(app, &config)
+
+	options.Input = app.
+		Arg("input", "The NDJSON file of the captured Logs API batches, or the directory of such files").
+		Required().String()
+	options.Forwarder = app.
+		Flag(replayForwarderFlag, "The only forwarder to build and enable, e.g. newrelic or newrelic-team, and all logs are sent to it").
+		Default("").String()
+	options.DryRun = app.
+		Flag("dry-run", "Print the logs to stdout instead of sending them to the forwarders").
+		Default("false").Bool()
+	options.TimeScale = app.
+		Flag("time-scale", "Scale the time between the batches as captured, e.g. 1 is real time and 0 replays them at once").
+		Default("0").Float64()
+	options.RebaseTime = app.
+		Flag("rebase-time", "Shift the time of the logs, so that the first log is at the start of the replay").
+		Default("false").Bool()
+	options.NewRequestIDs = app.
+		Flag("new-request-ids", "Replace the request ids of the invocations with new ones").
+		Default("false").Bool()
+	options.FunctionArn = app.
+		Flag("function-arn", "The function arn of the simulated invocations").
+		Default("arn:aws:lambda:us-east-1:123456789012:function:replay").String()
+	options.FlushTimeout = app.
+		Flag("flush-timeout", "The time to flush the forwarders after the batches are replayed").
+		Default("10s").Duration()
+
+	return config, options
+}
+
+// Replay feeds the captured batches of the Logs API through the pipeline of the extension with the registered
+// forwarders: the parsing of the log service, the processors and the forwarders, or a printer on dry run
+func Replay() {
+	if err := replay(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func replay(args []string, out io.Writer) error {
+	// Setup configurations
+	app := kingpin.New("replay", "Replay the captured Logs API batches through the pipeline of the extension")
+	c := newComponents()
+	cfg, replayCfg := setupReplayConfigs(app)
+	c.setupProcessorConfigs(app)
+	c.redactor.SetupConfigs(app)
+	c.resolver.SetupConfigs(app)
+	c.configFile.SetupConfigs(app)
+	if err := c.configFile.Load(args); err != nil {
+		return err
+	}
+	only, err := c.configFile.Lookup(args, replayForwarderFlag, "")
+	if err != nil {
+		return err
+	}
+	if only != "" {
+		err = c.setupReplayForwarder(only)
+	} else {
+		err = c.setupForwarders(args)
+	}
+	if err != nil {
+		return err
+	}
+	forwarderOptions := c.setupForwarderConfigs(app)
+	if err := c.configFile.Apply(app); err != nil {
+		return err
+	}
+	if _, err := app.Parse(args); err != nil {
+		return err
+	}
+	if only != "" {
+		if err := c.enableForwarders(app); err != nil {
+			return err
+		}
+	}
+	c.resolver.Init(secrets.Params{AWSRegion: *cfg.AWSRegion})
+	if err := c.resolver.Resolve(app); err != nil {
+		return err
+	}
+
+	// The logs of the replay are written to stderr, so the printed logs are kept apart on stdout
+	lvl, _ := zerolog.ParseLevel(*cfg.LogLevel)
+	zerolog.SetGlobalLevel(lvl)
+	zerolog.TimeFieldFormat = *cfg.LogTimeFormat
+	logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
+	ctx := logger.WithContext(context.Background())
+
+	batches, err := readBatches(*replayCfg.Input)
+	if err != nil {
+		return err
+	}
+	parsing, err := parsingParams(cfg)
+	if err != nil {
+		return err
+	}
+
+	var routes forwardservice.Routes
+	var defaultRoute []string
+	replayForwarders := []forwardservice.ForwarderV2{newPrinter(out)}
+	if !*replayCfg.DryRun {
+		replayForwarders = c.enabledForwarders()
+		if len(replayForwarders) == 0 {
+			return errors.New("replay: no forwarder is enabled, enable one by its settings or use --dry-run")
+		}
+		if only == "" {
+			routes, defaultRoute = *cfg.Routes, utils.SplitList(*cfg.DefaultRoute)
+		}
+		if err := forwardservice.ValidateRoutes(routes, defaultRoute, replayForwarders); err != nil {
+			return err
+		}
+	}
+
+	// Create the pipeline as the extension does, but the batches are ingested without the Logs API
+	stats := metrics.New()
+	logsQueue := make(chan []logservice.Log, 8)
+	processedQueue := make(chan []logservice.Log, 8)
+	logSrv := logservice.New(logservice.ServiceParams{
+		LogsQueue:            logsQueue,
+		EnablePlatformReport: parsing.EnablePlatformReport,
+		ParseFormats:         parsing.ParseFormats,
+		MinLevel:             parsing.MinLevel,
+		Multiline:            parsing.Multiline,
+		Metrics:              stats,
+	})
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	processSrv := processservice.New(processservice.ServiceParams{
+		Processors:  c.processors,
+		LogsQueue:   logsQueue,
+		OutputQueue: processedQueue,
+		LambdaName:  *cfg.AWSLambdaName,
+		AWSRegion:   *cfg.AWSRegion,
+		Metrics:     stats,
+	})
+	processSrv.Run(ctx, &wg)
+
+	wg.Add(1)
+	forwardSrv, err := forwardservice.New(forwardservice.ServiceParams{
+		Forwarders:       replayForwarders,
+		ForwarderOptions: forwarderOptions,
+		Redactor:         c.redactor,
+		Metrics:          stats,
+		Routes:           routes,
+		DefaultRoute:     defaultRoute,
+		LogsQueue:        processedQueue,
+		LambdaName:       *cfg.AWSLambdaName,
+		AWSRegion:        *cfg.AWSRegion,
+	})
+	if err != nil {
+		return err
+	}
+	forwardSrv.Run(ctx, &wg)
+
+	r := newRewriter(time.Now(), *replayCfg.RebaseTime, *replayCfg.NewRequestIDs, batches)
+	for i, batch := range batches {
+		if i > 0 && *replayCfg.TimeScale > 0 {
+			time.Sleep(time.Duration(float64(batch.start().Sub(batches[i-1].start())) * *replayCfg.TimeScale))
+		}
+		batch = r.rewrite(batch)
+
+		// Simulate the INVOKE events, which link the logs with the function arn
+		for _, msg := range batch {
+			if logservice.LogType(msg.Type) == logservice.PlatformStart {
+				var record logservice.StartRecord
+				if json.Unmarshal(msg.Record, &record) == nil {
+					logSrv.AddInvocation(extension.NextEventResponse{
+						EventType:          extension.Invoke,
+						RequestID:          record.RequestID,
+						InvokedFunctionArn: *replayCfg.FunctionArn,
+					})
+				}
+			}
+		}
+		body, err := json.Marshal(batch)
+		if err != nil {
+			return err
+		}
+		if err := logSrv.Ingest(ctx, body); err != nil {
+			return fmt.Errorf("replay: batch %d: %w", i+1, err)
+		}
+	}
+
+	// Drain the pipeline and flush the forwarders
+	flushCtx, cancel := context.WithTimeout(context.Background(), *replayCfg.FlushTimeout)
+	defer cancel()
+	if err := logSrv.Shutdown(flushCtx); err != nil {
+		return err
+	}
+	if err := processSrv.Wait(flushCtx); err != nil {
+		return fmt.Errorf("replay: fail to drain the processors: %w", err)
+	}
+	forwardSrv.Shutdown(flushCtx)
+	if err := forwardSrv.Wait(flushCtx); err != nil {
+		return fmt.Errorf("replay: fail to flush the forwarders: %w", err)
+	}
+
+	logger.Info().
+		Int("batches", len(batches)).
+		Uint64("received", stats.Total(metrics.LogRecords)).
+		Uint64("delivered", stats.Total(metrics.ForwarderSent)).
+		Uint64("failed", stats.Total(metrics.ForwarderFailed)).
+		Uint64("dropped", stats.Total(metrics.DroppedLogs)+stats.Total(metrics.ForwarderDropped)).
+		Msg("replay summary")
+	return nil
+}
+
+// setupReplayForwarder builds only the forwarder of the name, which is a type of forwarders or a named instance of one
+func (c *components) setupReplayForwarder(name string) error {
+	types := forwardservice.Types()
+	if name == forwardservice.AllForwarders || strings.Contains(name, ",") {
+		return fmt.Errorf("replay: --%s takes a single forwarder, expect one of %s", replayForwarderFlag, strings.Join(types, ", "))
+	}
+	var err error
+	if instances, parseErr := forwardservice.ParseInstances(name, types); parseErr == nil && instances[0].Name != "" {
+		c.forwarders, err = forwardservice.Build(nil, instances)
+	} else {
+		c.forwarders, err = forwardservice.Build([]string{name}, nil)
+	}
+	return err
+}
+
+// enableForwarders sets the enable flags of the built forwarders after the args are parsed, so that they are enabled
+// whatever the args, the environment variables and the config file set
+func (c *components) enableForwarders(app *kingpin.Application) error {
+	for _, f := range c.forwarders {
+		if flag := app.GetFlag(f.Name() + "-enable"); flag != nil {
+			if err := flag.Model().Value.Set("true"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// enabledForwarders returns the built forwarders which are enabled by their settings
+func (c *components) enabledForwarders() []forwardservice.ForwarderV2 {
+	var enabled []forwardservice.ForwarderV2
+	for _, f := range c.forwarders {
+		if f.IsEnable() {
+			enabled = append(enabled, f)
+		}
+	}
+	return enabled
+}
+
+// replayBatch is a captured batch of the Logs API
+type replayBatch []logservice.Message
+
+// start returns the time of the first log of the batch
+func (b replayBatch) start() time.Time {
+	if len(b) == 0 {
+		return time.Time{}
+	}
+	return b[0].Time
+}
+
+// readBatches reads the batches from the file, or the files of the directory in the order of their names. A file has
+// a batch as a JSON array per line, or a single event as a JSON object.
+func readBatches(path string) ([]replayBatch, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("replay: %w", err)
+	}
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("replay: %w", err)
+		}
+		files = nil
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+		sort.Strings(files)
+	}
+
+	var batches []replayBatch
+	for _, file := range files {
+		b, err := readBatchFile(file)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, b...)
+	}
+	return batches, nil
+}
+
+func readBatchFile(file string) ([]replayBatch, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("replay: %w", err)
+	}
+	var batches []replayBatch
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err == io.EOF {
+			return batches, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("replay: %s: %w", file, err)
+		}
+
+		var batch replayBatch
+		if bytes.HasPrefix(value, []byte("{")) {
+			var msg logservice.Message
+			err = json.Unmarshal(value, &msg)
+			batch = replayBatch{msg}
+		} else {
+			err = json.Unmarshal(value, &batch)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("replay: %s: invalid batch %d: %w", file, len(batches)+1, err)
+		}
+		batches = append(batches, batch)
+	}
+}
+
+// rewriter shifts the time of the logs and replaces the request ids of the captured batches
+type rewriter struct {
+	offset time.Duration
+	// ids maps the captured request ids to the new ones, nil if the request ids are kept
+	ids map[string]string
+}
+
+func newRewriter(now time.Time, rebaseTime, newRequestIDs bool, batches []replayBatch) *rewriter {
+	r := &rewriter{}
+	if rebaseTime && len(batches) > 0 && len(batches[0]) > 0 {
+		r.offset = now.Sub(batches[0].start())
+	}
+	if newRequestIDs {
+		r.ids = make(map[string]string)
+	}
+	return r
+}
+
+func (r *rewriter) rewrite(batch replayBatch) replayBatch {
+	rewritten := make(replayBatch, 0, len(batch))
+	for _, msg := range batch {
+		msg.Time = msg.Time.Add(r.offset)
+		if r.ids != nil {
+			msg.Record = r.replaceRequestIDs(msg)
+		}
+		rewritten = append(rewritten, msg)
+	}
+	return rewritten
+}
+
+// replaceRequestIDs replaces the request ids in the record, including the ones written by the runtime in the function
+// logs. A request id is known by the platform logs with it, which come before the function logs of the invocation.
+func (r *rewriter) replaceRequestIDs(msg logservice.Message) json.RawMessage {
+	var record struct {
+		RequestID string `json:"requestId"`
+	}
+	if bytes.HasPrefix(msg.Record, []byte("{")) && json.Unmarshal(msg.Record, &record) == nil && record.RequestID != "" {
+		if _, ok := r.ids[record.RequestID]; !ok {
+			r.ids[record.RequestID] = newRequestID()
+		}
+	}
+	content := []byte(msg.Record)
+	for captured, id := range r.ids {
+		content = bytes.ReplaceAll(content, []byte(captured), []byte(id))
+	}
+	return content
+}
+
+// newRequestID returns a random request id in the format of UUID
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	s := hex.EncodeToString(b)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// printer is the forwarder of the dry run, which prints the logs as JSON lines
+type printer struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func newPrinter(out io.Writer) *printer {
+	return &printer{out: out}
+}
+
+func (p *printer) Name() string                                { return "printer" }
+func (p *printer) SetupConfigs(_ *kingpin.Application)         {}
+func (p *printer) Init(_ forwardservice.ForwarderParams) error { return nil }
+func (p *printer) IsEnable() bool                              { return true }
+func (p *printer) Flush(_ context.Context) error               { return nil }
+func (p *printer) Shutdown(_ context.Context) error            { return nil }
+
+func (p *printer) Send(_ context.Context, logs []logservice.Log) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	encoder := json.NewEncoder(p.out)
+	for _, log := range logs {
+		err := encoder.Encode(map[string]interface{}{
+			"time":        log.Time,
+			"type":        log.Type,
+			"requestId":   log.RequestID,
+			"functionArn": log.FunctionArn,
+			"level":       log.Level.String(),
+			"fields":      log.Fields,
+			"metadata":    log.Metadata,
+			"content":     json.RawMessage(log.Content),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
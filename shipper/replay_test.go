@@ -0,0 +1,151 @@
+package shipper
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/forwardservice"
+)
+
+const capturedRequestID = "6f7f0961-f834-4211-8a7a-f6fe80b88d56"
+
+// switchForwarder is the capture forwarder which is disabled by default
+type switchForwarder struct {
+	*captureForwarder
+	enable *bool
+}
+
+func init() {
+	forwardservice.Register("switch", func(_ string) forwardservice.ForwarderV2 {
+		return &switchForwarder{captureForwarder: capture}
+	})
+}
+
+func (f *switchForwarder) Name() string   { return "switch" }
+func (f *switchForwarder) IsEnable() bool { return *f.enable }
+
+func (f *switchForwarder) SetupConfigs(app *kingpin.Application) {
+	f.enable = app.Flag("switch-enable", "Enable the switch forwarder").Default("false").Bool()
+}
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The batches of a file are NDJSON, and a file could be a pretty printed batch
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "1.ndjson"), []byte(`
+[{"time":"2020-08-20T12:31:32.123Z","type":"platform.start","record":{"requestId":"`+capturedRequestID+`"}}]
+[{"time":"2020-08-20T12:31:32.200Z","type":"function","record":"2020-08-20T12:31:32.200Z\t`+capturedRequestID+`\tINFO\thello\n"}]
+`), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "2.json"), []byte(`[
+	{"time": "2020-08-20T12:31:33.123Z", "type": "function", "record": "{\"level\":\"error\",\"msg\":\"boom\"}"},
+	{"time": "2020-08-20T12:31:33.200Z", "type": "platform.runtimeDone", "record": {"requestId": "`+capturedRequestID+`"}},
+	{"time": "2020-08-20T12:31:33.300Z", "type": "platform.report", "record": {"requestId": "`+capturedRequestID+`", "metrics": {"durationMs": 101.5}}}
+]`), 0644))
+
+	batches, err := readBatches(dir)
+	require.NoError(t, err)
+	require.Len(t, batches, 3)
+
+	out := &bytes.Buffer{}
+	start := time.Now()
+	require.NoError(t, replay([]string{"--log-level", "error", "--dry-run", "--new-request-ids", "--rebase-time", dir}, out))
+
+	type printed struct {
+		Time        time.Time              `json:"time"`
+		Type        string                 `json:"type"`
+		RequestID   string                 `json:"requestId"`
+		FunctionArn string                 `json:"functionArn"`
+		Level       string                 `json:"level"`
+		Fields      map[string]interface{} `json:"fields"`
+	}
+	var logs []printed
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		var log printed
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &log))
+		logs = append(logs, log)
+	}
+	require.Len(t, logs, 3)
+	assert.Equal(t, []string{"function", "function", "platform.report"}, []string{logs[0].Type, logs[1].Type, logs[2].Type})
+	assert.Equal(t, "error", logs[1].Level)
+	assert.Equal(t, "boom", logs[1].Fields["msg"])
+	for _, log := range logs {
+		assert.NotEqual(t, capturedRequestID, log.RequestID)
+		assert.Equal(t, logs[0].RequestID, log.RequestID)
+		assert.True(t, strings.HasSuffix(log.FunctionArn, ":function:replay"))
+		assert.False(t, log.Time.Before(start))
+	}
+}
+
+func TestReplay_forwarder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "captured.ndjson")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`[{"time":"2020-08-20T12:31:32.123Z","type":"platform.start","record":{"requestId":"`+capturedRequestID+`"}},`+
+		`{"time":"2020-08-20T12:31:32.200Z","type":"function","record":"hello"}]`), 0644))
+
+	// Only the forwarder is built, and the routes of other forwarders are not applied
+	capture.reset()
+	out := &bytes.Buffer{}
+	require.NoError(t, replay([]string{"--log-level", "error", "--forwarder", "capture", "--routes", "level>=error -> newrelic", file}, out))
+	logs := capture.reset()
+	require.Len(t, logs, 1)
+	assert.Equal(t, `"hello"`, string(logs[0].Content))
+	assert.Empty(t, out.String())
+
+	// The forwarder is enabled even if it is disabled by its settings
+	require.NoError(t, replay([]string{"--log-level", "error", "--forwarder", "switch", "--no-switch-enable", file}, out))
+	assert.Len(t, capture.reset(), 1)
+
+	for _, name := range []string{"unknown", "*", "capture,newrelic"} {
+		assert.Error(t, replay([]string{"--log-level", "error", "--forwarder", name, file}, out), name)
+	}
+
+	// The settings referring to secrets are resolved
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	ssm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"Parameter": {"Value": "arn:aws:lambda:us-east-1:123456789012:function:resolved"}}`))
+	}))
+	defer ssm.Close()
+	require.NoError(t, replay([]string{"--log-level", "error", "--forwarder", "capture",
+		"--function-arn", "ssm:/replay/function-arn", "--secrets-ssm-endpoint", ssm.URL, file}, out))
+	logs = capture.reset()
+	require.Len(t, logs, 1)
+	assert.Equal(t, "arn:aws:lambda:us-east-1:123456789012:function:resolved", logs[0].FunctionArn)
+}
+
+func TestReadBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "invalid.ndjson")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`[{"time":"2020-08-20T12:31:32.123Z","type":"function","record":"hello"}]
+{"time":"2020-08-20T12:31:32.123Z","type":"function","record":"world"}
+["invalid"]`), 0644))
+	_, err = readBatches(file)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "replay: "+file+": invalid batch 3")
+
+	_, err = readBatches(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,470 @@
+// Package shipper runs the extension. A custom binary of the extension registers its own forwarders by importing their
+// packages, and then calls Main:
+//
+//	import (
+//		"github.com/david7482/lambda-extension-log-shipper/shipper"
+//
+//		_ "github.com/david7482/lambda-extension-log-shipper/forwardservice/forwarders/all"
+//		_ "example.com/acme/splunk"
+//	)
+//
+//	func main() {
+//		shipper.Main()
+//	}
+package shipper
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/configfile"
+	"github.com/david7482/lambda-extension-log-shipper/extension"
+	"github.com/david7482/lambda-extension-log-shipper/forwardservice"
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/metrics"
+	"github.com/david7482/lambda-extension-log-shipper/processservice"
+	"github.com/david7482/lambda-extension-log-shipper/processservice/processors/enrich"
+	"github.com/david7482/lambda-extension-log-shipper/processservice/processors/filter"
+	"github.com/david7482/lambda-extension-log-shipper/processservice/processors/logmetrics"
+	"github.com/david7482/lambda-extension-log-shipper/processservice/processors/sampler"
+	"github.com/david7482/lambda-extension-log-shipper/processservice/processors/transform"
+	"github.com/david7482/lambda-extension-log-shipper/redact"
+	"github.com/david7482/lambda-extension-log-shipper/secrets"
+	"github.com/david7482/lambda-extension-log-shipper/spill"
+	"github.com/david7482/lambda-extension-log-shipper/utils"
+)
+
+const (
+	// MaxItems is the maximum number of events to be buffered in memory. (default: 10000, minimum: 1000, maximum: 10000)
+	maxItems = 10000
+	// MaxBytes is the maximum size in bytes of the logs to be buffered in memory. (default: 262144, minimum: 262144, maximum: 1048576)
+	maxBytes = 262144
+	// TimeoutMS is the maximum time (in milliseconds) for a batch to be buffered. (default: 1000, minimum: 100, maximum: 30000)
+	timeoutMS = 1000
+)
+
+// The settings deciding the forwarders, which are looked up before the args are parsed
+const (
+	forwardersFlag          = "forwarders"
+	forwardersEnvar         = "LS_FORWARDERS"
+	forwarderInstancesFlag  = "forwarder-instances"
+	forwarderInstancesEnvar = "LS_FORWARDER_INSTANCES"
+)
+
+var (
+	extensionName = filepath.Base(os.Args[0]) // extension name has to match the filename
+	logTypes      = []extension.LogType{extension.Platform, extension.Function}
+)
+
+// components are the parts of the pipeline which hold configs or state, so they are created by each run of the
+// extension or the replay
+type components struct {
+	processors []processservice.Processor
+	// forwarders are built from the registered forwarders by the settings
+	forwarders []forwardservice.ForwarderV2
+	redactor   *redact.Redactor
+	spillStore *spill.Store
+	registry   *metrics.Registry
+	configFile *configfile.File
+	resolver   *secrets.Resolver
+}
+
+func newComponents() *components {
+	return &components{
+		processors: []processservice.Processor{enrich.New(), transform.New(), logmetrics.New(), filter.New(), sampler.New()},
+		redactor:   redact.New(),
+		spillStore: spill.New(),
+		registry:   metrics.New(),
+		configFile: configfile.New(),
+		resolver:   secrets.New(),
+	}
+}
+
+type generalConfig struct {
+	AWSLambdaName        *string
+	AWSRegion            *string
+	AWSRuntimeAPI        *string
+	ListenPort           *int
+	LogLevel             *string
+	LogTimeFormat        *string
+	EnablePlatformReport *bool
+	ParseFormats         *string
+	MinLevel             *string
+	MultilinePresets     *string
+	MultilineStart       *string
+	MultilineTimeout     *time.Duration
+	MultilineMaxLines    *int
+	MultilineMaxBytes    *int
+	Routes               *forwardservice.Routes
+	DefaultRoute         *string
+	Forwarders           *string
+	ForwarderInstances   *string
+}
+
+func setupGeneralConfigs(app *kingpin.Application) generalConfig {
+	var config generalConfig
+
+	// the followings would read from lambda runtime environment variables
+	config.AWSLambdaName = app.
+		Flag("lambda-name", "The name of the lambda function").
+		Envar("AWS_LAMBDA_FUNCTION_NAME").
+		Required().String()
+	config.AWSRegion = app.
+		Flag("region", "The AWS Region where the Lambda function is executed").
+		Envar("AWS_REGION").
+		Required().String()
+	config.AWSRuntimeAPI = app.
+		Flag("runtime-api", "The endpoint URL of lambda extension runtime API").
+		Envar("AWS_LAMBDA_RUNTIME_API").
+		Required().String()
+	config.ListenPort = app.
+		Flag("listen-port", "The port that the log server listens on for the Logs API").
+		Envar("LS_LISTEN_PORT").
+		Default("8443").Int()
+
+	setupPipelineConfigs(app, &config)
+	return config
+}
+
+// setupPipelineConfigs setups the general settings of the pipeline, which are shared by the extension and the replay
+func setupPipelineConfigs(app *kingpin.Application, config *generalConfig) {
+	// the followings are general settings
+	config.LogLevel = app.
+		Flag("log-level", "The level of the internal logger").
+		Envar("LS_LOG_LEVEL").
+		Default("info").Enum("error", "warn", "info", "debug")
+	config.LogTimeFormat = app.
+		Flag("log-timeformat", "The time format of the internal logger").
+		Envar("LS_LOG_TIMEFORMAT").
+		Default("2006-01-02T15:04:05.000Z07:00").String()
+	config.EnablePlatformReport = app.
+		Flag("enable-platform-report", "Send Lambda platform report to all forwarders").
+		Envar("LS_ENABLE_PLATFORM_REPORT").
+		Default("true").Bool()
+	config.ParseFormats = app.
+		Flag("parse-formats", "The comma separated formats (json, logfmt, runtime) to parse function logs into structured fields").
+		Envar("LS_PARSE_FORMATS").
+		Default("json,runtime").String()
+	config.MinLevel = app.
+		Flag("min-level", "The minimum level of logs sent to all forwarders").
+		Envar("LS_MIN_LEVEL").
+		Default("trace").Enum(logservice.LevelNames...)
+
+	// the followings are multiline aggregation settings
+	config.MultilinePresets = app.
+		Flag("multiline-presets", "The comma separated built-in rules (go, java, node, python) to join multiline logs").
+		Envar("LS_MULTILINE_PRESETS").
+		Default("").String()
+	config.MultilineStart = app.
+		Flag("multiline-start-pattern", "The regex matching the first line of a multiline log").
+		Envar("LS_MULTILINE_START_PATTERN").
+		Default("").String()
+	config.MultilineTimeout = app.
+		Flag("multiline-flush-timeout", "The time to wait for the next line before a multiline log is flushed").
+		Envar("LS_MULTILINE_FLUSH_TIMEOUT").
+		Default("1s").Duration()
+	config.MultilineMaxLines = app.
+		Flag("multiline-max-lines", "The maximum number of lines of a multiline log").
+		Envar("LS_MULTILINE_MAX_LINES").
+		Default("500").Int()
+	config.MultilineMaxBytes = app.
+		Flag("multiline-max-bytes", "The maximum size in bytes of a multiline log").
+		Envar("LS_MULTILINE_MAX_BYTES").
+		Default("65536").Int()
+
+	// the followings are routing settings
+	config.Routes = new(forwardservice.Routes)
+	app.
+		Flag("routes", "The semicolon separated routing rules, e.g. type=platform.report -> newrelic; level>=error -> stdout stop").
+		Envar("LS_ROUTES").
+		Default("").SetValue(config.Routes)
+	config.DefaultRoute = app.
+		Flag("default-route", "The comma separated forwarders of logs matching no route, * is all forwarders").
+		Envar("LS_DEFAULT_ROUTE").
+		Default(forwardservice.AllForwarders).String()
+	config.Forwarders = app.
+		Flag(forwardersFlag, "The comma separated forwarders to build, * is all registered forwarders").
+		Envar(forwardersEnvar).
+		Default(forwardservice.AllForwarders).String()
+	config.ForwarderInstances = app.
+		Flag(forwarderInstancesFlag, "The comma separated named instances of forwarders, e.g. newrelic-team,newrelic-platform").
+		Envar(forwarderInstancesEnvar).
+		Default("").String()
+}
+
+// parsingParams returns the parsing settings of the log service by the configs
+func parsingParams(cfg generalConfig) (logservice.ServiceParams, error) {
+	parseFormats, err := logservice.ParseFormats(*cfg.ParseFormats)
+	if err != nil {
+		return logservice.ServiceParams{}, err
+	}
+	minLevel, _ := logservice.ParseLevel(*cfg.MinLevel)
+	multiline, err := logservice.NewMultiline(logservice.MultilineParams{
+		Presets:      utils.SplitList(*cfg.MultilinePresets),
+		StartPattern: *cfg.MultilineStart,
+		FlushTimeout: *cfg.MultilineTimeout,
+		MaxLines:     *cfg.MultilineMaxLines,
+		MaxBytes:     *cfg.MultilineMaxBytes,
+	})
+	if err != nil {
+		return logservice.ServiceParams{}, err
+	}
+	return logservice.ServiceParams{
+		EnablePlatformReport: *cfg.EnablePlatformReport,
+		ParseFormats:         parseFormats,
+		MinLevel:             minLevel,
+		Multiline:            multiline,
+	}, nil
+}
+
+func (c *components) setupProcessorConfigs(app *kingpin.Application) {
+	// let each processor setup its own configurations
+	for _, p := range c.processors {
+		p.SetupConfigs(app)
+	}
+}
+
+// setupForwarders builds the forwarders and their named instances, which have to be known before their configurations
+// are setup, so the settings are looked up before the args are parsed
+func (c *components) setupForwarders(args []string) error {
+	types, err := c.configFile.Lookup(args, forwardersFlag, forwardersEnvar)
+	if err != nil {
+		return err
+	}
+	if types == "" {
+		types = forwardservice.AllForwarders
+	}
+	value, err := c.configFile.Lookup(args, forwarderInstancesFlag, forwarderInstancesEnvar)
+	if err != nil {
+		return err
+	}
+	instances, err := forwardservice.ParseInstances(value, forwardservice.Types())
+	if err != nil {
+		return err
+	}
+	c.forwarders, err = forwardservice.Build(utils.SplitList(types), instances)
+	return err
+}
+
+func (c *components) setupForwarderConfigs(app *kingpin.Application) map[string]forwardservice.ForwarderOptions {
+	// let each forwarder setup its own configurations
+	options := make(map[string]forwardservice.ForwarderOptions)
+	for _, f := range c.forwarders {
+		f.SetupConfigs(app)
+		options[f.Name()] = forwardservice.SetupForwarderOptions(app, f.Name())
+	}
+	return options
+}
+
+// Main runs the extension with the registered forwarders, and exits with its exit code
+func Main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs the extension with the args until it is shutdown or fails, and returns the exit code
+func run(args []string) int {
+	// Setup configurations
+	app := kingpin.New("lambda-extension-log-shipper", "Lambda Extension Log Shipper")
+	c := newComponents()
+	cfg := setupGeneralConfigs(app)
+	c.setupProcessorConfigs(app)
+	c.redactor.SetupConfigs(app)
+	c.spillStore.SetupConfigs(app)
+	c.registry.SetupConfigs(app)
+	c.resolver.SetupConfigs(app)
+	c.configFile.SetupConfigs(app)
+
+	// The errors are reported to the Extensions API, whose endpoint is taken from the environment until the flags are parsed
+	rootLogger := zerolog.New(os.Stdout).With().Timestamp().Logger()
+	rep := &reporter{}
+	if runtimeAPI := os.Getenv("AWS_LAMBDA_RUNTIME_API"); runtimeAPI != "" {
+		rep.setClient(extension.NewClient(runtimeAPI))
+	}
+
+	// the config file sets the defaults of the flags, so it is loaded before the flags are parsed
+	if err := c.configFile.Load(args); err != nil {
+		return rep.fail(&rootLogger, extension.NewError(extension.ConfigInvalid, err))
+	}
+	if err := c.setupForwarders(args); err != nil {
+		return rep.fail(&rootLogger, extension.NewError(extension.ConfigInvalid, err))
+	}
+	forwarderOptions := c.setupForwarderConfigs(app)
+	if err := c.configFile.Apply(app); err != nil {
+		return rep.fail(&rootLogger, extension.NewError(extension.ConfigInvalid, err))
+	}
+	if _, err := app.Parse(args); err != nil {
+		return rep.fail(&rootLogger, extension.NewError(extension.ConfigInvalid, err))
+	}
+	extensionClient := extension.NewClient(*cfg.AWSRuntimeAPI)
+	rep.setClient(extensionClient)
+
+	// Setup zerolog
+	lvl, _ := zerolog.ParseLevel(*cfg.LogLevel)
+	zerolog.SetGlobalLevel(lvl)
+	zerolog.TimeFieldFormat = *cfg.LogTimeFormat
+
+	// Create root context
+	rootCtx, rootCtxCancelFunc := context.WithCancel(context.Background())
+	defer rootCtxCancelFunc()
+	rootCtx = rootLogger.WithContext(rootCtx)
+
+	rootLogger.Info().Interface("config", cfg).Str("configFile", c.configFile.Path()).Msg("lambda-extension-log-shipper start...")
+
+	// Resolve the configs referring to secrets before they are used by any component
+	c.resolver.Init(secrets.Params{AWSRegion: *cfg.AWSRegion})
+	if err := c.resolver.Resolve(app); err != nil {
+		return rep.fail(&rootLogger, extension.NewError(extension.ConfigInvalid, err))
+	}
+
+	parsing, err := parsingParams(cfg)
+	if err != nil {
+		return rep.fail(&rootLogger, extension.NewError(extension.ConfigInvalid, err))
+	}
+
+	defaultRoute := utils.SplitList(*cfg.DefaultRoute)
+	if err := forwardservice.ValidateRoutes(*cfg.Routes, defaultRoute, c.forwarders); err != nil {
+		return rep.fail(&rootLogger, extension.NewError(extension.ConfigInvalid, err))
+	}
+
+	// Register extension as soon as possible
+	registerRes, err := extensionClient.RegisterExtension(rootCtx, extensionName)
+	if err != nil {
+		return rep.fail(&rootLogger, err)
+	}
+
+	// Report the metrics of the pipeline periodically
+	c.registry.Init(metrics.Params{LambdaName: *cfg.AWSLambdaName})
+	c.registry.Run(rootCtx)
+
+	// Create the logs queues
+	logsQueue := make(chan []logservice.Log, 8)
+	processedQueue := make(chan []logservice.Log, 8)
+
+	// The forwarders are initialized before any service starts, so that nothing is left running if one of them fails
+	forwardSrv, err := forwardservice.New(forwardservice.ServiceParams{
+		Forwarders:       c.forwarders,
+		ForwarderOptions: forwarderOptions,
+		Redactor:         c.redactor,
+		Spill:            c.spillStore,
+		Metrics:          c.registry,
+		Routes:           *cfg.Routes,
+		DefaultRoute:     defaultRoute,
+		LogsQueue:        processedQueue,
+		LambdaName:       *cfg.AWSLambdaName,
+		AWSRegion:        *cfg.AWSRegion,
+	})
+	if err != nil {
+		return rep.fail(&rootLogger, err)
+	}
+
+	// Start services
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	logSrv := logservice.New(logservice.ServiceParams{
+		LogAPIClient:         extensionClient,
+		LogTypes:             logTypes,
+		LogsQueue:            logsQueue,
+		ListenPort:           *cfg.ListenPort,
+		MaxItems:             maxItems,
+		MaxBytes:             maxBytes,
+		TimeoutMS:            timeoutMS,
+		EnablePlatformReport: parsing.EnablePlatformReport,
+		ParseFormats:         parsing.ParseFormats,
+		MinLevel:             parsing.MinLevel,
+		Multiline:            parsing.Multiline,
+		Metrics:              c.registry,
+	})
+	if err := logSrv.Run(rootCtx, &wg); err != nil {
+		return rep.fail(&rootLogger, err)
+	}
+	// The log service stops once it fails to serve the logs, and the extension stops waiting for the next event and
+	// exits with its error
+	serveErr := make(chan error, 1)
+	go func() {
+		select {
+		case err := <-logSrv.Err():
+			serveErr <- err
+			rootCtxCancelFunc()
+		case <-rootCtx.Done():
+		}
+	}()
+
+	wg.Add(1)
+	processSrv := processservice.New(processservice.ServiceParams{
+		Processors:      c.processors,
+		LogsQueue:       logsQueue,
+		OutputQueue:     processedQueue,
+		LambdaName:      *cfg.AWSLambdaName,
+		AWSRegion:       *cfg.AWSRegion,
+		FunctionVersion: registerRes.FunctionVersion,
+		Handler:         registerRes.Handler,
+		Metrics:         c.registry,
+	})
+	processSrv.Run(rootCtx, &wg)
+
+	wg.Add(1)
+	forwardSrv.Run(rootCtx, &wg)
+
+	// Listen to SIGTEM/SIGINT to close
+	var gracefulStop = make(chan os.Signal, 1)
+	signal.Notify(gracefulStop, syscall.SIGTERM, syscall.SIGINT)
+
+	// Will block until invoke or shutdown event is received or cancelled via the context.
+	rep.start()
+	reason := "signal"
+	var deadlineMs int64
+LOOP:
+	for {
+		select {
+		case s := <-gracefulStop:
+			rootLogger.Info().Msgf("received signal to terminate: %s", s.String())
+			break LOOP
+		default:
+			// This is a blocking call
+			res, err := extensionClient.NextEvent(rootCtx)
+			if err != nil {
+				rootCtxCancelFunc()
+				select {
+				case err = <-serveErr:
+				default:
+					err = fmt.Errorf("shipper: fail to invoke NextEvent: %w", err)
+				}
+				return rep.fail(&rootLogger, err)
+			}
+
+			// Exit if we receive a SHUTDOWN event
+			if res.EventType == extension.Shutdown {
+				rootLogger.Info().Str("reason", string(res.ShutdownReason)).Int64("deadlineMs", res.DeadlineMs).Msg("received SHUTDOWN event")
+				reason, deadlineMs = string(res.ShutdownReason), res.DeadlineMs
+				break LOOP
+			}
+
+			// Link the logs of this invocation with its request id, function arn and tracing
+			logSrv.AddInvocation(res)
+		}
+	}
+
+	// Shutdown the services within the deadline of the SHUTDOWN event
+	shutdown(&rootLogger, shutdownParams{
+		reason:         reason,
+		budget:         newShutdownBudget(time.Now(), deadlineMs),
+		logSrv:         logSrv,
+		processSrv:     processSrv,
+		forwardSrv:     forwardSrv,
+		logsQueue:      logsQueue,
+		processedQueue: processedQueue,
+		registry:       c.registry,
+	})
+	rootCtxCancelFunc()
+	c.registry.Report()
+	return 0
+}
@@ -0,0 +1,100 @@
+package shipper
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/david7482/lambda-extension-log-shipper/extension"
+	"github.com/david7482/lambda-extension-log-shipper/forwardservice"
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/metrics"
+	"github.com/david7482/lambda-extension-log-shipper/processservice"
+)
+
+const (
+	// defaultShutdownBudget is the time to shutdown when there is no deadline, e.g. terminated by a signal
+	defaultShutdownBudget = 2 * time.Second
+	// shutdownMargin is kept before the deadline to report the summary
+	shutdownMargin = 50 * time.Millisecond
+)
+
+// The shares of the shutdown budget at the end of each phase, and the forwarders are flushed until the deadline
+const (
+	intakeShare = 0.3
+	drainShare  = 0.5
+)
+
+// shutdownBudget splits the time until the deadline of the SHUTDOWN event into the phases of the shutdown
+type shutdownBudget struct {
+	start    time.Time
+	deadline time.Time
+}
+
+func newShutdownBudget(now time.Time, deadlineMs int64) shutdownBudget {
+	deadline := now.Add(defaultShutdownBudget)
+	if deadlineMs > 0 {
+		deadline = time.Unix(0, deadlineMs*int64(time.Millisecond))
+	}
+	deadline = deadline.Add(-shutdownMargin)
+	if deadline.Before(now) {
+		deadline = now
+	}
+	return shutdownBudget{start: now, deadline: deadline}
+}
+
+// until returns the end of the phase at the share of the budget
+func (b shutdownBudget) until(share float64) time.Time {
+	return b.start.Add(time.Duration(float64(b.deadline.Sub(b.start)) * share))
+}
+
+type shutdownParams struct {
+	reason         string
+	budget         shutdownBudget
+	logSrv         *logservice.LogService
+	processSrv     *processservice.ProcessService
+	forwardSrv     *forwardservice.ForwardService
+	logsQueue      chan []logservice.Log
+	processedQueue chan []logservice.Log
+	registry       *metrics.Registry
+}
+
+// shutdown stops the services in phases within the budget: stop receiving logs, drain the processors, flush the
+// forwarders in parallel, and then report what is delivered and what is left behind
+func shutdown(logger *zerolog.Logger, p shutdownParams) {
+	logger.Info().Str("reason", p.reason).Dur("budget", p.budget.deadline.Sub(p.budget.start)).Msg("shutdown start")
+
+	ctx, cancel := context.WithDeadline(context.Background(), p.budget.until(intakeShare))
+	if err := p.logSrv.Shutdown(ctx); err != nil {
+		logger.Warn().Err(err).Msg("fail to wait for the logs in flight")
+	}
+	cancel()
+
+	ctx, cancel = context.WithDeadline(context.Background(), p.budget.until(drainShare))
+	if err := p.processSrv.Wait(ctx); err != nil {
+		logger.Warn().Err(err).Msg("fail to drain the processors")
+	}
+	cancel()
+
+	ctx, cancel = context.WithDeadline(context.Background(), p.budget.deadline)
+	p.forwardSrv.Shutdown(ctx)
+	if err := p.forwardSrv.Wait(ctx); err != nil {
+		logger.Warn().Err(err).Msg("fail to flush the forwarders")
+	}
+	cancel()
+
+	e := logger.Info()
+	if p.reason == string(extension.Timeout) || p.reason == string(extension.Failure) {
+		e = logger.Warn()
+	}
+	e.Str("reason", p.reason).
+		Uint64("received", p.registry.Total(metrics.LogRecords)).
+		Uint64("delivered", p.registry.Total(metrics.ForwarderSent)).
+		Uint64("failed", p.registry.Total(metrics.ForwarderFailed)).
+		Uint64("spilled", p.registry.Total(metrics.ForwarderSpilled)).
+		Uint64("dropped", p.registry.Total(metrics.DroppedLogs)+p.registry.Total(metrics.ForwarderDropped)).
+		Int("leftBatches", len(p.logsQueue)+len(p.processedQueue)).
+		Dur("elapsed", time.Since(p.budget.start)).
+		Msg("shutdown summary")
+}
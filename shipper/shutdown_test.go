@@ -0,0 +1,25 @@
+package shipper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdownBudget(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	b := newShutdownBudget(now, 1600000000*1000+1050)
+	assert.Equal(t, now.Add(time.Second), b.deadline)
+	assert.Equal(t, now.Add(300*time.Millisecond), b.until(intakeShare))
+	assert.Equal(t, now.Add(500*time.Millisecond), b.until(drainShare))
+
+	// A signal has no deadline
+	b = newShutdownBudget(now, 0)
+	assert.Equal(t, now.Add(defaultShutdownBudget-shutdownMargin), b.deadline)
+
+	// The deadline is already passed
+	b = newShutdownBudget(now, 1600000000*1000-10)
+	assert.Equal(t, now, b.deadline)
+	assert.Equal(t, now, b.until(drainShare))
+}
@@ -0,0 +1,69 @@
+package spill
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// A segment file is a sequence of records, each record is a batch of logs:
+//
+//	magic (4 bytes) | payload length (uint32) | payload CRC-32 (uint32) | payload (gzipped JSON of logs)
+//
+// A record which is truncated, e.g. the extension is killed while writing it, or whose checksum mismatches is
+// skipped, and the reader resyncs at the next magic.
+var recordMagic = []byte("LSR1")
+
+const recordHeaderSize = 12
+
+// maxRecordSize protects the reader from allocating a huge buffer for a corrupted length
+const maxRecordSize = 64 << 20
+
+func encodeRecord(payload []byte) []byte {
+	record := make([]byte, recordHeaderSize+len(payload))
+	copy(record, recordMagic)
+	binary.BigEndian.PutUint32(record[4:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[8:], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeaderSize:], payload)
+	return record
+}
+
+// decodeRecords returns the payloads of the valid records in data and the number of corrupted regions skipped
+func decodeRecords(data []byte) ([][]byte, int) {
+	var payloads [][]byte
+	corrupted := 0
+	resyncing := false
+	for len(data) > 0 {
+		if payload, size, ok := decodeRecord(data); ok {
+			payloads = append(payloads, payload)
+			data = data[size:]
+			resyncing = false
+			continue
+		}
+		if !resyncing {
+			corrupted++
+			resyncing = true
+		}
+		next := bytes.Index(data[1:], recordMagic)
+		if next < 0 {
+			break
+		}
+		data = data[1+next:]
+	}
+	return payloads, corrupted
+}
+
+func decodeRecord(data []byte) ([]byte, int, bool) {
+	if len(data) < recordHeaderSize || !bytes.Equal(data[:4], recordMagic) {
+		return nil, 0, false
+	}
+	length := binary.BigEndian.Uint32(data[4:])
+	if length > maxRecordSize || int(length) > len(data)-recordHeaderSize {
+		return nil, 0, false
+	}
+	payload := data[recordHeaderSize : recordHeaderSize+int(length)]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[8:]) {
+		return nil, 0, false
+	}
+	return payload, recordHeaderSize + int(length), true
+}
@@ -0,0 +1,278 @@
+package spill
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+	"github.com/david7482/lambda-extension-log-shipper/utils"
+)
+
+const segmentExt = ".seg"
+
+// maxSegmentSize is the size at which a new segment file is started
+const maxSegmentSize = 1 << 20
+
+// Store creates the disk buffers of forwarders. Each forwarder spills its undelivered logs into its own directory.
+type Store struct {
+	cfg    config
+	logger zerolog.Logger
+}
+
+type config struct {
+	Enable   *bool
+	Dir      *string
+	MaxBytes *int64
+}
+
+func New() *Store {
+	return &Store{
+		logger: zerolog.New(os.Stdout).With().Str("component", "spill").Timestamp().Logger(),
+	}
+}
+
+func (s *Store) SetupConfigs(app *kingpin.Application) {
+	s.cfg.Enable = app.
+		Flag("spill-enable", "Spill the logs which could not be delivered to disk, and retry them later").
+		Envar("LS_SPILL_ENABLE").
+		Default("true").Bool()
+	s.cfg.Dir = app.
+		Flag("spill-dir", "The directory of the spilled logs").
+		Envar("LS_SPILL_DIR").
+		Default(filepath.Join(os.TempDir(), "lambda-extension-log-shipper")).String()
+	s.cfg.MaxBytes = app.
+		Flag("spill-max-bytes", "The maximum size of spilled logs of each forwarder, the oldest logs are evicted when it is full").
+		Envar("LS_SPILL_MAX_BYTES").
+		Default("33554432").Int64()
+}
+
+func (s *Store) IsEnable() bool {
+	return *s.cfg.Enable && *s.cfg.MaxBytes > 0
+}
+
+// Open returns the buffer of the named forwarder. The logs spilled by previous invocations are kept.
+func (s *Store) Open(name string) (*Buffer, error) {
+	dir := filepath.Join(*s.cfg.Dir, name)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("spill: fail to create dir: %w", err)
+	}
+	b := &Buffer{
+		dir:            dir,
+		maxBytes:       *s.cfg.MaxBytes,
+		maxSegmentSize: maxSegmentSize,
+	}
+	if b.maxSegmentSize > b.maxBytes/4 {
+		b.maxSegmentSize = b.maxBytes / 4
+	}
+	segments, err := b.segments()
+	if err != nil {
+		return nil, err
+	}
+	b.pending = len(segments) > 0
+	if len(segments) > 0 {
+		b.seq = segments[len(segments)-1].seq
+	}
+	s.logger.Debug().Str("forwarder", name).Int("segments", len(segments)).Msg("spill buffer is opened")
+	return b, nil
+}
+
+// Buffer is a persistent FIFO of log batches in segment files. It is not safe for concurrent use.
+type Buffer struct {
+	dir            string
+	maxBytes       int64
+	maxSegmentSize int64
+	seq            uint64
+	pending        bool
+
+	stats Stats
+}
+
+// Stats are the counters of a buffer
+type Stats struct {
+	Spilled         uint64
+	Replayed        uint64
+	Evicted         uint64
+	EvictedSegments uint64
+	Corrupted       uint64
+}
+
+type segment struct {
+	seq  uint64
+	path string
+	size int64
+}
+
+// IsEmpty tells whether there is no spilled logs
+func (b *Buffer) IsEmpty() bool {
+	return !b.pending
+}
+
+// Stats returns the counters of spilled, replayed and evicted batches
+func (b *Buffer) Stats() Stats {
+	return b.stats
+}
+
+// Push appends the logs to the newest segment, and evicts the oldest segments if the buffer is full
+func (b *Buffer) Push(logs []logservice.Log) error {
+	uncompressed, err := json.Marshal(logs)
+	if err != nil {
+		return fmt.Errorf("spill: fail to marshal logs: %w", err)
+	}
+	compressed, err := utils.Compress(uncompressed)
+	if err != nil {
+		return fmt.Errorf("spill: fail to compress logs: %w", err)
+	}
+	record := encodeRecord(compressed.Bytes())
+
+	segments, err := b.segments()
+	if err != nil {
+		return err
+	}
+	if len(segments) == 0 || segments[len(segments)-1].size+int64(len(record)) > b.maxSegmentSize {
+		b.seq++
+		segments = append(segments, segment{seq: b.seq, path: b.segmentPath(b.seq)})
+	}
+	newest := &segments[len(segments)-1]
+
+	f, err := os.OpenFile(newest.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("spill: fail to open segment: %w", err)
+	}
+	_, err = f.Write(record)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("spill: fail to write segment: %w", err)
+	}
+	newest.size += int64(len(record))
+	b.stats.Spilled++
+	b.pending = true
+
+	return b.evict(segments)
+}
+
+// evict removes the oldest segments until the total size is within the limit
+func (b *Buffer) evict(segments []segment) error {
+	var total int64
+	for _, seg := range segments {
+		total += seg.size
+	}
+	for len(segments) > 0 && total > b.maxBytes {
+		data, err := ioutil.ReadFile(segments[0].path)
+		if err != nil {
+			return fmt.Errorf("spill: fail to read segment: %w", err)
+		}
+		payloads, _ := decodeRecords(data)
+		if err := os.Remove(segments[0].path); err != nil {
+			return fmt.Errorf("spill: fail to evict segment: %w", err)
+		}
+		b.stats.Evicted += uint64(len(payloads))
+		b.stats.EvictedSegments++
+		total -= segments[0].size
+		segments = segments[1:]
+	}
+	b.pending = len(segments) > 0
+	return nil
+}
+
+// Replay delivers the spilled batches oldest first, and removes them once delivered. It stops at the first
+// batch which could not be delivered and returns its error, so that the batch is retried by the next replay.
+func (b *Buffer) Replay(deliver func([]logservice.Log) error) error {
+	segments, err := b.segments()
+	if err != nil {
+		return err
+	}
+	for _, seg := range segments {
+		data, err := ioutil.ReadFile(seg.path)
+		if err != nil {
+			return fmt.Errorf("spill: fail to read segment: %w", err)
+		}
+		payloads, corrupted := decodeRecords(data)
+		b.stats.Corrupted += uint64(corrupted)
+
+		for i, payload := range payloads {
+			logs, err := decodeLogs(payload)
+			if err != nil {
+				// The checksum is valid, so the batch could never be decoded; drop it
+				b.stats.Corrupted++
+				continue
+			}
+			if err := deliver(logs); err != nil {
+				if rewriteErr := b.rewrite(seg, payloads[i:]); rewriteErr != nil {
+					return rewriteErr
+				}
+				return err
+			}
+			b.stats.Replayed++
+		}
+		if err := os.Remove(seg.path); err != nil {
+			return fmt.Errorf("spill: fail to remove segment: %w", err)
+		}
+	}
+	b.pending = false
+	return nil
+}
+
+// rewrite keeps only the undelivered records of the segment
+func (b *Buffer) rewrite(seg segment, payloads [][]byte) error {
+	var buf bytes.Buffer
+	for _, payload := range payloads {
+		buf.Write(encodeRecord(payload))
+	}
+	tmp := seg.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("spill: fail to rewrite segment: %w", err)
+	}
+	if err := os.Rename(tmp, seg.path); err != nil {
+		return fmt.Errorf("spill: fail to rewrite segment: %w", err)
+	}
+	return nil
+}
+
+func decodeLogs(payload []byte) ([]logservice.Log, error) {
+	uncompressed, err := utils.Decompress(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	var logs []logservice.Log
+	if err := json.Unmarshal(uncompressed, &logs); err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// segments returns the segment files ordered from the oldest
+func (b *Buffer) segments() ([]segment, error) {
+	files, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, fmt.Errorf("spill: fail to list segments: %w", err)
+	}
+	var segments []segment
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{seq: seq, path: filepath.Join(b.dir, f.Name()), size: f.Size()})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].seq < segments[j].seq })
+	return segments, nil
+}
+
+func (b *Buffer) segmentPath(seq uint64) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
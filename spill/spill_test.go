@@ -0,0 +1,153 @@
+package spill
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/david7482/lambda-extension-log-shipper/logservice"
+)
+
+func newTestStore(t *testing.T, maxBytes int64) *Store {
+	enable := true
+	dir, err := ioutil.TempDir("", "spill")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	s := New()
+	s.cfg = config{Enable: &enable, Dir: &dir, MaxBytes: &maxBytes}
+	return s
+}
+
+func batch(requestID string) []logservice.Log {
+	return []logservice.Log{
+		{Type: logservice.Function, RequestID: requestID, Content: []byte(`"hello"`), Level: logservice.InfoLevel},
+		{Type: logservice.PlatformReport, RequestID: requestID, Content: []byte(`{"durationMs":1}`)},
+	}
+}
+
+func replayed(t *testing.T, b *Buffer) []string {
+	var requestIDs []string
+	require.NoError(t, b.Replay(func(logs []logservice.Log) error {
+		requestIDs = append(requestIDs, logs[0].RequestID)
+		return nil
+	}))
+	return requestIDs
+}
+
+func TestBuffer_PushReplay(t *testing.T) {
+	store := newTestStore(t, 1<<20)
+	b, err := store.Open("newrelic")
+	require.NoError(t, err)
+	assert.True(t, b.IsEmpty())
+
+	require.NoError(t, b.Push(batch("1")))
+	require.NoError(t, b.Push(batch("2")))
+	assert.False(t, b.IsEmpty())
+
+	// the spilled logs are kept for the next invocations
+	reopened, err := store.Open("newrelic")
+	require.NoError(t, err)
+	require.False(t, reopened.IsEmpty())
+
+	var got [][]logservice.Log
+	require.NoError(t, reopened.Replay(func(logs []logservice.Log) error {
+		got = append(got, logs)
+		return nil
+	}))
+	require.Len(t, got, 2)
+	assert.Equal(t, batch("1")[0].Content, got[0][0].Content)
+	assert.Equal(t, batch("1")[1].Type, got[0][1].Type)
+	assert.Equal(t, "2", got[1][0].RequestID)
+	assert.True(t, reopened.IsEmpty())
+	assert.Equal(t, uint64(2), reopened.Stats().Replayed)
+
+	// other forwarders have their own buffers
+	other, err := store.Open("stdout")
+	require.NoError(t, err)
+	assert.True(t, other.IsEmpty())
+}
+
+func TestBuffer_ReplayFailure(t *testing.T) {
+	b, err := newTestStore(t, 1<<20).Open("newrelic")
+	require.NoError(t, err)
+	for _, requestID := range []string{"1", "2", "3"} {
+		require.NoError(t, b.Push(batch(requestID)))
+	}
+
+	// the destination is still down after the first batch
+	var delivered []string
+	err = b.Replay(func(logs []logservice.Log) error {
+		if len(delivered) == 1 {
+			return errors.New("unavailable")
+		}
+		delivered = append(delivered, logs[0].RequestID)
+		return nil
+	})
+	assert.EqualError(t, err, "unavailable")
+	assert.Equal(t, []string{"1"}, delivered)
+	assert.False(t, b.IsEmpty())
+
+	require.NoError(t, b.Push(batch("4")))
+	assert.Equal(t, []string{"2", "3", "4"}, replayed(t, b))
+}
+
+func TestBuffer_Evict(t *testing.T) {
+	b, err := newTestStore(t, 1<<20).Open("newrelic")
+	require.NoError(t, err)
+	require.NoError(t, b.Push(batch("1")))
+	segments, err := b.segments()
+	require.NoError(t, err)
+	size := segments[0].size
+
+	// each segment holds a batch, and the buffer holds 3 batches
+	b.maxSegmentSize = size
+	b.maxBytes = 3*size + size/2
+	for _, requestID := range []string{"2", "3", "4", "5"} {
+		require.NoError(t, b.Push(batch(requestID)))
+	}
+	assert.Equal(t, uint64(2), b.Stats().Evicted)
+	assert.Equal(t, []string{"3", "4", "5"}, replayed(t, b))
+}
+
+func TestBuffer_Corrupted(t *testing.T) {
+	b, err := newTestStore(t, 1<<20).Open("newrelic")
+	require.NoError(t, err)
+	for _, requestID := range []string{"1", "2", "3"} {
+		require.NoError(t, b.Push(batch(requestID)))
+	}
+	segments, err := b.segments()
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	data, err := ioutil.ReadFile(segments[0].path)
+	require.NoError(t, err)
+	recordSize := len(data) / 3
+
+	// flip a byte of the second record, and truncate the last record as if the write is interrupted
+	data[recordSize+recordHeaderSize+1] ^= 0xff
+	data = data[:len(data)-5]
+	require.NoError(t, ioutil.WriteFile(segments[0].path, data, 0o600))
+
+	assert.Equal(t, []string{"1"}, replayed(t, b))
+	assert.Equal(t, uint64(1), b.Stats().Corrupted)
+	files, err := ioutil.ReadDir(filepath.Dir(segments[0].path))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestDecodeRecords(t *testing.T) {
+	first, second := []byte("first"), []byte("second")
+	data := append(append(encodeRecord(first), []byte("garbage")...), encodeRecord(second)...)
+
+	payloads, corrupted := decodeRecords(data)
+	assert.Equal(t, [][]byte{first, second}, payloads)
+	assert.Equal(t, 1, corrupted)
+
+	payloads, corrupted = decodeRecords(nil)
+	assert.Empty(t, payloads)
+	assert.Equal(t, 0, corrupted)
+}
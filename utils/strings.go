@@ -0,0 +1,15 @@
+package utils
+
+import "strings"
+
+// SplitList splits a comma separated list, e.g. "a, b,,c", into its trimmed non-empty items.
+func SplitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}